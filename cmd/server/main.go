@@ -1,15 +1,48 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/longsolong/flow/pkg/execution/standalone/scheduler"
+	"github.com/longsolong/flow/pkg/execution/standalone/traverser"
 	"github.com/longsolong/flow/pkg/http/rest"
 	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/spec"
+	"github.com/longsolong/flow/pkg/registry"
+	"github.com/longsolong/flow/pkg/services/event"
+	"github.com/longsolong/flow/pkg/services/store"
+	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	// workflows register themselves with pkg/registry in init
+	_ "github.com/longsolong/flow/dev/workflows/pipeline"
+	_ "github.com/longsolong/flow/dev/workflows/standalone"
+)
+
+var (
+	workflowsDir = flag.String("workflows", "configs/workflows", "directory of declarative workflow specs")
+	runsDir      = flag.String("runs", "var/runs", "directory where runs are persisted")
+	maxParallel  = flag.Int("max-parallel", 0, "max jobs a run runs at once, 0 for no limit")
+	pools        = flag.String("pools", "", "slots of the resource pools of the jobs of a run, like db=3,api=5")
+	slots        = flag.Int("slots", 0, "max jobs all runs run at once, 0 for no limit")
+	weights      = flag.String("weights", "", "shares of the slots of workflow namespaces, like interactive=3,backfill=1")
+	retention    = flag.Duration("retention", time.Hour, "how long the server keeps a done run in memory, 0 to keep it")
+	stopTimeout  = flag.Duration("stop-timeout", registry.DefaultTimeout, "how long stopping or suspending a run waits for its jobs to stop")
+	sendTimeout  = flag.Duration("send-timeout", registry.DefaultTimeout, "how long a done job waits to be reaped before it is dropped")
 )
 
 func main() {
+	flag.Parse()
 	if err := run(); err != nil {
 		fmt.Fprintf(os.Stderr, "%v", err)
 		os.Exit(1)
@@ -26,15 +59,49 @@ func run() error {
 	}
 
 	// init storage
+	runStore, err := store.NewFile(*runsDir)
+	if err != nil {
+		return err
+	}
 
 	// init repositories with given logger and storage
 
 	// init services with given logger and repository
+	traversers := traverser.NewRepo(*retention)
+	events := event.NewBus()
+	registry.SingleProcessorFactory.SetStore(runStore)
+	poolSlots, err := parseCounts(*pools)
+	if err != nil {
+		return fmt.Errorf("-pools: %w", err)
+	}
+	registry.SingleProcessorFactory.SetLimits(traverser.Limits{MaxParallel: *maxParallel, Pools: poolSlots})
+	namespaceWeights, err := parseCounts(*weights)
+	if err != nil {
+		return fmt.Errorf("-weights: %w", err)
+	}
+	registry.SingleProcessorFactory.SetScheduler(scheduler.New(*slots, namespaceWeights))
+	registry.SingleProcessorFactory.SetTimeouts(*stopTimeout, *sendTimeout)
+
+	// load declarative workflows
+	specs, err := spec.Load(*workflowsDir)
+	if err != nil {
+		return err
+	}
+	for _, s := range specs {
+		if err := registry.RegisterGrapher(s.Namespace, s.Name, s.Version, s.NewGrapher); err != nil {
+			return err
+		}
+	}
+
+	// resume the runs that were running when the server stopped
+	if err := resumeRuns(logger, runStore, traversers, events); err != nil {
+		return err
+	}
 
 	// setup routes
 	restHandler := rest.CreateHandler(logger)
 	restHandler.NewHealthCheckHandler()
-	restHandler.NewFlowHandler(logger)
+	restHandler.NewFlowHandler(logger, traversers, events)
 
 	// listen and serve
 	// webServer := server.CreateServer(restHandler.GetRouter(), ":"+os.Getenv("HTTP_PORT"))
@@ -42,3 +109,50 @@ func run() error {
 	log.Println("starting server...")
 	return srv.ListenAndServe()
 }
+
+// resumeRuns resumes every persisted run that is still running. A run that
+// can't be loaded or resumed is logged and left as it is.
+func resumeRuns(logger *infra.Logger, runStore store.Store, traversers traverser.Repo, events *event.Bus) error {
+	runs, err := runStore.ListRuns(store.Filter{States: []state.State{state.StateRunning}})
+	if errors.Is(err, store.ErrCorruptRun) {
+		logger.Log.Error("loading runs failed", zap.Error(err))
+	} else if err != nil {
+		return err
+	}
+	ctx := context.WithValue(context.Background(), flowcontext.LoggerCtxKey, logger)
+	ctx = flowcontext.WithEvents(ctx, events)
+	for _, run := range runs {
+		fields := []zapcore.Field{
+			zap.String("request_id", run.RequestUUID),
+			zap.String("workflow", registry.Key{Namespace: run.Namespace, Name: run.Name, Version: run.Version}.String()),
+		}
+		t, err := registry.SingleProcessorFactory.Resume(ctx, logger, run)
+		if err != nil {
+			logger.Log.Error("resuming run failed", append(fields, zap.Error(err))...)
+			continue
+		}
+		logger.Log.Info("resumed run", fields...)
+		traversers.Set(run.RequestUUID, t)
+	}
+	return nil
+}
+
+// parseCounts parses comma separated name=count pairs, like the -pools flag.
+func parseCounts(s string) (map[string]int, error) {
+	counts := map[string]int{}
+	if s == "" {
+		return counts, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid %q: want name=count", pair)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid %q: count must be a non-negative integer", pair)
+		}
+		counts[kv[0]] = n
+	}
+	return counts, nil
+}
@@ -1 +1,92 @@
 package examples
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/faceair/jio"
+	"github.com/longsolong/flow/dev/steps/standalone/examples/numberguess"
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/longsolong/flow/pkg/workflow/step"
+)
+
+//go:generate genatom -type=InteractiveNumberGuess
+
+// InteractiveNumberGuess asks a person to guess the secret of the request.
+// Each run waits for one guess, see atom.InputRequester: a wrong guess fails
+// the job and narrows the range the next guess is asked in, so retrying its
+// sequence asks again.
+type InteractiveNumberGuess struct {
+	*step.Step
+
+	mux    *sync.Mutex // guards the fields below, read while the job waits for input
+	secret int
+	low    int
+	high   int
+}
+
+// NewInteractiveNumberGuess ...
+func NewInteractiveNumberGuess(id, expansionDigest string) *InteractiveNumberGuess {
+	return &InteractiveNumberGuess{
+		Step: step.NewStep(id, expansionDigest),
+		mux:  &sync.Mutex{},
+	}
+}
+
+// Create ...
+func (s *InteractiveNumberGuess) Create(ctx context.Context, req *request.Request) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.secret = int(req.RequestArgs["secret"].(float64))
+	s.low = numberguess.LOW
+	s.high = numberguess.HIGH
+	return nil
+}
+
+// InputRequest asks for a "guess" within the range left.
+func (s *InteractiveNumberGuess) InputRequest(ctx context.Context) *atom.InputRequest {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return &atom.InputRequest{
+		Prompt: fmt.Sprintf("guess the secret number between %d and %d", s.low, s.high),
+		Schema: jio.Object().Keys(jio.K{
+			"guess": jio.Number().Integer().Min(float64(s.low)).Max(float64(s.high)).Required(),
+		}),
+	}
+}
+
+// Run checks the guess, and outputs it as "guess".
+func (s *InteractiveNumberGuess) Run(ctx context.Context) (atom.Return, error) {
+	var input struct {
+		Guess int `json:"guess"`
+	}
+	if err := flowcontext.Input(ctx, &input); err != nil {
+		return atom.Return{State: state.StateFail, Exit: 1, Error: err}, nil
+	}
+	ret := atom.Return{State: state.StateSuccess, Outputs: atom.Outputs{}}
+	if err := ret.Outputs.Set("guess", input.Guess); err != nil {
+		return ret, err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if input.Guess != s.secret {
+		ret.State = state.StateFail
+		ret.Exit = 1
+		if input.Guess < s.secret {
+			s.low = input.Guess + 1
+		} else {
+			s.high = input.Guess - 1
+		}
+	}
+	return ret, nil
+}
+
+// Stop run
+func (s *InteractiveNumberGuess) Stop(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+// Code generated by "genatom -type=Split"; DO NOT EDIT.
+
+package examples
+
+import (
+	"reflect"
+
+	"github.com/longsolong/flow/pkg/workflow/atom"
+)
+
+// AtomID ...
+func (s *Split) AtomID() atom.AtomID {
+	return atom.AtomID{
+		Type:            reflect.TypeOf(s).Elem().String(),
+		ID:              s.ID,
+		ExpansionDigest: s.ExpansionDigest,
+	}
+}
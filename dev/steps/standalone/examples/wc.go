@@ -1 +1,113 @@
 package examples
+
+import (
+	"context"
+	"strings"
+
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/longsolong/flow/pkg/workflow/step"
+)
+
+//go:generate genatom -type=Split
+
+// Split outputs the texts of the request, one per word count to expand.
+type Split struct {
+	*step.Step
+	texts []string
+}
+
+// NewSplit ...
+func NewSplit(id, expansionDigest string) *Split {
+	return &Split{Step: step.NewStep(id, expansionDigest)}
+}
+
+// Create ...
+func (s *Split) Create(ctx context.Context, req *request.Request) error {
+	s.texts = s.texts[:0]
+	texts, _ := req.RequestArgs["texts"].([]interface{})
+	for _, text := range texts {
+		s.texts = append(s.texts, text.(string))
+	}
+	return nil
+}
+
+// Run outputs "texts".
+func (s *Split) Run(ctx context.Context) (atom.Return, error) {
+	ret := atom.Return{State: state.StateSuccess, Outputs: atom.Outputs{}}
+	return ret, ret.Outputs.Set("texts", s.texts)
+}
+
+// Stop run
+func (s *Split) Stop(ctx context.Context) error {
+	return nil
+}
+
+//go:generate genatom -type=Count
+
+// Count counts the words of one text.
+type Count struct {
+	*step.Step
+	text string
+}
+
+// NewCount ...
+func NewCount(id, expansionDigest, text string) *Count {
+	return &Count{Step: step.NewStep(id, expansionDigest), text: text}
+}
+
+// Create ...
+func (s *Count) Create(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+// Run outputs "words".
+func (s *Count) Run(ctx context.Context) (atom.Return, error) {
+	ret := atom.Return{State: state.StateSuccess, Outputs: atom.Outputs{}}
+	return ret, ret.Outputs.Set("words", len(strings.Fields(s.text)))
+}
+
+// Stop run
+func (s *Count) Stop(ctx context.Context) error {
+	return nil
+}
+
+//go:generate genatom -type=Sum
+
+// Sum adds up the "words" outputs of its upstream atoms.
+type Sum struct {
+	*step.Step
+}
+
+// NewSum ...
+func NewSum(id, expansionDigest string) *Sum {
+	return &Sum{Step: step.NewStep(id, expansionDigest)}
+}
+
+// Create ...
+func (s *Sum) Create(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+// Run outputs "words".
+func (s *Sum) Run(ctx context.Context) (atom.Return, error) {
+	total := 0
+	for _, outputs := range flowcontext.UpstreamOutputs(ctx) {
+		var words int
+		if err := outputs.Get("words", &words); err == atom.ErrNoOutput {
+			continue
+		} else if err != nil {
+			return atom.Return{State: state.StateFail, Error: err}, err
+		}
+		total += words
+	}
+	ret := atom.Return{State: state.StateSuccess, Outputs: atom.Outputs{}}
+	return ret, ret.Outputs.Set("words", total)
+}
+
+// Stop run
+func (s *Sum) Stop(ctx context.Context) error {
+	return nil
+}
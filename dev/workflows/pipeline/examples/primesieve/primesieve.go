@@ -10,17 +10,24 @@ import (
 	"github.com/faceair/jio"
 	pipe "github.com/longsolong/flow/pkg/execution/pipeline"
 	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/registry"
 )
 
 // https://play.golang.org/p/9U22NfrXeq
 
 const (
+	// NAMESPACE ...
+	NAMESPACE = "examples"
 	// NAME ...
 	NAME = "prime_sieve"
 	// VERSION ...
 	VERSION = 1
 )
 
+func init() {
+	registry.MustRegisterPipeline(NAMESPACE, NAME, VERSION, NewPipeline)
+}
+
 //go:generate genaccessor -type=generateParam,filterParam -v
 
 type generateParam struct {
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/registry"
 	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
 )
 
@@ -35,7 +36,7 @@ func TestNewPipeline(t *testing.T) {
 			{"name": "aa", "value": "bb"}
 		]
 	}`)
-	_, err = PipelineFactory.Make(
+	_, err = registry.PipelineFactory.Make(
 		context.WithValue(baseCtx, flowcontext.LoggerCtxKey, logger),
 		logger, namespace, name, version, body)
 	valv.Shutdown(1)
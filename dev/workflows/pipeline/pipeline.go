@@ -0,0 +1,8 @@
+// Package pipeline registers the example pipeline workflows. Import it for
+// its side effects.
+package pipeline
+
+import (
+	// workflows register themselves with pkg/registry in init
+	_ "github.com/longsolong/flow/dev/workflows/pipeline/examples/primesieve"
+)
@@ -1 +1,62 @@
 package interactivenumberguess
+
+import (
+	"context"
+
+	"github.com/faceair/jio"
+	"github.com/longsolong/flow/dev/steps/standalone/examples"
+	"github.com/longsolong/flow/dev/steps/standalone/examples/numberguess"
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/graph"
+	"github.com/longsolong/flow/pkg/registry"
+)
+
+const (
+	// NAMESPACE ...
+	NAMESPACE = "examples"
+	// NAME ...
+	NAME = "interactive_number_guess"
+	// VERSION ...
+	VERSION = 1
+	// GUESSES is how many guesses are asked for before the flow fails.
+	GUESSES = 7
+)
+
+var schema = jio.Object().Keys(jio.K{
+	"requestArgs": jio.Object().Keys(jio.K{
+		"secret": jio.Number().Integer().Min(numberguess.LOW).Max(numberguess.HIGH).Required(),
+	}),
+	"requestTags": jio.Array().Items(jio.Object().Keys(jio.K{
+		"name":  jio.String().Required(),
+		"value": jio.String().Required(),
+	})),
+})
+
+func init() {
+	registry.MustRegisterGrapher(NAMESPACE, NAME, VERSION, NewGrapher)
+}
+
+//go:generate gengrapher -type=InteractiveNumberGuess
+
+// plotter has a single job asking for guesses of the secret of the request.
+// It is its own sequence, retried once per wrong guess.
+type plotter struct {
+	graph.Plotter
+}
+
+func (p *plotter) Begin(ctx context.Context, req *request.Request) error {
+	node, err := p.NewNode(
+		ctx, req,
+		examples.NewInteractiveNumberGuess("guess", ""),
+		"ask for a guess of the secret number", 0, 0)
+	if err != nil {
+		return err
+	}
+	node.SequenceID = node.Datum.AtomID()
+	node.SequenceRetry = GUESSES - 1
+	return nil
+}
+
+func (p *plotter) Grow(ctx context.Context) {
+	p.Plotter.Close()
+}
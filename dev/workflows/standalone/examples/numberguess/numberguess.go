@@ -8,9 +8,12 @@ import (
 	"github.com/longsolong/flow/dev/steps/standalone/examples/numberguess"
 	"github.com/longsolong/flow/pkg/orchestration/request"
 	"github.com/longsolong/flow/pkg/orchestration/standalone/graph"
+	"github.com/longsolong/flow/pkg/registry"
 )
 
 const (
+	// NAMESPACE ...
+	NAMESPACE = "examples"
 	// NAME ...
 	NAME = "number_guess"
 	// VERSION ...
@@ -27,6 +30,10 @@ var schema = jio.Object().Keys(jio.K{
 	})),
 })
 
+func init() {
+	registry.MustRegisterGrapher(NAMESPACE, NAME, VERSION, NewGrapher)
+}
+
 //go:generate gengrapher -type=NumberGuess
 
 type plotter struct {
@@ -20,8 +20,7 @@ func NewGrapher(ctx context.Context, rawRequestData []byte) (*graph.Grapher, err
 	if err != nil {
 		return nil, err
 	}
-	g := graph.NewGrapher(req, p.DAG, p.Chain, p)
-	return g, nil
+	return graph.NewGrapher(req, p.DAG, p.Chain, p)
 }
 
 func newRequest(ctx context.Context, rawRequestData []byte) (*request.Request, error) {
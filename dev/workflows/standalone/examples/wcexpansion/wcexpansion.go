@@ -1 +1,85 @@
 package wcexpansion
+
+import (
+	"context"
+	"time"
+
+	"github.com/faceair/jio"
+	"github.com/longsolong/flow/dev/steps/standalone/examples"
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/graph"
+	"github.com/longsolong/flow/pkg/registry"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/dag"
+)
+
+const (
+	// NAMESPACE ...
+	NAMESPACE = "examples"
+	// NAME ...
+	NAME = "wc_expansion"
+	// VERSION ...
+	VERSION = 1
+)
+
+var schema = jio.Object().Keys(jio.K{
+	"requestArgs": jio.Object().Keys(jio.K{
+		"texts": jio.Array().Items(jio.String()).Required(),
+	}),
+	"requestTags": jio.Array().Items(jio.Object().Keys(jio.K{
+		"name":  jio.String().Required(),
+		"value": jio.String().Required(),
+	})),
+})
+
+func init() {
+	registry.MustRegisterGrapher(NAMESPACE, NAME, VERSION, NewGrapher)
+}
+
+//go:generate gengrapher -type=WcExpansion
+
+// plotter counts the words of the texts of the request: split outputs the
+// texts, one count per text is expanded after it, and sum adds up the counts.
+type plotter struct {
+	graph.Plotter
+	split *dag.Node
+	sum   *dag.Node
+}
+
+func (p *plotter) Begin(ctx context.Context, req *request.Request) error {
+	var err error
+	if p.split, err = p.NewNode(ctx, req, examples.NewSplit("split", ""), "split texts", 0, time.Duration(0)); err != nil {
+		return err
+	}
+	if p.sum, err = p.NewNode(ctx, req, examples.NewSum("sum", ""), "sum word counts", 0, time.Duration(0)); err != nil {
+		return err
+	}
+	return p.sum.SetUpstream(p.split)
+}
+
+func (p *plotter) Grow(ctx context.Context) {
+	p.Plotter.Close()
+}
+
+// ExpandAfter expands one word count per text output by split.
+func (p *plotter) ExpandAfter(ctx context.Context, req *request.Request, jobID atom.AtomID, outputs atom.Outputs) error {
+	if jobID != p.split.Datum.AtomID() {
+		return nil
+	}
+	var texts []string
+	if err := outputs.Get("texts", &texts); err != nil {
+		return err
+	}
+	tmpl := graph.Template{
+		Name: "count",
+		Nodes: []graph.TemplateNode{{
+			Name:  "count words",
+			Retry: 1,
+			New: func(i int, expansionDigest string) atom.Atom {
+				return examples.NewCount("count", expansionDigest, texts[i])
+			},
+		}},
+	}
+	_, err := p.Expand(ctx, req, tmpl, len(texts), []atom.AtomID{jobID}, []atom.AtomID{p.sum.Datum.AtomID()})
+	return err
+}
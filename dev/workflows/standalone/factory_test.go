@@ -2,12 +2,22 @@ package standalone
 
 import (
 	"context"
+	"errors"
 	"github.com/go-chi/valve"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 
 	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/graph"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/spec"
+	"github.com/longsolong/flow/pkg/registry"
+	"github.com/longsolong/flow/pkg/services/store"
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
 	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
+	"github.com/longsolong/flow/pkg/workflow/state"
 )
 
 func TestNewGrapher(t *testing.T) {
@@ -35,8 +45,239 @@ func TestNewGrapher(t *testing.T) {
 			{"name": "aa", "value": "bb"}
 		]
 	}`)
-	_, err = SingleProcessorFactory.Make(
+	_, err = registry.SingleProcessorFactory.Make(
 		context.WithValue(baseCtx, flowcontext.LoggerCtxKey, logger),
 		logger, namespace, name, version, body)
 	assert.Nil(t, err)
 }
+
+func TestMakeSpec(t *testing.T) {
+	logger, err := infra.CreateLogger(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := spec.ParseFile("../../../configs/workflows/noop_diamond.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, registry.RegisterGrapher(s.Namespace, s.Name, s.Version, s.NewGrapher))
+	assert.True(t, errors.Is(
+		registry.RegisterGrapher(s.Namespace, s.Name, s.Version, s.NewGrapher), registry.ErrAlreadyRegistered))
+
+	body := []byte(`{
+		"primaryRequestArgs": {
+			"namespace": "examples",
+			"name": "noop_diamond",
+			"version": 1
+		},
+		"requestArgs": {},
+		"requestTags": []
+	}`)
+	g, err := registry.SingleProcessorFactory.Make(
+		context.WithValue(context.Background(), flowcontext.LoggerCtxKey, logger),
+		logger, "examples", "noop_diamond", 1, body)
+	assert.Nil(t, err)
+	done, complete := g.Chain.IsDoneRunning()
+	assert.True(t, done)
+	assert.True(t, complete)
+	assert.Len(t, g.Chain.AllJobs(), 4)
+}
+
+func TestResume(t *testing.T) {
+	logger, err := infra.CreateLogger(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := spec.ParseFile("../../../configs/workflows/noop_diamond.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = registry.RegisterGrapher(s.Namespace, s.Name, s.Version, s.NewGrapher)
+	if err != nil && !errors.Is(err, registry.ErrAlreadyRegistered) {
+		t.Fatal(err)
+	}
+
+	// The run as it was saved when the server died, while "left" was running.
+	runStore := store.NewMemory()
+	registry.SingleProcessorFactory.SetStore(runStore)
+	defer registry.SingleProcessorFactory.SetStore(nil)
+	noop := func(id string) atom.AtomID { return atom.AtomID{Type: "builtin.Noop", ID: id} }
+	startedAt := time.Now().UTC().Add(-time.Hour)
+	run := store.Run{
+		RequestUUID: "0b6f6f3e-8e36-4bd5-9a2b-8a5d3b6c2f10",
+		Namespace:   "examples",
+		Name:        "noop_diamond",
+		Version:     1,
+		RequestArgs: map[string]interface{}{"note": "hi"},
+		RequestTags: []request.Tag{{Name: "aa", Value: "bb"}},
+		State:       state.StateRunning,
+		StartedAt:   startedAt,
+		Jobs: []store.Job{
+			{AtomID: noop("start"), State: state.StateSuccess, Tries: 1},
+			{AtomID: noop("left"), State: state.StateRunning, Tries: 2},
+			{AtomID: noop("right"), State: state.StateSuccess, Tries: 1},
+			{AtomID: noop("end"), State: state.StateUnknown},
+		},
+	}
+	assert.Nil(t, runStore.SaveRun(run))
+	_, err = runStore.AppendTransition(store.Transition{
+		RequestUUID: run.RequestUUID, Kind: store.JobTriesTransition, AtomID: noop("left"), Delta: 1})
+	assert.Nil(t, err)
+	runs, err := runStore.ListRuns(store.Filter{States: []state.State{state.StateRunning}})
+	assert.Nil(t, err)
+	assert.Len(t, runs, 1)
+
+	tr, err := registry.SingleProcessorFactory.Resume(
+		context.WithValue(context.Background(), flowcontext.LoggerCtxKey, logger), logger, runs[0])
+	assert.Nil(t, err)
+	<-tr.Done()
+
+	g := tr.Grapher()
+	assert.Equal(t, run.RequestUUID, g.Req.RequestUUID.String())
+	assert.Equal(t, "hi", g.Req.RequestArgs["note"])
+	assert.Equal(t, run.RequestTags, g.Req.RequestTags)
+	// Only the interrupted job and the job after it ran again.
+	assert.Equal(t, uint(1), g.Chain.JobTries(noop("start")))
+	assert.Equal(t, uint(4), g.Chain.JobTries(noop("left")))
+	assert.Equal(t, uint(1), g.Chain.JobTries(noop("end")))
+
+	// The transitions saved before the resume are not applied twice.
+	saved, err := runStore.LoadRun(run.RequestUUID)
+	assert.Nil(t, err)
+	assert.Equal(t, state.StateSuccess, saved.State)
+	assert.Equal(t, startedAt, saved.StartedAt)
+	for _, j := range saved.Jobs {
+		assert.Equal(t, state.StateSuccess, j.State, j.AtomID.ID)
+		assert.Equal(t, g.Chain.JobTries(j.AtomID), j.Tries, j.AtomID.ID)
+	}
+}
+
+func TestWcExpansion(t *testing.T) {
+	logger, err := infra.CreateLogger(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{
+		"primaryRequestArgs": {
+			"namespace": "examples",
+			"name": "wc_expansion",
+			"version": 1
+		},
+		"requestArgs": {
+			"texts": ["one two", "three four five", ""]
+		},
+		"requestTags": []
+	}`)
+	g, err := registry.SingleProcessorFactory.Make(
+		context.WithValue(context.Background(), flowcontext.LoggerCtxKey, logger),
+		logger, "examples", "wc_expansion", 1, body)
+	assert.Nil(t, err)
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+	// split, sum and one count per text.
+	assert.Len(t, g.Chain.AllJobs(), 5)
+	var words int
+	assert.Nil(t, g.Chain.JobOutputs(atom.AtomID{Type: "examples.Sum", ID: "sum"}).Get("words", &words))
+	assert.Equal(t, 5, words)
+}
+
+func TestResumeWcExpansion(t *testing.T) {
+	logger, err := infra.CreateLogger(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	split := atom.AtomID{Type: "examples.Split", ID: "split"}
+	count := func(i int) atom.AtomID {
+		return atom.AtomID{Type: "examples.Count", ID: "count", ExpansionDigest: graph.ExpansionDigest("count", i)}
+	}
+	sum := atom.AtomID{Type: "examples.Sum", ID: "sum"}
+	texts := atom.Outputs{}
+	assert.Nil(t, texts.Set("texts", []string{"one two", "three four five"}))
+	words := atom.Outputs{}
+	assert.Nil(t, words.Set("words", 2))
+
+	// The run as it was saved while the second count was running.
+	runStore := store.NewMemory()
+	registry.SingleProcessorFactory.SetStore(runStore)
+	defer registry.SingleProcessorFactory.SetStore(nil)
+	run := store.Run{
+		RequestUUID: "6d0c3f1e-5b8a-4c1e-9f57-2d8e4b7a9c31",
+		Namespace:   "examples",
+		Name:        "wc_expansion",
+		Version:     1,
+		RequestArgs: map[string]interface{}{"texts": []interface{}{"one two", "three four five"}},
+		State:       state.StateRunning,
+		StartedAt:   time.Now().UTC().Add(-time.Hour),
+		Jobs: []store.Job{
+			{AtomID: split, State: state.StateSuccess, Tries: 1, Outputs: texts},
+			{AtomID: count(0), State: state.StateSuccess, Tries: 1, Outputs: words},
+			{AtomID: count(1), State: state.StateRunning, Tries: 1},
+			{AtomID: sum, State: state.StateUnknown},
+		},
+	}
+	assert.Nil(t, runStore.SaveRun(run))
+
+	tr, err := registry.SingleProcessorFactory.Resume(
+		context.WithValue(context.Background(), flowcontext.LoggerCtxKey, logger), logger, run)
+	assert.Nil(t, err)
+	<-tr.Done()
+
+	g := tr.Grapher()
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+	// The counts were expanded again; only the interrupted one ran again.
+	assert.Len(t, g.Chain.AllJobs(), 4)
+	assert.Equal(t, uint(1), g.Chain.JobTries(split))
+	assert.Equal(t, uint(1), g.Chain.JobTries(count(0)))
+	assert.Equal(t, uint(2), g.Chain.JobTries(count(1)))
+	var total int
+	assert.Nil(t, g.Chain.JobOutputs(sum).Get("words", &total))
+	assert.Equal(t, 5, total)
+}
+
+func TestInteractiveNumberGuess(t *testing.T) {
+	logger, err := infra.CreateLogger(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{
+		"primaryRequestArgs": {
+			"namespace": "examples",
+			"name": "interactive_number_guess",
+			"version": 1
+		},
+		"requestArgs": {
+			"secret": 30
+		},
+		"requestTags": []
+	}`)
+	ctx := context.WithValue(context.Background(), flowcontext.LoggerCtxKey, logger)
+	tr, err := registry.SingleProcessorFactory.Start(ctx, logger, "examples", "interactive_number_guess", 1, body)
+	assert.Nil(t, err)
+	guess := atom.AtomID{Type: "examples.InteractiveNumberGuess", ID: "guess"}
+
+	// waitPrompt waits for the guess job to ask for input, and returns the
+	// prompt.
+	waitPrompt := func() string {
+		for i := 0; i < 100; i++ {
+			if status := tr.Status(); status.Jobs[0].StateText == "WAIT_INPUT" {
+				return status.Jobs[0].Prompt
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("guess never waited for input")
+		return ""
+	}
+
+	assert.Equal(t, "guess the secret number between 0 and 100", waitPrompt())
+	assert.True(t, errors.Is(tr.SubmitInput(ctx, guess, []byte(`{"guess": 101}`)), workflow.ErrInvalidInput))
+	assert.Nil(t, tr.SubmitInput(ctx, guess, []byte(`{"guess": 50}`)))
+	assert.Equal(t, "guess the secret number between 0 and 49", waitPrompt())
+	assert.Nil(t, tr.SubmitInput(ctx, guess, []byte(`{"guess": 30}`)))
+	<-tr.Done()
+
+	g := tr.Grapher()
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+	assert.Equal(t, uint(2), g.Chain.JobTries(guess))
+	var last int
+	assert.Nil(t, g.Chain.JobOutputs(guess).Get("guess", &last))
+	assert.Equal(t, 30, last)
+}
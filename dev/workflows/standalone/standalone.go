@@ -0,0 +1,10 @@
+// Package standalone registers the example standalone workflows. Import it
+// for its side effects.
+package standalone
+
+import (
+	// workflows register themselves with pkg/registry in init
+	_ "github.com/longsolong/flow/dev/workflows/standalone/examples/interactivenumberguess"
+	_ "github.com/longsolong/flow/dev/workflows/standalone/examples/numberguess"
+	_ "github.com/longsolong/flow/dev/workflows/standalone/examples/wcexpansion"
+)
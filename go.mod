@@ -16,4 +16,5 @@ require (
 	go.uber.org/multierr v1.2.0 // indirect
 	go.uber.org/zap v1.10.0
 	golang.org/x/net v0.0.0-20191119073136-fc4aabc6c914 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -4,12 +4,15 @@ package runner
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/longsolong/flow/pkg/infra"
 	"github.com/longsolong/flow/pkg/orchestration/job"
 	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/services/event"
 	"github.com/longsolong/flow/pkg/workflow/atom"
 	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
+	"github.com/longsolong/flow/pkg/workflow/retry"
 	"github.com/longsolong/flow/pkg/workflow/state"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -18,10 +21,18 @@ import (
 	"time"
 )
 
+var (
+	// ErrTimeout is the error of the atom.Return of a try that ran past its
+	// timeout or the chain deadline.
+	ErrTimeout = errors.New("job timed out")
+)
+
 // Return ...
 type Return struct {
 	AtomReturn atom.Return // Final atom.Return Determines if/how chain continues running.
 	Tries      uint        // Number of tries this run, not including any previous tries
+
+	Input *atom.InputRequest // input the job waits for if it is StateWaitInput
 }
 
 // A Runner runs and manages one job in a job chain. The job must implement the
@@ -44,9 +55,12 @@ type runner struct {
 	realJob job.Job // the actual job interface to run
 	req     *request.Request
 
-	totalTries uint // try count all seq tries
-	maxTries   uint // max tries per seq try
-	retryWait  time.Duration
+	totalTries uint            // try count all seq tries
+	maxTries   uint            // max tries per seq try
+	backoff    retry.Backoff   // wait before each retry
+	retryIf    retry.Predicate // failures that can be retried, nil for all
+	timeout    time.Duration   // max run time of a try, 0 for none
+	deadline   time.Time       // chain deadline, zero for none
 	stopChan   chan struct{}
 	mux        *sync.Mutex
 
@@ -56,15 +70,33 @@ type runner struct {
 }
 
 // NewRunner ...
-func NewRunner(realJob job.Job, req *request.Request, totalTries uint, name string, retry uint, retryWait time.Duration, logger *infra.Logger) Runner {
+//
+// A failed try is retried, after waiting as long as backoff says, unless
+// retryIf or the atom, if it is a retry.Classifier, says it can't be. A nil
+// backoff doesn't wait. Each try runs with a context that expires after timeout, or at deadline if
+// that's sooner; zero values mean none. The runner stops a try that hasn't
+// returned when its context expires and records it as StateTimeout, which is
+// retried like a failure. No try starts past the deadline.
+//
+// A job whose atom is an atom.InputRequester asking for input doesn't run
+// unless its run context has input, see flowcontext.WithInput: Run returns
+// right away with StateWaitInput and the atom.InputRequest. The tries of the
+// run share the input.
+func NewRunner(realJob job.Job, req *request.Request, totalTries uint, name string, retries uint, backoff retry.Backoff, retryIf retry.Predicate, timeout time.Duration, deadline time.Time, logger *infra.Logger) Runner {
+	if backoff == nil {
+		backoff = retry.Constant(0)
+	}
 	return &runner{
 		jobName: name,
 		realJob: realJob,
 		req:     req,
 
 		totalTries: 1 + totalTries, // this run + past totalTries (on resume/retry)
-		maxTries:   1 + retry,      // + 1 because we always run once
-		retryWait:  retryWait,
+		maxTries:   1 + retries,    // + 1 because we always run once
+		backoff:    backoff,
+		retryIf:    retryIf,
+		timeout:    timeout,
+		deadline:   deadline,
 		stopChan:   make(chan struct{}),
 		mux:        &sync.Mutex{},
 
@@ -85,6 +117,7 @@ func (r *runner) Run(ctx context.Context) Return {
 	// the run fails.
 	tries := uint(1) // number of tries this run
 	finalAtomReturn := atom.Return{State: state.StateUnknown}
+	var input *atom.InputRequest
 TRY_LOOP:
 	for tries <= r.maxTries {
 		tryFields := append([]zapcore.Field(nil), fields...)
@@ -97,12 +130,31 @@ TRY_LOOP:
 		// Can be stopped before we've started.
 		if r.stopped() {
 			logger.Info("job stopped before start", tryFields...)
+			tries-- // this try did not run
+			finalAtomReturn = atom.Return{State: state.StateStopped}
+			break TRY_LOOP
+		}
+
+		// Or be past the chain deadline, then no try can finish in time.
+		if !r.deadline.IsZero() && !time.Now().Before(r.deadline) {
+			logger.Warn("job past chain deadline", tryFields...)
+			tries-- // this try did not run
+			finalAtomReturn = atom.Return{State: state.StateTimeout, Error: ErrTimeout}
+			break TRY_LOOP
+		}
+
+		// Or need input that wasn't submitted yet, then it waits for it.
+		if input = r.inputRequest(ctx); input != nil {
+			logger.Info("job waiting for input", tryFields...)
+			tries-- // this try did not run
+			finalAtomReturn = atom.Return{State: state.StateWaitInput}
 			break TRY_LOOP
 		}
 
 		// Run the job. Use a separate method so we can easily recover from a panic
 		// in job.Run.
 		logger.Info("job start", tryFields...)
+		r.publish(event.Event{Kind: event.JobStarted, Try: r.totalTries})
 		ctx = context.WithValue(ctx, flowcontext.FlowContextKey("totalTries"), r.totalTries)
 		ctx = context.WithValue(ctx, flowcontext.FlowContextKey("maxTries"), r.maxTries)
 		startedAt, finishedAt, jobRet, runErr := r.runJob(ctx)
@@ -117,8 +169,8 @@ TRY_LOOP:
 		}...)
 		logger.Info("job return", runFields...)
 
-		// Set final job state to this job state
-		finalAtomReturn.State = jobRet.State
+		// Set final job return, state and outputs, to this job return
+		finalAtomReturn = jobRet
 
 		// Break try loop on success or stop
 		if jobRet.State == state.StateSuccess || jobRet.State == state.StateStopped {
@@ -132,12 +184,26 @@ TRY_LOOP:
 		}...)
 
 		logger.Warn("job failed", retryFields...)
+		failed := event.Event{Kind: event.JobTryFailed, State: jobRet.State, Try: r.totalTries}
+		if jobRet.Error != nil {
+			failed.Error = jobRet.Error.Error()
+		} else if runErr != nil {
+			failed.Error = runErr.Error()
+		}
+		r.publish(failed)
 
 		// If last try, break retry loop, don't wait
 		if tries == r.maxTries {
 			break TRY_LOOP
 		}
 
+		// Or if the failure can't be fixed by retrying.
+		if !r.retryable(jobRet) {
+			logger.Warn("job failed, not retryable", retryFields...)
+			break TRY_LOOP
+		}
+		retryWait := r.backoff.Wait(tries)
+
 		// Wait between retries. Can be stopped while waiting which is why we
 		// need to increment tries first. At this point, we're effectively on
 		// the next try.
@@ -146,8 +212,9 @@ TRY_LOOP:
 		r.totalTries++
 		r.sleeping = true
 		r.mux.Unlock()
+		r.publish(event.Event{Kind: event.JobRetryWaiting, Try: r.totalTries, Wait: retryWait})
 		select {
-		case <-time.After(r.retryWait):
+		case <-time.After(retryWait):
 			// Job failed, wait and retry?
 			r.mux.Lock()
 			r.sleeping = false
@@ -165,11 +232,78 @@ TRY_LOOP:
 	return Return{
 		AtomReturn: finalAtomReturn,
 		Tries:      tries,
+		Input:      input,
+	}
+}
+
+// publish publishes an event of the job to the event bus of the request, see
+// flowcontext.WithEvents.
+func (r *runner) publish(e event.Event) {
+	e.RequestUUID = r.req.RequestUUID.String()
+	e.AtomID = r.realJob.AtomID()
+	flowcontext.Events(r.req.Context()).Publish(e)
+}
+
+// inputRequest returns the input the job waits for, nil if it needs none or
+// its input was submitted.
+func (r *runner) inputRequest(ctx context.Context) *atom.InputRequest {
+	requester, ok := r.realJob.Atom.(atom.InputRequester)
+	if !ok || flowcontext.InputData(ctx) != nil {
+		return nil
 	}
+	return requester.InputRequest(ctx)
 }
 
-// Actually run the job.
+// Actually run the job, within the timeout and deadline.
 func (r *runner) runJob(ctx context.Context) (startedAt, finishedAt int64, ret atom.Return, err error) {
+	deadline := r.deadline
+	if r.timeout > 0 {
+		if d := time.Now().Add(r.timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if deadline.IsZero() {
+		return r.runTry(ctx)
+	}
+
+	// Stop the job if it's still running when the try expires. Wait for the
+	// watch to end before returning so it can't stop the next try.
+	tryCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	doneChan := make(chan struct{})
+	watchChan := make(chan bool)
+	go func() {
+		select {
+		case <-tryCtx.Done():
+			if tryCtx.Err() != context.DeadlineExceeded {
+				watchChan <- false
+				return
+			}
+			r.logger.Log.Warn("job timed out, stopping it",
+				zap.String("request_id", r.req.RequestUUID.String()),
+				zap.String("job_id", r.realJob.AtomID().String()))
+			r.realJob.Atom.(atom.Runnable).Stop(ctx)
+			watchChan <- true
+		case <-doneChan:
+			watchChan <- false
+		}
+	}()
+
+	startedAt, finishedAt, ret, err = r.runTry(tryCtx)
+	close(doneChan)
+	if timedOut := <-watchChan; timedOut && ret.State != state.StateSuccess {
+		ret.State = state.StateTimeout
+		if ret.Error == nil {
+			ret.Error = ErrTimeout
+		} else {
+			ret.Error = fmt.Errorf("%w: %s", ErrTimeout, ret.Error)
+		}
+	}
+	return
+}
+
+// runTry runs one try of the job.
+func (r *runner) runTry(ctx context.Context) (startedAt, finishedAt int64, ret atom.Return, err error) {
 	defer func() {
 		// Recover from a panic inside Job.Run()
 		if panicErr := recover(); panicErr != nil {
@@ -196,6 +330,17 @@ func (r *runner) runJob(ctx context.Context) (startedAt, finishedAt int64, ret a
 	return
 }
 
+// retryable reports whether a failed try can be retried.
+func (r *runner) retryable(ret atom.Return) bool {
+	if r.retryIf != nil && !r.retryIf(ret) {
+		return false
+	}
+	if c, ok := r.realJob.Atom.(retry.Classifier); ok && !c.Retryable(ret) {
+		return false
+	}
+	return true
+}
+
 func (r *runner) Stop(ctx context.Context) error {
 	fields := []zapcore.Field{
 		zap.String("request_id", r.req.RequestUUID.String()),
@@ -1 +1,229 @@
 package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/faceair/jio"
+	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/orchestration/job"
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
+	"github.com/longsolong/flow/pkg/workflow/retry"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/longsolong/flow/pkg/workflow/step"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// sleep runs for d, or until it is stopped.
+type sleep struct {
+	step.Step
+	d     time.Duration
+	runs  int32
+	stops int32
+	stop  chan struct{}
+}
+
+func newSleep(d time.Duration) *sleep {
+	s := &sleep{d: d, stop: make(chan struct{}, 1)}
+	s.ID = "sleep"
+	return s
+}
+
+func (s *sleep) AtomID() atom.AtomID {
+	return atom.AtomID{Type: "runner.sleep", ID: s.ID}
+}
+
+func (s *sleep) Create(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+func (s *sleep) Run(ctx context.Context) (atom.Return, error) {
+	atomic.AddInt32(&s.runs, 1)
+	select {
+	case <-time.After(s.d):
+		return atom.Return{State: state.StateSuccess}, nil
+	case <-s.stop:
+		return atom.Return{State: state.StateStopped}, nil
+	}
+}
+
+func (s *sleep) Stop(ctx context.Context) error {
+	atomic.AddInt32(&s.stops, 1)
+	select {
+	case s.stop <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func TestTimeout(t *testing.T) {
+	ctx := context.Background()
+	logger := &infra.Logger{Log: zap.NewNop()}
+	req := request.NewRequest()
+
+	// Each try times out and is retried.
+	s := newSleep(time.Second)
+	r := NewRunner(*job.NewJob(s), req, 0, "sleep", 1, nil, nil, 20*time.Millisecond, time.Time{}, logger)
+	ret := r.Run(ctx)
+	assert.Equal(t, state.StateTimeout, ret.AtomReturn.State)
+	assert.True(t, errors.Is(ret.AtomReturn.Error, ErrTimeout))
+	assert.Equal(t, uint(2), ret.Tries)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&s.stops))
+
+	// The chain deadline cuts the try short, and there is no time left to
+	// retry.
+	s = newSleep(time.Second)
+	r = NewRunner(*job.NewJob(s), req, 0, "sleep", 3, nil, nil, time.Second, time.Now().Add(20*time.Millisecond), logger)
+	ret = r.Run(ctx)
+	assert.Equal(t, state.StateTimeout, ret.AtomReturn.State)
+	assert.Equal(t, uint(1), ret.Tries)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&s.runs))
+
+	// No try starts past the deadline.
+	s = newSleep(0)
+	r = NewRunner(*job.NewJob(s), req, 0, "sleep", 0, nil, nil, 0, time.Now().Add(-time.Second), logger)
+	ret = r.Run(ctx)
+	assert.Equal(t, state.StateTimeout, ret.AtomReturn.State)
+	assert.Equal(t, uint(0), ret.Tries)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&s.runs))
+
+	// A try done in time succeeds.
+	s = newSleep(time.Millisecond)
+	r = NewRunner(*job.NewJob(s), req, 0, "sleep", 0, nil, nil, time.Second, time.Now().Add(time.Second), logger)
+	ret = r.Run(ctx)
+	assert.Equal(t, state.StateSuccess, ret.AtomReturn.State)
+	assert.Nil(t, ret.AtomReturn.Error)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&s.stops))
+}
+
+// flaky fails with its exits in turn, then succeeds, and tells which of its
+// failures can be retried.
+type flaky struct {
+	step.Step
+	exits     []int64
+	runs      int
+	runTimes  []time.Time
+	retryable func(ret atom.Return) bool
+}
+
+func (s *flaky) AtomID() atom.AtomID {
+	return atom.AtomID{Type: "runner.flaky", ID: s.ID}
+}
+
+func (s *flaky) Create(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+func (s *flaky) Run(ctx context.Context) (atom.Return, error) {
+	s.runTimes = append(s.runTimes, time.Now())
+	s.runs++
+	if s.runs > len(s.exits) {
+		return atom.Return{State: state.StateSuccess}, nil
+	}
+	return atom.Return{State: state.StateFail, Exit: s.exits[s.runs-1]}, nil
+}
+
+func (s *flaky) Stop(ctx context.Context) error {
+	return nil
+}
+
+func (s *flaky) Retryable(ret atom.Return) bool {
+	return s.retryable == nil || s.retryable(ret)
+}
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	logger := &infra.Logger{Log: zap.NewNop()}
+	req := request.NewRequest()
+
+	// Each retry waits as long as the backoff says.
+	s := &flaky{exits: []int64{1, 1}}
+	backoff := retry.Linear{Initial: 10 * time.Millisecond, Step: 20 * time.Millisecond}
+	r := NewRunner(*job.NewJob(s), req, 0, "flaky", 2, backoff, nil, 0, time.Time{}, logger)
+	ret := r.Run(ctx)
+	assert.Equal(t, state.StateSuccess, ret.AtomReturn.State)
+	assert.Equal(t, uint(3), ret.Tries)
+	assert.True(t, s.runTimes[1].Sub(s.runTimes[0]) >= 10*time.Millisecond)
+	assert.True(t, s.runTimes[2].Sub(s.runTimes[1]) >= 30*time.Millisecond)
+
+	// A failure the predicate doesn't retry is final.
+	s = &flaky{exits: []int64{1, 2, 1}}
+	r = NewRunner(*job.NewJob(s), req, 0, "flaky", 5, nil, retry.NotOnExits(2), 0, time.Time{}, logger)
+	ret = r.Run(ctx)
+	assert.Equal(t, state.StateFail, ret.AtomReturn.State)
+	assert.Equal(t, int64(2), ret.AtomReturn.Exit)
+	assert.Equal(t, uint(2), ret.Tries)
+
+	// So is a failure the atom says can't be retried.
+	s = &flaky{exits: []int64{3, 1}, retryable: retry.NotOnExits(3)}
+	r = NewRunner(*job.NewJob(s), req, 0, "flaky", 5, nil, nil, 0, time.Time{}, logger)
+	ret = r.Run(ctx)
+	assert.Equal(t, state.StateFail, ret.AtomReturn.State)
+	assert.Equal(t, uint(1), ret.Tries)
+}
+
+// ask needs a "name" as input before it runs.
+type ask struct {
+	step.Step
+	name string
+}
+
+func (s *ask) AtomID() atom.AtomID {
+	return atom.AtomID{Type: "runner.ask", ID: s.ID}
+}
+
+func (s *ask) Create(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+func (s *ask) InputRequest(ctx context.Context) *atom.InputRequest {
+	return &atom.InputRequest{
+		Prompt: "name?",
+		Schema: jio.Object().Keys(jio.K{"name": jio.String().Required()}),
+	}
+}
+
+func (s *ask) Run(ctx context.Context) (atom.Return, error) {
+	var input struct{ Name string }
+	if err := flowcontext.Input(ctx, &input); err != nil {
+		return atom.Return{State: state.StateFail}, err
+	}
+	s.name = input.Name
+	return atom.Return{State: state.StateSuccess}, nil
+}
+
+func (s *ask) Stop(ctx context.Context) error {
+	return nil
+}
+
+func TestWaitInput(t *testing.T) {
+	ctx := context.Background()
+	logger := &infra.Logger{Log: zap.NewNop()}
+	req := request.NewRequest()
+
+	// Without input, the job doesn't run.
+	s := &ask{}
+	r := NewRunner(*job.NewJob(s), req, 0, "ask", 1, nil, nil, 0, time.Time{}, logger)
+	ret := r.Run(ctx)
+	assert.Equal(t, state.StateWaitInput, ret.AtomReturn.State)
+	assert.Equal(t, uint(0), ret.Tries)
+	if assert.NotNil(t, ret.Input) {
+		assert.Equal(t, "name?", ret.Input.Prompt)
+	}
+	assert.Equal(t, "", s.name)
+
+	// With input, it runs and reads it.
+	r = NewRunner(*job.NewJob(s), req, 0, "ask", 1, nil, nil, 0, time.Time{}, logger)
+	ret = r.Run(flowcontext.WithInput(ctx, json.RawMessage(`{"Name":"flow"}`)))
+	assert.Equal(t, state.StateSuccess, ret.AtomReturn.State)
+	assert.Equal(t, uint(1), ret.Tries)
+	assert.Nil(t, ret.Input)
+	assert.Equal(t, "flow", s.name)
+}
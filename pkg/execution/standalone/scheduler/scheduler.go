@@ -0,0 +1,276 @@
+// Package scheduler shares the running slots of a process between the jobs of
+// all the chains it runs.
+package scheduler
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/longsolong/flow/pkg/orchestration/request"
+)
+
+// PriorityTag is the name of the request tag that sets the priority of a
+// request, an integer; higher runs first. Requests without it have priority 0.
+const PriorityTag = "priority"
+
+// RequestPriority returns the priority a request sets with its PriorityTag,
+// or 0 if it sets none or it isn't an integer.
+func RequestPriority(req *request.Request) int {
+	for _, tag := range req.RequestTags {
+		if tag.Name != PriorityTag {
+			continue
+		}
+		p, err := strconv.Atoi(tag.Value)
+		if err != nil {
+			return 0
+		}
+		return p
+	}
+	return 0
+}
+
+// Scheduler hands out the running slots of a process to the jobs traversers
+// submit. Namespaces share the slots by weight: a free slot goes to the
+// namespace with waiting jobs that runs the fewest jobs for its weight, then
+// to the one that got the fewest slots for its weight, so a namespace
+// submitting many jobs can't starve the others. Within a namespace,
+// jobs get a slot by request priority, then job priority, then in the order
+// they were submitted.
+type Scheduler struct {
+	slots   int            // jobs running at once, 0 for no limit
+	weights map[string]int // share of the slots of a namespace, 1 if missing
+
+	mux     *sync.Mutex
+	running map[string]int       // slots taken per namespace
+	total   int                  // slots taken
+	queues  map[string][]*Ticket // waiting tickets per namespace, best first
+	pass    map[string]float64   // slots granted per namespace over its weight, see grant
+	seq     uint64
+}
+
+// Ticket is a job waiting for, or holding, a slot of a Scheduler.
+type Ticket struct {
+	namespace       string
+	requestPriority int
+	priority        int
+	seq             uint64
+	since           time.Time
+	waited          time.Duration // set when ready is closed
+	ready           chan struct{} // closed when the ticket got its slot
+}
+
+// New returns a scheduler with slots running slots, 0 for no limit, shared
+// by namespace weight.
+func New(slots int, weights map[string]int) *Scheduler {
+	w := make(map[string]int, len(weights))
+	for ns, weight := range weights {
+		w[ns] = weight
+	}
+	return &Scheduler{
+		slots:   slots,
+		weights: w,
+		mux:     &sync.Mutex{},
+		running: make(map[string]int),
+		queues:  make(map[string][]*Ticket),
+		pass:    make(map[string]float64),
+	}
+}
+
+// Submit queues a job of a request of a namespace for a slot, and hands it
+// the slot right away if one is free. Call Wait to wait for the slot, then
+// Done when the job is done.
+func (s *Scheduler) Submit(namespace string, requestPriority, priority int) *Ticket {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.seq++
+	t := &Ticket{
+		namespace:       namespace,
+		requestPriority: requestPriority,
+		priority:        priority,
+		seq:             s.seq,
+		since:           time.Now(),
+		ready:           make(chan struct{}),
+	}
+	q := s.queues[namespace]
+	if len(q) == 0 {
+		// A namespace that had nothing to run doesn't get the slots it didn't
+		// ask for: it starts level with the namespaces waiting.
+		first := true
+		min := 0.0
+		for ns := range s.queues {
+			if first || s.pass[ns] < min {
+				min, first = s.pass[ns], false
+			}
+		}
+		if !first && s.pass[namespace] < min {
+			s.pass[namespace] = min
+		}
+	}
+	i := sort.Search(len(q), func(i int) bool { return t.before(q[i]) })
+	q = append(q, nil)
+	copy(q[i+1:], q[i:])
+	q[i] = t
+	s.queues[namespace] = q
+	s.grant()
+	return t
+}
+
+// Wait blocks until the ticket got its slot. It returns how long the ticket
+// waited, and false if stop was closed before it got the slot; then the
+// ticket no longer waits and Done must not be called.
+func (s *Scheduler) Wait(t *Ticket, stop <-chan struct{}) (time.Duration, bool) {
+	select {
+	case <-t.ready:
+		return t.waited, true
+	case <-stop:
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	select {
+	case <-t.ready:
+		// Got the slot while stopping, give it back.
+		s.doneLocked(t)
+	default:
+		q := s.queues[t.namespace]
+		for i := range q {
+			if q[i] == t {
+				s.dequeue(t.namespace, i)
+				break
+			}
+		}
+	}
+	return time.Since(t.since), false
+}
+
+// Done gives back the slot of a ticket.
+func (s *Scheduler) Done(t *Ticket) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.doneLocked(t)
+}
+
+func (s *Scheduler) doneLocked(t *Ticket) {
+	// CALLER MUST LOCK s.mux!
+	s.total--
+	s.running[t.namespace]--
+	if s.running[t.namespace] == 0 {
+		delete(s.running, t.namespace)
+	}
+	s.grant()
+}
+
+// Waiting returns the number of tickets waiting for a slot, per namespace.
+func (s *Scheduler) Waiting() map[string]int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	waiting := make(map[string]int, len(s.queues))
+	for ns, q := range s.queues {
+		waiting[ns] = len(q)
+	}
+	return waiting
+}
+
+// Running returns the number of slots taken, per namespace.
+func (s *Scheduler) Running() map[string]int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	running := make(map[string]int, len(s.running))
+	for ns, n := range s.running {
+		running[ns] = n
+	}
+	return running
+}
+
+// Granted reports whether the ticket got its slot.
+func (t *Ticket) Granted() bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// before reports whether t gets a slot before u of the same namespace.
+func (t *Ticket) before(u *Ticket) bool {
+	if t.requestPriority != u.requestPriority {
+		return t.requestPriority > u.requestPriority
+	}
+	if t.priority != u.priority {
+		return t.priority > u.priority
+	}
+	return t.seq < u.seq
+}
+
+// grant hands out the free slots to the waiting tickets.
+func (s *Scheduler) grant() {
+	// CALLER MUST LOCK s.mux!
+	for s.slots <= 0 || s.total < s.slots {
+		ns, ok := s.next()
+		if !ok {
+			return
+		}
+		t := s.queues[ns][0]
+		s.dequeue(ns, 0)
+		s.total++
+		s.running[ns]++
+		s.pass[ns] += 1 / float64(s.weight(ns))
+		t.waited = time.Since(t.since)
+		close(t.ready)
+	}
+}
+
+// next returns the namespace that gets the next free slot: the one running
+// the fewest jobs for its weight, then the one granted the fewest slots for
+// its weight, then the one with the best waiting ticket.
+func (s *Scheduler) next() (string, bool) {
+	// CALLER MUST LOCK s.mux!
+	best := ""
+	found := false
+	for ns, q := range s.queues {
+		if !found {
+			best, found = ns, true
+			continue
+		}
+		// running[ns]/weight(ns) < running[best]/weight(best)
+		a := s.running[ns] * s.weight(best)
+		b := s.running[best] * s.weight(ns)
+		if a != b {
+			if a < b {
+				best = ns
+			}
+			continue
+		}
+		if s.pass[ns] != s.pass[best] {
+			if s.pass[ns] < s.pass[best] {
+				best = ns
+			}
+			continue
+		}
+		if q[0].before(s.queues[best][0]) {
+			best = ns
+		}
+	}
+	return best, found
+}
+
+func (s *Scheduler) weight(namespace string) int {
+	// CALLER MUST LOCK s.mux!
+	if w, ok := s.weights[namespace]; ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+func (s *Scheduler) dequeue(namespace string, i int) {
+	// CALLER MUST LOCK s.mux!
+	q := append(s.queues[namespace][:i], s.queues[namespace][i+1:]...)
+	if len(q) == 0 {
+		delete(s.queues, namespace)
+		return
+	}
+	s.queues[namespace] = q
+}
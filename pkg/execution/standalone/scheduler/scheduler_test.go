@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"testing"
+
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestPriority(t *testing.T) {
+	req := request.NewRequest()
+	assert.Equal(t, 0, RequestPriority(req))
+	req.RequestTags = append(req.RequestTags, request.Tag{Name: "team", Value: "x"}, request.Tag{Name: PriorityTag, Value: "7"})
+	assert.Equal(t, 7, RequestPriority(req))
+	req.RequestTags[1].Value = "high"
+	assert.Equal(t, 0, RequestPriority(req))
+}
+
+// runAll gives back the slot of running, then of each ticket that gets it in
+// turn, and returns the namespaces of the tickets in the order they got it.
+func runAll(s *Scheduler, running *Ticket, tickets []*Ticket) []string {
+	waiting := append([]*Ticket(nil), tickets...)
+	var order []string
+	for len(waiting) > 0 {
+		s.Done(running)
+		for i, t := range waiting {
+			if t.Granted() {
+				running = t
+				waiting = append(waiting[:i], waiting[i+1:]...)
+				break
+			}
+		}
+		order = append(order, running.namespace)
+	}
+	return order
+}
+
+func TestScheduler(t *testing.T) {
+	stop := make(chan struct{})
+
+	// A namespace submitting many jobs doesn't starve the others: they share
+	// the slots by weight.
+	s := New(1, map[string]int{"interactive": 2})
+	first := s.Submit("backfill", 0, 0)
+	assert.True(t, first.Granted())
+	var tickets []*Ticket
+	for i := 0; i < 5; i++ {
+		tickets = append(tickets, s.Submit("backfill", 0, 0))
+	}
+	for i := 0; i < 4; i++ {
+		tickets = append(tickets, s.Submit("interactive", 0, 0))
+	}
+	assert.Equal(t, map[string]int{"backfill": 5, "interactive": 4}, s.Waiting())
+	order := runAll(s, first, tickets)
+	assert.Equal(t, []string{"backfill", "interactive", "interactive", "backfill", "interactive", "interactive", "backfill", "backfill", "backfill"}, order)
+
+	// Within a namespace, by request priority, then job priority.
+	s = New(1, nil)
+	first = s.Submit("ns", 0, 0)
+	low := s.Submit("ns", 0, 0)
+	urgent := s.Submit("ns", 0, 9)
+	vip := s.Submit("ns", 1, 0)
+	for _, next := range []*Ticket{vip, urgent, low} {
+		s.Done(first)
+		_, ok := s.Wait(next, stop)
+		assert.True(t, ok)
+		first = next
+	}
+	s.Done(first)
+	assert.Equal(t, map[string]int{}, s.Running())
+
+	// A stopped ticket no longer waits.
+	s = New(1, nil)
+	first = s.Submit("ns", 0, 0)
+	waiting := s.Submit("ns", 0, 0)
+	close(stop)
+	_, ok := s.Wait(waiting, stop)
+	assert.False(t, ok)
+	assert.Equal(t, map[string]int{}, s.Waiting())
+	s.Done(first)
+	assert.False(t, waiting.Granted())
+	assert.Equal(t, map[string]int{}, s.Running())
+
+	// No limit.
+	s = New(0, nil)
+	for i := 0; i < 10; i++ {
+		assert.True(t, s.Submit("ns", 0, 0).Granted())
+	}
+}
@@ -0,0 +1,146 @@
+package traverser
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Limits bound the jobs a traverser runs at once. Zero values mean no limit.
+type Limits struct {
+	MaxParallel int            // jobs running at once
+	Pools       map[string]int // slots of the pools named by dag.Node.Pool; pools missing here are unlimited
+}
+
+// limiter hands out running slots to jobs. Jobs waiting for a slot get it by
+// priority, then in the order they started waiting; a job waiting for a full
+// pool doesn't hold back the jobs after it.
+type limiter struct {
+	limits Limits
+
+	mux     *sync.Mutex
+	running int            // slots taken
+	pools   map[string]int // slots taken per pool
+	queue   []*waiter      // sorted by priority, then seq
+	seq     uint64
+}
+
+type waiter struct {
+	pool     string
+	priority int
+	seq      uint64
+	since    time.Time
+	waited   time.Duration // set when ready is closed
+	ready    chan struct{} // closed when the waiter got its slot
+}
+
+// granted reports whether the waiter got its slot.
+func (w *waiter) granted() bool {
+	select {
+	case <-w.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func newLimiter(limits Limits) *limiter {
+	return &limiter{
+		limits: limits,
+		mux:    &sync.Mutex{},
+		pools:  make(map[string]int),
+	}
+}
+
+// enqueue adds a waiter for a slot of the pool, and hands it the slot right
+// away if one is free. Call wait to wait for the slot.
+func (l *limiter) enqueue(pool string, priority int) *waiter {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.seq++
+	w := &waiter{
+		pool:     pool,
+		priority: priority,
+		seq:      l.seq,
+		since:    time.Now(),
+		ready:    make(chan struct{}),
+	}
+	i := sort.Search(len(l.queue), func(i int) bool { return l.queue[i].priority < priority })
+	l.queue = append(l.queue, nil)
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = w
+	l.grant()
+	return w
+}
+
+// wait blocks until the waiter got its slot. It returns how long the waiter
+// waited, and false if stop was closed before it got the slot; then it no
+// longer waits.
+func (l *limiter) wait(w *waiter, stop <-chan struct{}) (time.Duration, bool) {
+	select {
+	case <-w.ready:
+		return w.waited, true
+	case <-stop:
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	select {
+	case <-w.ready:
+		// Got the slot while stopping, give it back.
+		l.releaseLocked(w.pool)
+	default:
+		for i := range l.queue {
+			if l.queue[i] == w {
+				l.queue = append(l.queue[:i], l.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	return time.Since(w.since), false
+}
+
+// release gives back a slot of the pool.
+func (l *limiter) release(pool string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.releaseLocked(pool)
+}
+
+func (l *limiter) releaseLocked(pool string) {
+	// CALLER MUST LOCK l.mux!
+	l.running--
+	if pool != "" {
+		l.pools[pool]--
+	}
+	l.grant()
+}
+
+// waiting returns the number of jobs waiting for a slot.
+func (l *limiter) waiting() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return len(l.queue)
+}
+
+// grant hands out the free slots to the waiters, in queue order.
+func (l *limiter) grant() {
+	// CALLER MUST LOCK l.mux!
+	for i := 0; i < len(l.queue); {
+		if l.limits.MaxParallel > 0 && l.running >= l.limits.MaxParallel {
+			return
+		}
+		w := l.queue[i]
+		if slots := l.limits.Pools[w.pool]; w.pool != "" && slots > 0 && l.pools[w.pool] >= slots {
+			i++
+			continue
+		}
+		l.running++
+		if w.pool != "" {
+			l.pools[w.pool]++
+		}
+		w.waited = time.Since(w.since)
+		close(w.ready)
+		l.queue = append(l.queue[:i], l.queue[i+1:]...)
+	}
+}
@@ -0,0 +1,53 @@
+package traverser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	stop := make(chan struct{})
+
+	// Waiters get a slot by priority, then in the order they came.
+	l := newLimiter(Limits{MaxParallel: 1})
+	a := l.enqueue("", 0)
+	b := l.enqueue("", 0)
+	c := l.enqueue("", 5)
+	d := l.enqueue("", 5)
+	assert.True(t, a.granted())
+	assert.Equal(t, 3, l.waiting())
+	for _, w := range []*waiter{c, d, b} {
+		assert.False(t, w.granted())
+		l.release("")
+		_, ok := l.wait(w, stop)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 0, l.waiting())
+
+	// A waiter for a full pool doesn't hold back the others.
+	l = newLimiter(Limits{Pools: map[string]int{"db": 1}})
+	x := l.enqueue("db", 0)
+	y := l.enqueue("db", 10)
+	z := l.enqueue("", 0)
+	api := l.enqueue("api", 0) // not configured: unlimited
+	assert.True(t, x.granted())
+	assert.False(t, y.granted())
+	assert.True(t, z.granted())
+	assert.True(t, api.granted())
+	l.release("")
+	assert.False(t, y.granted())
+	l.release("db")
+	assert.True(t, y.granted())
+
+	// A stopped waiter leaves the queue.
+	l = newLimiter(Limits{MaxParallel: 1})
+	l.enqueue("", 0)
+	w := l.enqueue("", 0)
+	close(stop)
+	_, ok := l.wait(w, stop)
+	assert.False(t, ok)
+	assert.Equal(t, 0, l.waiting())
+	l.release("")
+	assert.False(t, w.granted())
+}
@@ -4,14 +4,19 @@ package traverser
 
 import (
 	"context"
+	"github.com/longsolong/flow/pkg/execution/runner"
 	"github.com/longsolong/flow/pkg/infra"
 	"github.com/longsolong/flow/pkg/orchestration/job"
 	"github.com/longsolong/flow/pkg/orchestration/standalone/graph"
+	"github.com/longsolong/flow/pkg/services/event"
 	"github.com/longsolong/flow/pkg/workflow/atom"
+	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
 	"github.com/longsolong/flow/pkg/workflow/state"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"sort"
 	"sync"
+	"time"
 )
 
 type reaper struct {
@@ -30,7 +35,9 @@ type reaper struct {
 // RunningChainReaper ...
 type RunningChainReaper struct {
 	reaper
-	runJobChan chan job.Job // enqueue next jobs to run here
+	runJobChan chan job.Job         // enqueue next jobs to run here
+	enqueued   map[atom.AtomID]bool // jobs enqueued but not reaped yet
+	jobs       int                  // jobs of the chain when it last grew
 }
 
 // NewRunningChainReaper ...
@@ -47,45 +54,98 @@ func NewRunningChainReaper(grapher *graph.Grapher, logger *infra.Logger, doneJob
 			doneJobChan: doneJobChan,
 		},
 		runJobChan: runJobChan,
+		enqueued:   make(map[atom.AtomID]bool),
 	}
 }
 
-// Run reaps jobs when they finish running. For each job reaped, if...
+// Run enqueues the first runnable jobs, then reaps jobs when they finish
+// running. For each job reaped, if...
 // - chain is done: save final state .
 // - job failed:    retry sequence if possible.
 // - job completed: prepared subsequent jobs and enqueue if runnable.
+// When the graph grows, or the input of a job waiting for it is submitted, it
+// enqueues the new runnable jobs.
 func (r *RunningChainReaper) Run(ctx context.Context) {
 	defer close(r.doneChan)
 
 	// If the chain is already done, skip straight to finalizing.
 	done, complete := r.grapher.Chain.IsDoneRunning()
 	if done {
-		r.Finalize(complete)
-		return
+		select {
+		case <-r.grapher.GraphPlotter.Done():
+			r.Finalize(complete)
+			return
+		default:
+		}
 	}
+	r.jobs = len(r.grapher.Chain.AllJobs())
+	r.enqueueRunnableJobs()
 
+	plotterDone := r.grapher.GraphPlotter.Done()
 REAPER:
 	for {
 		select {
 		case j := <-r.doneJobChan:
 			r.Reap(&j)
-			done, complete = r.grapher.Chain.IsDoneRunning()
-			if done {
-				select {
-				case <-r.grapher.GraphPlotter.Done():
-					break REAPER
-				default:
-				}
-			}
+		case <-r.grapher.Chain.Grown():
+			r.publishGrown()
+			r.enqueueRunnableJobs()
+		case <-plotterDone:
+			plotterDone = nil // closed, don't select it again
 		case <-r.stopChan:
 			// Don't Finalize the chain when stopping
 			return
 		}
+		if plotterDone != nil {
+			continue // the graph may still grow
+		}
+		if done, complete = r.grapher.Chain.IsDoneRunning(); done {
+			break REAPER
+		}
 	}
 
 	r.Finalize(complete)
 }
 
+// enqueueRunnableJobs enqueues the runnable jobs that aren't enqueued yet:
+// the first jobs of the chain, and the jobs added when the graph grows.
+func (r *RunningChainReaper) enqueueRunnableJobs() {
+	logger := r.logger.Log
+	jobs := r.grapher.Chain.RunnableJobs()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].AtomID().Less(jobs[j].AtomID()) })
+	for _, j := range jobs {
+		if r.enqueued[j.AtomID()] {
+			continue
+		}
+		node := r.grapher.Chain.MustGetNode(j.AtomID())
+		fields := []zapcore.Field{
+			zap.String("job_id", j.AtomID().String()),
+			zap.String("job_name", node.Name),
+		}
+		logger.Info("enqueueing runnable job", fields...)
+		r.enqueue(j)
+	}
+}
+
+// enqueue sends a job to be run.
+func (r *RunningChainReaper) enqueue(j *job.Job) {
+	r.enqueued[j.AtomID()] = true
+	r.publish(event.Event{Kind: event.JobEnqueued, AtomID: j.AtomID()})
+	r.runJobChan <- *j
+}
+
+// publishGrown publishes that the graph grew, if jobs were added to the chain
+// since it last did. The chain is also notified when jobs became runnable
+// again, see Chain.NotifyGrown.
+func (r *RunningChainReaper) publishGrown() {
+	n := len(r.grapher.Chain.AllJobs())
+	if n <= r.jobs {
+		return
+	}
+	r.publish(event.Event{Kind: event.GraphGrown, Jobs: n - r.jobs})
+	r.jobs = n
+}
+
 // Stop stops the reaper from reaping any more jobs. It blocks until the reaper
 // is stopped (will reap no more jobs and Run will return).
 func (r *RunningChainReaper) Stop(ctx context.Context) {
@@ -105,8 +165,10 @@ func (r *RunningChainReaper) Stop(ctx context.Context) {
 // to continue running the chain (or recognizes that the chain is done running).
 //
 // If chain is done: save final state + stop running more jobs.
-// If job failed:    retry sequence if possible.
+// If job failed:    retry sequence if possible, else handle subsequent jobs
+//                   as if it completed, their trigger rules may run them.
 // If job completed: prepared subsequent jobs and enqueue if runnable.
+// If job waits:     nothing to do until its input is submitted.
 func (r *RunningChainReaper) Reap(job *job.Job) {
 	node := r.grapher.Chain.DAG.MustGetNode(job.AtomID())
 	fields := []zapcore.Field{
@@ -121,36 +183,310 @@ func (r *RunningChainReaper) Reap(job *job.Job) {
 	logger := r.logger.Log
 	logger.Info("got job", sequenceFields...)
 
+	// Expand the graph from the outputs of a completed job before enqueueing
+	// its next jobs.
+	if _, ok := state.JobCompleteState[job.State]; ok {
+		if err := r.expandAfter(job.AtomID()); err != nil {
+			errFields := append([]zapcore.Field(nil), fields...)
+			errFields = append(errFields, zap.Error(err))
+			logger.Error("expanding graph failed", errFields...)
+			job.State = state.StateFail
+		}
+	}
+
 	// Set the final state of the job in the chain.
-	r.grapher.Chain.SetJobState(job.AtomID(), job.State)
+	r.setJobState(job.AtomID(), job.State)
+	r.publish(event.Event{Kind: event.JobFinished, AtomID: job.AtomID(), State: job.State})
+	delete(r.enqueued, job.AtomID())
+
+	// A job waiting for input is enqueued again, by enqueueRunnableJobs,
+	// once its input is submitted.
+	if job.State == state.StateWaitInput {
+		logger.Info("job waiting for input", fields...)
+		return
+	}
 
 	if _, ok := state.JobCompleteState[job.State]; ok {
-		for _, nextJob := range r.grapher.Chain.NextJobs(job.AtomID()) {
-			nextFields := append([]zapcore.Field(nil), fields...)
-			nextFields = append(nextFields, zap.String("next_job_id", nextJob.AtomID().String()))
-
-			if !r.grapher.Chain.IsRunnable(nextJob.AtomID()) {
-				logger.Info("next job not runnable", nextFields...)
-				continue
-			}
-			logger.Info("enqueueing next job", nextFields...)
-			r.runJobChan <- *nextJob
-		}
+		r.enqueueNextJobs(job.AtomID())
 	} else {
 		// Job was NOT successful. The job.Runner already did job retries.
 		// Retry sequence if possible.
 		if !r.grapher.Chain.CanRetrySequence(job.AtomID()) {
 			logger.Warn("job failed, no sequence tries left", fields...)
+			// Next jobs triggered by all_done, one_failed, etc. can still run.
+			r.enqueueNextJobs(job.AtomID())
 			return
 		}
 		logger.Warn("job failed, retrying sequence", fields...)
 		sequenceStartJob := r.prepareSequenceRetry(job)
-		r.runJobChan <- *sequenceStartJob // re-enqueue first job in sequence
+		r.publish(event.Event{Kind: event.SequenceRetried, AtomID: sequenceStartJob.AtomID()})
+		r.enqueue(sequenceStartJob) // re-enqueue first job in sequence
+	}
+}
+
+// expandAfter calls the Expander of the grapher, if it has one, for a job that
+// completed.
+func (r *RunningChainReaper) expandAfter(jobID atom.AtomID) error {
+	expander, ok := r.grapher.GraphPlotter.(graph.Expander)
+	if !ok {
+		return nil
 	}
+	req := r.grapher.Req
+	return expander.ExpandAfter(req.Context(), req, jobID, r.grapher.Chain.JobOutputs(jobID))
 }
 
-// Finalize determines the final state of the chain
+// enqueueNextJobs enqueues the next jobs of a done job whose trigger rule is
+// met. Next jobs whose trigger rule never will be met are ignored if none of
+// their upstream jobs failed; either way, their own next jobs are handled in
+// turn, e.g. to run a TriggerAlways job after a failed branch.
+func (r *RunningChainReaper) enqueueNextJobs(jobID atom.AtomID) {
+	logger := r.logger.Log
+	for _, nextJob := range r.grapher.Chain.NextJobs(jobID) {
+		nextFields := []zapcore.Field{
+			zap.String("job_id", jobID.String()),
+			zap.String("next_job_id", nextJob.AtomID().String()),
+		}
+
+		if r.enqueued[nextJob.AtomID()] {
+			logger.Info("next job already enqueued", nextFields...)
+			continue
+		}
+		if r.grapher.Chain.IsRunnable(nextJob.AtomID()) {
+			logger.Info("enqueueing next job", nextFields...)
+			r.enqueue(nextJob)
+			continue
+		}
+		if r.grapher.Chain.IsIgnorable(nextJob.AtomID()) {
+			logger.Info("ignoring next job, trigger rule not met", nextFields...)
+			r.setJobState(nextJob.AtomID(), state.StateIgnored)
+			r.enqueueNextJobs(nextJob.AtomID())
+			continue
+		}
+		if r.grapher.Chain.IsBlocked(nextJob.AtomID()) {
+			logger.Info("next job never runnable", nextFields...)
+			r.enqueueNextJobs(nextJob.AtomID())
+			continue
+		}
+		logger.Info("next job not runnable", nextFields...)
+	}
+}
+
+// Finalize determines the final state of the chain: SUCCESS if every job
+// completed, FAIL otherwise.
 func (r *RunningChainReaper) Finalize(complete bool) {
+	if complete {
+		r.finalize(state.StateSuccess)
+	} else {
+		r.finalize(state.StateFail)
+	}
+}
+
+// finalize sets the final state of the chain, which calls the chain's
+// OnFinalize callbacks.
+func (r *reaper) finalize(s state.State) {
+	c := r.grapher.Chain
+	fields := []zapcore.Field{
+		zap.String("request_id", r.grapher.Req.RequestUUID.String()),
+		zap.String("chain_name", c.DAG.Name),
+		zap.Int("chain_version", c.DAG.Version),
+		zap.String("state", state.StateText[s]),
+		zap.Time("started_at", c.StartedAt()),
+	}
+	c.Finalize(s)
+	fields = append(fields, zap.Duration("runtime", c.FinishedAt().Sub(c.StartedAt())))
+	r.logger.Log.Info("chain finalized", fields...)
+	r.publish(event.Event{Kind: event.ChainFinished, State: s})
+}
+
+// publish publishes an event of the chain to the event bus of the request,
+// see flowcontext.WithEvents.
+func (r *reaper) publish(e event.Event) {
+	e.RequestUUID = r.grapher.Req.RequestUUID.String()
+	flowcontext.Events(r.grapher.Req.Context()).Publish(e)
+}
+
+// stoppingReaper is the base of the reapers that take over when the running
+// reaper is stopped. They don't enqueue any job; they only reap the jobs that
+// were still running until none is left in the runner repo.
+type stoppingReaper struct {
+	reaper
+	runnerRepo runner.Repo      // reap until it is empty
+	timeout    <-chan time.Time // give up reaping when it fires
+}
+
+func newStoppingReaper(grapher *graph.Grapher, logger *infra.Logger, doneJobChan chan job.Job, runnerRepo runner.Repo, timeout <-chan time.Time) stoppingReaper {
+	return stoppingReaper{
+		reaper: reaper{
+			grapher: grapher,
+			logger:  logger,
+
+			stopMux:  &sync.Mutex{},
+			stopChan: make(chan struct{}),
+
+			doneChan:    make(chan struct{}),
+			doneJobChan: doneJobChan,
+		},
+		runnerRepo: runnerRepo,
+		timeout:    timeout,
+	}
+}
+
+// run calls reap for every done job until no job runner is left in the runner
+// repo, the timeout fires or the reaper is stopped.
+func (r *stoppingReaper) run(reap func(*job.Job)) {
+	defer close(r.doneChan)
+	logger := r.logger.Log
+
+	// A job's runner is removed from the repo after the job is sent to
+	// doneJobChan, so the repo is checked again every little while instead of
+	// only after reaping a job.
+	for r.runnerRepo.Count() > 0 {
+		select {
+		case j := <-r.doneJobChan:
+			reap(&j)
+		case <-time.After(100 * time.Millisecond):
+		case <-r.timeout:
+			fields := []zapcore.Field{
+				zap.Int("running", r.runnerRepo.Count()),
+			}
+			logger.Warn("timed out reaping running jobs", fields...)
+			return
+		case <-r.stopChan:
+			return
+		}
+	}
+}
+
+// Stop stops the reaper from reaping any more jobs. It blocks until Run
+// returns.
+func (r *stoppingReaper) Stop(ctx context.Context) {
+	r.stopMux.Lock()
+	defer r.stopMux.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+
+	close(r.stopChan)
+	<-r.doneChan
+}
+
+// StoppedChainReaper reaps the jobs that were still running when a chain was
+// stopped, recording their final state.
+type StoppedChainReaper struct {
+	stoppingReaper
+}
+
+// NewStoppedChainReaper ...
+func NewStoppedChainReaper(grapher *graph.Grapher, logger *infra.Logger, doneJobChan chan job.Job, runnerRepo runner.Repo, timeout <-chan time.Time) *StoppedChainReaper {
+	return &StoppedChainReaper{
+		stoppingReaper: newStoppingReaper(grapher, logger, doneJobChan, runnerRepo, timeout),
+	}
+}
+
+// Run reaps done jobs until no job is left running, then finalizes the chain
+// as STOPPED.
+func (r *StoppedChainReaper) Run(ctx context.Context) {
+	r.run(r.Reap)
+	r.finalize(state.StateStopped)
+}
+
+// Reap saves the final state of a job that was running when the chain was
+// stopped. A job that was stopped before it started is saved as stopped.
+func (r *StoppedChainReaper) Reap(job *job.Job) {
+	if job.State == state.StateUnknown {
+		job.State = state.StateStopped
+	}
+	fields := []zapcore.Field{
+		zap.String("job_id", job.AtomID().String()),
+		zap.String("state", state.StateText[job.State]),
+	}
+	r.logger.Log.Info("got stopped job", fields...)
+
+	r.setJobState(job.AtomID(), job.State)
+	r.publish(event.Event{Kind: event.JobFinished, AtomID: job.AtomID(), State: job.State})
+}
+
+// SuspendedChainReaper reaps the jobs that were still running when a chain was
+// suspended. It leaves the chain in a state where resuming it reruns every job
+// and sequence that didn't finish, as if the suspend never happened: the
+// sequence try interrupted by the suspend doesn't count against SequenceRetry.
+type SuspendedChainReaper struct {
+	stoppingReaper
+	rolledBack map[atom.AtomID]bool // sequences rolled back, by sequence id
+}
+
+// NewSuspendedChainReaper ...
+func NewSuspendedChainReaper(grapher *graph.Grapher, logger *infra.Logger, doneJobChan chan job.Job, runnerRepo runner.Repo, timeout <-chan time.Time) *SuspendedChainReaper {
+	return &SuspendedChainReaper{
+		stoppingReaper: newStoppingReaper(grapher, logger, doneJobChan, runnerRepo, timeout),
+		rolledBack:     map[atom.AtomID]bool{},
+	}
+}
+
+// Run reaps done jobs until no job is left running, then finalizes the chain
+// as SUSPENDED.
+func (r *SuspendedChainReaper) Run(ctx context.Context) {
+	r.run(r.Reap)
+	r.finalize(state.StateSuspended)
+}
+
+// Reap saves the final state of a job that was running when the chain was
+// suspended.
+//
+// If job completed: nothing else to do, next jobs are runnable on resume,
+//                   unless its sequence was rolled back.
+// If job stopped:   roll back its sequence, or only the job, to up for retry.
+// If job failed:    roll back its sequence if it can be retried.
+// If job waits:     nothing to do, it waits for its input on resume.
+func (r *SuspendedChainReaper) Reap(job *job.Job) {
+	fields := []zapcore.Field{
+		zap.String("job_id", job.AtomID().String()),
+		zap.String("state", state.StateText[job.State]),
+	}
+	logger := r.logger.Log
+	logger.Info("got suspended job", fields...)
+
+	r.setJobState(job.AtomID(), job.State)
+	r.publish(event.Event{Kind: event.JobFinished, AtomID: job.AtomID(), State: job.State})
+
+	sequenceStartJob := r.grapher.Chain.SequenceStartJob(job.AtomID())
+	if _, ok := state.JobCompleteState[job.State]; ok {
+		if sequenceStartJob != nil && r.rolledBack[sequenceStartJob.AtomID()] {
+			// Its sequence will rerun on resume, so must it.
+			r.setJobState(job.AtomID(), state.StateUpForRetry)
+		}
+		return
+	}
+	switch job.State {
+	case state.StateWaitInput:
+		// Still waits for its input on resume.
+		return
+	case state.StateStopped, state.StateUnknown: // unknown: stopped before it started
+		if sequenceStartJob == nil {
+			r.setJobState(job.AtomID(), state.StateUpForRetry)
+			return
+		}
+		if !r.rolledBack[sequenceStartJob.AtomID()] {
+			// The sequence was interrupted, it did not fail: give its try back.
+			r.grapher.Chain.DecrementSequenceTries(job.AtomID(), 1)
+		}
+	default:
+		if !r.grapher.Chain.CanRetrySequence(job.AtomID()) {
+			logger.Warn("job failed, no sequence tries left", fields...)
+			return
+		}
+	}
+	r.prepareSequenceRetry(job)
+	r.rolledBack[sequenceStartJob.AtomID()] = true
+}
+
+// setJobState sets the state of a job in the chain. Reapers only make the
+// transitions of state.JobTransitions, so an error is a bug: it is logged.
+func (r *reaper) setJobState(jobID atom.AtomID, s state.State) {
+	if err := r.grapher.Chain.SetJobState(jobID, s); err != nil {
+		r.logger.Log.Error("setting job state failed", zap.String("job_id", jobID.String()), zap.Error(err))
+	}
 }
 
 // prepareSequenceRetry prepares a sequence to retry. The caller should check
@@ -188,7 +524,7 @@ func (r *reaper) prepareSequenceRetry(failedJob *job.Job) *job.Job {
 	// Roll back completed sequence jobs
 	for _, j := range sequenceJobsToRetry {
 		// Roll back job state to pending so it's runnable again
-		r.grapher.Chain.SetJobState(j.AtomID(), state.StateUpForRetry)
+		r.setJobState(j.AtomID(), state.StateUpForRetry)
 	}
 
 	// Running reaper will re-enqueue/re-run seq from this seq start job.
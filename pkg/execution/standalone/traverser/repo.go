@@ -0,0 +1,90 @@
+package traverser
+
+import (
+	"time"
+
+	"github.com/orcaman/concurrent-map"
+)
+
+// Repo is a small wrapper around a concurrent map that provides the ability to
+// store and retrieve Traversers in a thread-safe way. It is server-wide and
+// keyed on request UUID.
+//
+// A Traverser is kept while it runs, and for a retention period once it is
+// done so its flow can still be looked at, then removed. A suspended
+// Traverser is kept until it is resumed.
+type Repo interface {
+	Set(requestID string, traverser *Traverser)
+	Get(requestID string) *Traverser
+	Remove(requestID string)
+	Items() map[string]*Traverser
+	Count() int
+}
+
+type repo struct {
+	c         cmap.ConcurrentMap
+	retention time.Duration
+}
+
+// NewRepo returns a Repo keeping done Traversers for retention, or until
+// they are removed if it is 0.
+func NewRepo(retention time.Duration) Repo {
+	return &repo{
+		c:         cmap.New(),
+		retention: retention,
+	}
+}
+
+// Set sets a Traverser in the repo.
+func (r *repo) Set(requestID string, traverser *Traverser) {
+	r.c.Set(requestID, traverser)
+	if r.retention > 0 {
+		go r.expire(requestID, traverser)
+	}
+}
+
+// expire removes the traverser of a request from the repo retention after it
+// is done, unless it was suspended or it was replaced in the meantime, e.g.
+// by the traverser resuming it.
+func (r *repo) expire(requestID string, traverser *Traverser) {
+	<-traverser.Done()
+	if traverser.Suspended() {
+		return
+	}
+	time.Sleep(r.retention)
+	r.c.RemoveCb(requestID, func(key string, v interface{}, exists bool) bool {
+		return exists && v == traverser
+	})
+}
+
+// Get returns the Traverser of a request, or nil.
+func (r *repo) Get(requestID string) *Traverser {
+	v, ok := r.c.Get(requestID)
+	if !ok {
+		return nil
+	}
+	return v.(*Traverser)
+}
+
+// Remove removes a traverser from the repo.
+func (r *repo) Remove(requestID string) {
+	r.c.Remove(requestID)
+}
+
+// Items returns a map of requestID => Traverser with all the Traversers in the repo.
+func (r *repo) Items() map[string]*Traverser {
+	traversers := map[string]*Traverser{} // requestID => traverser
+	for requestID, v := range r.c.Items() {
+		traverser, ok := v.(*Traverser)
+		if !ok {
+			panic("traverser for request ID " + requestID + " is not type *Traverser") // should be impossible
+		}
+		traversers[requestID] = traverser
+	}
+	return traversers
+}
+
+// Count returns the number of Traversers in the repo.
+func (r *repo) Count() int {
+	return r.c.Count()
+}
@@ -0,0 +1,44 @@
+package traverser
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestRepo(t *testing.T) {
+	logger := &infra.Logger{Log: zap.NewNop()}
+	b := newBlock("2")
+	g := newSequenceGrapher(t, b)
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	repo := NewRepo(50 * time.Millisecond)
+	repo.Set("a", tr)
+	go tr.Run(context.Background())
+	waitJobState(t, g, b.AtomID(), state.StateRunning)
+
+	// Running and suspended traversers are kept.
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, tr, repo.Get("a"))
+	assert.Nil(t, tr.Suspend(context.Background()))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, tr, repo.Get("a"))
+
+	// Done ones are removed after the retention.
+	resumed, err := tr.Resume()
+	assert.Nil(t, err)
+	repo.Set("a", resumed)
+	close(b.release)
+	go resumed.Run(context.Background())
+	<-resumed.Done()
+	assert.Equal(t, resumed, repo.Get("a"))
+	for i := 0; i < 100 && repo.Get("a") != nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, repo.Get("a"))
+	assert.Equal(t, 0, repo.Count())
+}
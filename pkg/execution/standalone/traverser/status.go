@@ -0,0 +1,40 @@
+package traverser
+
+import (
+	"time"
+
+	"github.com/longsolong/flow/pkg/orchestration/standalone/chain"
+	"github.com/longsolong/flow/pkg/services/store"
+	"github.com/longsolong/flow/pkg/workflow/state"
+)
+
+// Status is a point in time report of the chain run by a traverser.
+type Status struct {
+	RequestUUID string
+	Name        string // name of the graph
+	Version     int    // version of the graph
+	State       state.State
+	StateText   string
+	StartedAt   time.Time
+	FinishedAt  time.Time // zero until the chain is finalized
+	Jobs        []chain.JobStatus
+	Audit       []store.Audit // operator actions on the jobs, oldest first
+}
+
+// Status reports the chain run by the traverser. The chain is RUNNING until
+// it is finalized as SUCCESS, FAIL, STOPPED or SUSPENDED.
+func (t *Traverser) Status() Status {
+	c := t.grapher.Chain
+	s := c.State()
+	return Status{
+		RequestUUID: t.grapher.Req.RequestUUID.String(),
+		Name:        t.grapher.DAG.Name,
+		Version:     t.grapher.DAG.Version,
+		State:       s,
+		StateText:   state.StateText[s],
+		StartedAt:   c.StartedAt(),
+		FinishedAt:  c.FinishedAt(),
+		Jobs:        c.JobStatuses(),
+		Audit:       c.Audit(),
+	}
+}
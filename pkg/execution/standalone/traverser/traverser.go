@@ -4,20 +4,37 @@ package traverser
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/faceair/jio"
 	"github.com/longsolong/flow/pkg/execution/runner"
+	"github.com/longsolong/flow/pkg/execution/standalone/scheduler"
 	"github.com/longsolong/flow/pkg/execution/traverser"
 	"github.com/longsolong/flow/pkg/infra"
 	"github.com/longsolong/flow/pkg/orchestration/job"
 	"github.com/longsolong/flow/pkg/orchestration/standalone/graph"
+	"github.com/longsolong/flow/pkg/services/event"
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
+	"github.com/longsolong/flow/pkg/workflow/dag"
 	"github.com/longsolong/flow/pkg/workflow/state"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+var (
+	// ErrNotSuspended is returned when resuming a traverser that was not
+	// suspended, and has no job marked to run again, or that was resumed
+	// already.
+	ErrNotSuspended = errors.New("traverser not suspended")
+)
+
 // Traverser ...
 type Traverser struct {
 	grapher *graph.Grapher
@@ -27,15 +44,25 @@ type Traverser struct {
 	runJobChan  chan job.Job  // jobs to be run
 	doneJobChan chan job.Job  // jobs that are done
 	doneChan    chan struct{} // closed when traverser finishes running
+	runDoneChan chan struct{} // closed when Run returns
 
 	stopMux     *sync.RWMutex // lock around checks to stopped
 	stopped     bool          // has traverser been stopped
+	suspended   bool          // has traverser been suspended, implies stopped
+	resumed     bool          // has Resume returned a traverser continuing the chain
 	stopChan    chan struct{} // don't run jobs in runJobs
 	pendingChan chan struct{} // runJobs closes on return
 	pending     int64         // N runJob goroutines are pending runnerRepo.Set
 
 	runnerRepo runner.Repo // stores actively running jobs
 
+	limits  Limits   // bounds the jobs running at once
+	limiter *limiter // hands out running slots within limits
+
+	scheduler       *scheduler.Scheduler // shares the running slots of the process, nil if none
+	namespace       string               // namespace of the workflow, the share of scheduler slots it runs in
+	requestPriority int                  // priority of the request among the scheduled ones
+
 	logger *infra.Logger
 
 	stopTimeout time.Duration // Time to wait for jobs to stop
@@ -55,12 +82,19 @@ func NewTraverser(grapher *graph.Grapher, logger *infra.Logger, stopTimeout, sen
 	return &Traverser{
 		grapher: grapher,
 
+		// Made here rather than in Run so Stop and Suspend can't race with
+		// Run on it.
+		reaper: NewRunningChainReaper(grapher, logger, doneJobChan, runJobChan),
+
 		runnerRepo: runnerRepo,
 
+		limiter: newLimiter(Limits{}),
+
 		runJobChan:  runJobChan,
 		doneJobChan: doneJobChan,
 
 		doneChan:    make(chan struct{}),
+		runDoneChan: make(chan struct{}),
 		stopChan:    make(chan struct{}),
 		pendingChan: make(chan struct{}),
 
@@ -72,38 +106,49 @@ func NewTraverser(grapher *graph.Grapher, logger *infra.Logger, stopTimeout, sen
 	}
 }
 
+// SetLimits bounds the jobs the traverser runs at once. Jobs over the limits
+// wait for a running slot, higher Node.Priority first. Call SetLimits before
+// Run.
+func (t *Traverser) SetLimits(l Limits) {
+	t.limits = l
+	t.limiter = newLimiter(l)
+}
+
+// SetScheduler makes the traverser run each job in a slot of s, once it got a
+// slot within its own limits. The jobs get the slots of the namespace of the
+// workflow, by the scheduler.RequestPriority of the request, then by
+// Node.Priority. Call SetScheduler before Run.
+func (t *Traverser) SetScheduler(s *scheduler.Scheduler, namespace string) {
+	t.scheduler = s
+	t.namespace = namespace
+	t.requestPriority = scheduler.RequestPriority(t.grapher.Req)
+}
+
 // Run runs all jobs in the chain and blocks until the chain finishes running, is
-// stopped.
+// stopped. The chain is finalized before Run returns; register callbacks with
+// Chain.OnFinalize to observe its final state.
 func (t *Traverser) Run(ctx context.Context) {
 	logger := t.logger.Log
 	logger.Info("traverser.Run call")
 	defer logger.Info("traverser.Run return")
+	defer close(t.runDoneChan)
+	t.grapher.Chain.Start()
+	flowcontext.Events(t.grapher.Req.Context()).Publish(event.Event{
+		Kind:        event.ChainStarted,
+		RequestUUID: t.grapher.Req.RequestUUID.String(),
+	})
 
 	// Start a goroutine to run jobs. This consumes runJobChan. When jobs are done,
 	// they're sent to doneJobChan, which a reaper consumes. This goroutine returns
 	// when runJobChan is closed below.
 	go t.runJobs(ctx)
 
-	// Enqueue all the first runnable jobs
-	initialJobs := t.grapher.Chain.RunnableJobs()
-	go func() {
-		for _, j := range initialJobs {
-			node := t.grapher.Chain.MustGetNode(j.AtomID())
-			fields := []zapcore.Field{
-				zap.String("job_id", j.AtomID().String()),
-				zap.String("job_name", node.Name),
-			}
-			logger.Info("initial job", fields...)
-			t.runJobChan <- *j
-		}
-	}()
-
-	// Start a goroutine to reap done jobs. The runningReaper consumes from
-	// doneJobChan and sends the next jobs to be run to runJobChan. Stop()
+	// Start a goroutine to reap done jobs. The runningReaper enqueues the first
+	// runnable jobs, consumes from doneJobChan and sends the next jobs to be
+	// run to runJobChan. Stop()
 	// calls t.reaper.Stop(), which is this reaper. The close(t.runJobChan)
 	// causes runJobs() (started above ^) to return.
 	runningReaperChan := make(chan struct{})
-	t.reaper = NewRunningChainReaper(t.grapher, t.logger, t.doneJobChan, t.runJobChan)
 	go func() {
 		defer close(runningReaperChan) // indicate reaper is done (see select below)
 		defer close(t.runJobChan)      // stop runJobs goroutine
@@ -138,6 +183,16 @@ func (t *Traverser) Run(ctx context.Context) {
 	}
 }
 
+// Done returns a channel that is closed when Run returns.
+func (t *Traverser) Done() <-chan struct{} {
+	return t.runDoneChan
+}
+
+// Grapher returns the grapher the traverser is running.
+func (t *Traverser) Grapher() *graph.Grapher {
+	return t.grapher
+}
+
 // Stop stops the running job chain and stopping all currently running jobs.
 func (t *Traverser) Stop(ctx context.Context) error {
 	// Don't do anything if the traverser has already been stopped.
@@ -164,10 +219,180 @@ func (t *Traverser) Stop(ctx context.Context) error {
 		err = fmt.Errorf("traverser was stopped, but encountered an error in the process: %s", err)
 	}
 
+	// Record the final state of the jobs that were running.
+	t.reaper = NewStoppedChainReaper(t.grapher, t.logger, t.doneJobChan, t.runnerRepo, timeout)
+	t.reaper.Run(ctx) // blocks until no job is running
+
 	close(t.doneChan)
 	return err
 }
 
+// Suspend stops the running job chain like Stop, but keeps it resumable: it
+// waits for the stopped jobs to be done and reaps them with a
+// SuspendedChainReaper, which leaves unfinished jobs and sequences up for
+// retry. Use Resume to continue running the chain.
+func (t *Traverser) Suspend(ctx context.Context) error {
+	// Don't do anything if the traverser has already been stopped.
+	t.stopMux.Lock()
+	defer t.stopMux.Unlock()
+	if t.stopped {
+		return nil
+	}
+	logger := t.logger.Log
+
+	close(t.stopChan)
+	t.stopped = true
+	t.suspended = true
+	logger.Info("suspending traverser and all jobs")
+
+	// Stop the runningReaper
+	t.reaper.Stop(ctx) // blocks until runningReaper stops
+
+	// Stop all job runners in the runner repo, then reap them until none is
+	// left running.
+	timeout := time.After(t.stopTimeout)
+	err := t.stopRunningJobs(ctx, timeout)
+	if err != nil {
+		err = fmt.Errorf("traverser was suspended, but encountered an error in the process: %s", err)
+	}
+	t.reaper = NewSuspendedChainReaper(t.grapher, t.logger, t.doneJobChan, t.runnerRepo, timeout)
+	t.reaper.Run(ctx) // blocks until no job is running
+
+	close(t.doneChan)
+	return err
+}
+
+// Resume returns a new traverser that continues running the chain of a
+// suspended traverser from where it was suspended. It also runs the chain of
+// a traverser that is done again if an operator marked jobs of it, see
+// chain.MarkJobSkipped and chain.MarkJobRetry, so that the chain has jobs to
+// run or can succeed. The returned traverser is not running yet. A traverser
+// is resumed only once, so that no two traversers run the chain.
+func (t *Traverser) Resume() (*Traverser, error) {
+	t.stopMux.RLock()
+	suspended := t.suspended
+	t.stopMux.RUnlock()
+	if !suspended {
+		select {
+		case <-t.Done():
+		default:
+			return nil, ErrNotSuspended
+		}
+		if !t.marked() {
+			return nil, ErrNotSuspended
+		}
+	}
+	<-t.Done()
+	t.stopMux.Lock()
+	if t.resumed {
+		t.stopMux.Unlock()
+		return nil, ErrNotSuspended
+	}
+	t.resumed = true
+	t.stopMux.Unlock()
+
+	r := NewTraverser(t.grapher, t.logger, t.stopTimeout, t.sendTimeout)
+	r.SetLimits(t.limits)
+	if t.scheduler != nil {
+		r.SetScheduler(t.scheduler, t.namespace)
+	}
+	return r, nil
+}
+
+// marked reports whether an operator marked jobs of the chain, and the chain
+// isn't done running as it was finalized: it has jobs to run, or it can
+// succeed.
+func (t *Traverser) marked() bool {
+	c := t.grapher.Chain
+	if len(c.Audit()) == 0 {
+		return false
+	}
+	done, complete := c.IsDoneRunning()
+	return !done || (complete && c.State() != state.StateSuccess)
+}
+
+// Recover prepares a chain restored from a store after the process running it
+// died. The jobs that were running are reaped as if the chain had been
+// suspended: they and their unfinished sequences are left up for retry, so Run
+// reruns them, and the interrupted sequence tries don't count. Jobs waiting
+// for input wait for it again. Call Recover before Run.
+func (t *Traverser) Recover() {
+	logger := t.logger.Log
+	suspendedReaper := NewSuspendedChainReaper(t.grapher, t.logger, t.doneJobChan, t.runnerRepo, nil)
+	jobs := t.grapher.Chain.AllJobs()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].AtomID().Less(jobs[j].AtomID()) })
+	for _, j := range jobs {
+		if j.State == state.StateWaitInput {
+			// Its prompt isn't saved: run it again so it asks for its
+			// input anew.
+			if err := t.grapher.Chain.SetJobState(j.AtomID(), state.StateUnknown); err != nil {
+				logger.Error("recovering waiting job failed", zap.String("job_id", j.AtomID().String()), zap.Error(err))
+			}
+			continue
+		}
+		if j.State != state.StateRunning {
+			continue
+		}
+		fields := []zapcore.Field{
+			zap.String("job_id", j.AtomID().String()),
+		}
+		logger.Info("recovering interrupted job", fields...)
+		interrupted := *j
+		interrupted.State = state.StateStopped
+		suspendedReaper.Reap(&interrupted)
+	}
+}
+
+// SubmitInput validates input against the schema of the atom.InputRequest of
+// a job waiting for input, and makes the job run with the validated input. It
+// returns workflow.ErrNotRegisteredNode if the chain has no such job,
+// workflow.ErrNotWaitingInput if the job isn't in StateWaitInput, and an
+// error wrapping workflow.ErrInvalidInput if the input isn't valid.
+func (t *Traverser) SubmitInput(ctx context.Context, atomID atom.AtomID, input []byte) error {
+	node, err := t.grapher.Chain.DAG.GetNode(atomID)
+	if err != nil {
+		return fmt.Errorf("%s: %w", atomID, err)
+	}
+	requester, ok := node.Datum.(atom.InputRequester)
+	if !ok || t.grapher.Chain.JobState(atomID) != state.StateWaitInput {
+		return fmt.Errorf("%s: %w", atomID, workflow.ErrNotWaitingInput)
+	}
+	request := requester.InputRequest(ctx)
+	if request == nil {
+		return fmt.Errorf("%s: %w", atomID, workflow.ErrNotWaitingInput)
+	}
+	data, err := jio.ValidateJSON(&input, request.Schema)
+	if err != nil {
+		return fmt.Errorf("%w: %s", workflow.ErrInvalidInput, err)
+	}
+	validated, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("%w: %s", workflow.ErrInvalidInput, err)
+	}
+	if err := t.grapher.Chain.SubmitJobInput(atomID, validated); err != nil {
+		return err
+	}
+	fields := []zapcore.Field{
+		zap.String("job_id", atomID.String()),
+	}
+	t.logger.Log.Info("job input submitted", fields...)
+	return nil
+}
+
+// Stopped reports whether the traverser has been stopped or suspended.
+func (t *Traverser) Stopped() bool {
+	t.stopMux.RLock()
+	defer t.stopMux.RUnlock()
+	return t.stopped
+}
+
+// Suspended reports whether the traverser has been suspended.
+func (t *Traverser) Suspended() bool {
+	t.stopMux.RLock()
+	defer t.stopMux.RUnlock()
+	return t.suspended
+}
+
 // runJobs loops on the runJobChan, and runs each job that comes through the
 // channel. When the job is done, it sends the job out through the doneJobChan
 // which is being consumed by a reaper.
@@ -242,7 +467,7 @@ func (t *Traverser) runJobs(ctx context.Context) {
 
 			totalTries := t.grapher.Chain.JobTries(j.AtomID())
 
-			jobRunner := runner.NewRunner(j, t.grapher.Req, totalTries, node.Name, node.Retry, node.RetryWait, t.logger)
+			jobRunner := runner.NewRunner(j, t.grapher.Req, totalTries, node.Name, node.Retry, node.RetryBackoff(), node.RetryIf, node.Timeout, t.grapher.Chain.Deadline(), t.logger)
 
 			// Add the runner to the repo. Runners in the repo are used
 			// by the Stop methods on the traverser.
@@ -251,17 +476,72 @@ func (t *Traverser) runJobs(ctx context.Context) {
 			t.runnerRepo.Set(j.AtomID().String(), jobRunner)
 			atomic.AddInt64(&t.pending, -1)
 
+			// Wait for a running slot, then for a slot of the scheduler. If the
+			// traverser is stopped meanwhile, the job doesn't run, as if it was
+			// stopped before it started.
+			ticket, wait, ok := t.waitSlot(node, fields)
+			t.grapher.Chain.SetJobWaitTime(j.AtomID(), wait)
+			if !ok {
+				logger.Info("not running job: traverser stopped", fields...)
+				j.State = state.StateUnknown
+				return
+			}
+			defer t.releaseSlot(node, ticket)
+
 			// Run the job. This is a blocking operation that could take a long time.
+			// The job reads the outputs of its upstream jobs, and the input
+			// submitted for it, from its context.
+			// A job that can't run, e.g. one already done, is reaped in the
+			// state it is in.
+			if err := t.grapher.Chain.SetJobState(j.AtomID(), state.StateRunning); err != nil {
+				errFields := append([]zapcore.Field(nil), fields...)
+				errFields = append(errFields, zap.Error(err))
+				logger.Error("not running job", errFields...)
+				j.State = t.grapher.Chain.JobState(j.AtomID())
+				return
+			}
 			logger.Info("running job", fields...)
-			t.grapher.Chain.SetJobState(j.AtomID(), state.StateRunning)
-			ret := jobRunner.Run(ctx)
+			jobCtx := flowcontext.WithUpstreamOutputs(ctx, t.grapher.Chain.UpstreamOutputs(j.AtomID()))
+			input := t.grapher.Chain.JobInput(j.AtomID())
+			if input != nil {
+				jobCtx = flowcontext.WithInput(jobCtx, input)
+			}
+			ret := jobRunner.Run(jobCtx)
 			runFields := append([]zapcore.Field(nil), fields...)
 			runFields = append(runFields, zap.String("state", state.StateText[ret.AtomReturn.State]))
 			logger.Info("job done", runFields...)
 
+			// A job waiting for input is reaped like a done job: the reaper
+			// enqueues it again when its input is submitted. Its run wasn't a
+			// sequence try. Otherwise, the run consumed the input.
+			if ret.AtomReturn.State == state.StateWaitInput {
+				if t.grapher.Chain.IsSequenceStartJob(j.AtomID()) {
+					t.grapher.Chain.DecrementSequenceTries(j.AtomID(), 1)
+				}
+				t.grapher.Chain.SetJobPrompt(j.AtomID(), ret.Input.Prompt)
+				j.State = state.StateWaitInput
+				return
+			}
+			if input != nil {
+				t.grapher.Chain.SetJobInput(j.AtomID(), nil)
+			}
+
 			// We don't pass the Chain to the job runner, so it can't call this
 			// itself. Instead, it returns how many tries it did, and we set it.
 			t.grapher.Chain.IncrementJobTries(j.AtomID(), ret.Tries)
+			t.grapher.Chain.SetJobOutputs(j.AtomID(), ret.AtomReturn.Outputs)
+			// A branch job choosing a job that isn't next to it fails.
+			if err := t.grapher.Chain.SetJobBranch(j.AtomID(), ret.AtomReturn.Branch); err != nil {
+				errFields := append([]zapcore.Field(nil), fields...)
+				errFields = append(errFields, zap.Error(err))
+				logger.Error("invalid branch", errFields...)
+				ret.AtomReturn.State = state.StateFail
+			}
+			// So does a job returning a state a run can't end in.
+			if !state.JobTransitions[state.StateRunning][ret.AtomReturn.State] {
+				logger.Error("invalid job state", runFields...)
+				ret.AtomReturn.State = state.StateFail
+			}
 
 			// Set job final state because this job is about to be reaped on
 			// the doneJobChan, sent in this goroutine's defer func at top ^.
@@ -270,6 +550,51 @@ func (t *Traverser) runJobs(ctx context.Context) {
 	}
 }
 
+// waitSlot waits for a running slot of the traverser limits, then for a slot
+// of the scheduler, if any, for a job. It returns the scheduler ticket of the
+// job, how long the job waited, and false if the traverser was stopped before
+// the job got the slots; then the job holds none.
+func (t *Traverser) waitSlot(node *dag.Node, fields []zapcore.Field) (*scheduler.Ticket, time.Duration, bool) {
+	logger := t.logger.Log
+	w := t.limiter.enqueue(node.Pool, node.Priority)
+	queued := !w.granted()
+	if queued {
+		logger.Info("job waiting for slot", fields...)
+	}
+	wait, ok := t.limiter.wait(w, t.stopChan)
+	if !ok {
+		return nil, wait, false
+	}
+	var ticket *scheduler.Ticket
+	if t.scheduler != nil {
+		ticket = t.scheduler.Submit(t.namespace, t.requestPriority, node.Priority)
+		if !ticket.Granted() {
+			queued = true
+			logger.Info("job waiting for scheduler", fields...)
+		}
+		schedWait, ok := t.scheduler.Wait(ticket, t.stopChan)
+		wait += schedWait
+		if !ok {
+			t.limiter.release(node.Pool)
+			return nil, wait, false
+		}
+	}
+	if queued {
+		waitFields := append([]zapcore.Field(nil), fields...)
+		waitFields = append(waitFields, zap.Duration("wait", wait))
+		logger.Info("job got slot", waitFields...)
+	}
+	return ticket, wait, true
+}
+
+// releaseSlot gives back the slots waitSlot got for a job.
+func (t *Traverser) releaseSlot(node *dag.Node, ticket *scheduler.Ticket) {
+	if ticket != nil {
+		t.scheduler.Done(ticket)
+	}
+	t.limiter.release(node.Pool)
+}
+
 // stopRunningJobs stops all currently running jobs.
 func (t *Traverser) stopRunningJobs(ctx context.Context, timeout <-chan time.Time) error {
 	// To stop all running jobs without race conditions, we need to know:
@@ -0,0 +1,914 @@
+package traverser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/faceair/jio"
+	"github.com/longsolong/flow/pkg/execution/standalone/scheduler"
+	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/chain"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/graph"
+	"github.com/longsolong/flow/pkg/services/event"
+	"github.com/longsolong/flow/pkg/services/store"
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
+	"github.com/longsolong/flow/pkg/workflow/dag"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/longsolong/flow/pkg/workflow/step"
+	"github.com/longsolong/flow/pkg/workflow/step/builtin"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// block runs until it is released or stopped.
+type block struct {
+	step.Step
+	release chan struct{}
+	stop    chan struct{}
+}
+
+func newBlock(id string) *block {
+	b := &block{release: make(chan struct{}), stop: make(chan struct{}, 1)}
+	b.ID = id
+	return b
+}
+
+func (s *block) AtomID() atom.AtomID {
+	return atom.AtomID{Type: reflect.TypeOf(s).Elem().String(), ID: s.ID}
+}
+
+func (s *block) Create(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+func (s *block) Run(ctx context.Context) (atom.Return, error) {
+	select {
+	case <-s.release:
+		return atom.Return{State: state.StateSuccess}, nil
+	case <-s.stop:
+		return atom.Return{State: state.StateStopped}, nil
+	}
+}
+
+func (s *block) Stop(ctx context.Context) error {
+	select {
+	case s.stop <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// fn runs a func.
+type fn struct {
+	step.Step
+	run func(ctx context.Context) (atom.Return, error)
+}
+
+func newFn(id string, run func(ctx context.Context) (atom.Return, error)) *fn {
+	f := &fn{run: run}
+	f.ID = id
+	return f
+}
+
+func (s *fn) AtomID() atom.AtomID {
+	return atom.AtomID{Type: reflect.TypeOf(s).Elem().String(), ID: s.ID}
+}
+
+func (s *fn) Create(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+func (s *fn) Run(ctx context.Context) (atom.Return, error) {
+	return s.run(ctx)
+}
+
+func (s *fn) Stop(ctx context.Context) error {
+	return nil
+}
+
+type testPlotter struct {
+	graph.Plotter
+}
+
+func (p *testPlotter) Begin(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+func (p *testPlotter) Grow(ctx context.Context) {
+	p.Plotter.Close()
+}
+
+// newSequenceGrapher makes the sequence noop1 -> block2 -> noop3.
+func newSequenceGrapher(t *testing.T, b *block) *graph.Grapher {
+	ctx := context.Background()
+	req := request.NewRequest()
+	p := &testPlotter{Plotter: graph.NewPlotter("test sequence", 1)}
+	noop1, err := p.NewNode(ctx, req, builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	assert.Nil(t, err)
+	block2, err := p.NewNode(ctx, req, b, "block2", 0, time.Duration(0))
+	assert.Nil(t, err)
+	noop3, err := p.NewNode(ctx, req, builtin.NewNoop("3", ""), "noop3", 0, time.Duration(0))
+	assert.Nil(t, err)
+	assert.Nil(t, block2.SetUpstream(noop1))
+	assert.Nil(t, noop3.SetUpstream(block2))
+	for _, node := range []*dag.Node{noop1, block2, noop3} {
+		node.SequenceID = noop1.Datum.AtomID()
+	}
+	noop1.SequenceRetry = 1
+
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	go p.Grow(ctx)
+	return g
+}
+
+func waitJobState(t *testing.T, g *graph.Grapher, id atom.AtomID, s state.State) {
+	for i := 0; i < 100; i++ {
+		if g.Chain.JobState(id) == s {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s never reached state %s", id, state.StateText[s])
+}
+
+func TestSuspendResume(t *testing.T) {
+	logger := &infra.Logger{Log: zap.NewNop()}
+	b := newBlock("2")
+	g := newSequenceGrapher(t, b)
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	go tr.Run(context.Background())
+	waitJobState(t, g, b.AtomID(), state.StateRunning)
+
+	_, err := tr.Resume()
+	assert.Equal(t, ErrNotSuspended, err)
+
+	assert.Nil(t, tr.Suspend(context.Background()))
+	<-tr.Done()
+	status := tr.Status()
+	assert.Equal(t, "SUSPENDED", status.StateText)
+	// The unfinished sequence is rolled back, the job after it never ran.
+	for i, want := range []string{"UP_FOR_RETRY", "UP_FOR_RETRY", "UNKNOWN"} {
+		assert.Equal(t, want, status.Jobs[i].StateText, status.Jobs[i].Name)
+	}
+	// The interrupted sequence try is given back, the job tries are kept.
+	assert.Equal(t, uint(0), g.Chain.SequenceTries(b.AtomID()))
+	assert.Equal(t, uint(1), g.Chain.JobTries(b.AtomID()))
+
+	startedAt := status.StartedAt
+	assert.False(t, startedAt.IsZero())
+
+	resumed, err := tr.Resume()
+	assert.Nil(t, err)
+	// It is resumed only once.
+	_, err = tr.Resume()
+	assert.Equal(t, ErrNotSuspended, err)
+	var finalized []string
+	g.Chain.OnFinalize(func(c *chain.Chain) {
+		finalized = append(finalized, state.StateText[c.State()])
+	})
+	close(b.release)
+	go resumed.Run(context.Background())
+	<-resumed.Done()
+	status = resumed.Status()
+	assert.Equal(t, "SUCCESS", status.StateText)
+	assert.Equal(t, []string{"SUCCESS"}, finalized)
+	assert.Equal(t, startedAt, status.StartedAt)
+	assert.True(t, status.FinishedAt.After(startedAt))
+	for _, j := range status.Jobs {
+		assert.Equal(t, "SUCCESS", j.StateText, j.Name)
+	}
+	assert.Equal(t, uint(1), g.Chain.SequenceTries(b.AtomID()))
+	assert.Equal(t, uint(2), g.Chain.JobTries(b.AtomID()))
+}
+
+func TestStop(t *testing.T) {
+	logger := &infra.Logger{Log: zap.NewNop()}
+	b := newBlock("2")
+	g := newSequenceGrapher(t, b)
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	go tr.Run(context.Background())
+	waitJobState(t, g, b.AtomID(), state.StateRunning)
+
+	assert.Nil(t, tr.Stop(context.Background()))
+	<-tr.Done()
+	status := tr.Status()
+	assert.Equal(t, "STOPPED", status.StateText)
+	assert.False(t, status.FinishedAt.IsZero())
+	// The stopped reaper records the final state of the running job.
+	for i, want := range []string{"SUCCESS", "STOPPED", "UNKNOWN"} {
+		assert.Equal(t, want, status.Jobs[i].StateText, status.Jobs[i].Name)
+	}
+	_, err := tr.Resume()
+	assert.Equal(t, ErrNotSuspended, err)
+}
+
+// gateStore holds the first transition of a job to RUNNING until released.
+type gateStore struct {
+	store.Store
+	id      atom.AtomID
+	once    *sync.Once
+	reached chan struct{}
+	release chan struct{}
+}
+
+func (s gateStore) AppendTransition(t store.Transition) (store.Transition, error) {
+	if t.Kind == store.JobStateTransition && t.AtomID == s.id && t.State == state.StateRunning {
+		s.once.Do(func() {
+			close(s.reached)
+			<-s.release
+		})
+	}
+	return s.Store.AppendTransition(t)
+}
+
+func TestSuspendBeforeFirstTry(t *testing.T) {
+	logger := &infra.Logger{Log: zap.NewNop()}
+	b := newBlock("2")
+	g := newSequenceGrapher(t, b)
+	s := gateStore{Store: store.NewMemory(), id: b.AtomID(), once: &sync.Once{}, reached: make(chan struct{}), release: make(chan struct{})}
+	assert.Nil(t, g.Chain.Persist(s, store.Run{RequestUUID: "a"}, nil))
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	go tr.Run(context.Background())
+
+	// The job is set RUNNING, but stopped before its first try.
+	<-s.reached
+	suspended := make(chan error)
+	go func() { suspended <- tr.Suspend(context.Background()) }()
+	time.Sleep(100 * time.Millisecond)
+	close(s.release)
+	assert.Nil(t, <-suspended)
+	<-tr.Done()
+
+	// It is rolled back like a stopped job, not failed.
+	status := tr.Status()
+	assert.Equal(t, "SUSPENDED", status.StateText)
+	for i, want := range []string{"UP_FOR_RETRY", "UP_FOR_RETRY", "UNKNOWN"} {
+		assert.Equal(t, want, status.Jobs[i].StateText, status.Jobs[i].Name)
+	}
+	for _, tr := range g.Chain.JobHistory(b.AtomID()) {
+		assert.NotEqual(t, state.StateFail, tr.To)
+	}
+	assert.Equal(t, uint(0), g.Chain.SequenceTries(b.AtomID()))
+	assert.Equal(t, uint(0), g.Chain.JobTries(b.AtomID()))
+}
+
+func TestTimeout(t *testing.T) {
+	logger := &infra.Logger{Log: zap.NewNop()}
+
+	// A timed out job is retried like a failed one, here with its sequence.
+	b := newBlock("2")
+	g := newSequenceGrapher(t, b)
+	g.DAG.MustGetNode(b.AtomID()).Timeout = 20 * time.Millisecond
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	tr.Run(context.Background())
+	status := tr.Status()
+	assert.Equal(t, "FAIL", status.StateText)
+	for i, want := range []string{"SUCCESS", "TIMEOUT", "UNKNOWN"} {
+		assert.Equal(t, want, status.Jobs[i].StateText, status.Jobs[i].Name)
+	}
+	assert.Equal(t, uint(2), status.Jobs[1].Tries)
+
+	// Past the chain deadline, no job runs anymore: the sequence retry times
+	// out before noop1 runs again.
+	b = newBlock("2")
+	g = newSequenceGrapher(t, b)
+	g.DAG.Timeout = 20 * time.Millisecond
+	tr = NewTraverser(g, logger, time.Second, time.Second)
+	tr.Run(context.Background())
+	status = tr.Status()
+	assert.Equal(t, "FAIL", status.StateText)
+	assert.Equal(t, "TIMEOUT", status.Jobs[0].StateText)
+	assert.Equal(t, uint(1), status.Jobs[0].Tries)
+	assert.Equal(t, uint(1), status.Jobs[1].Tries)
+	assert.False(t, g.Chain.Deadline().IsZero())
+}
+
+func TestOutputs(t *testing.T) {
+	ctx := context.Background()
+	logger := &infra.Logger{Log: zap.NewNop()}
+	req := request.NewRequest()
+	p := &testPlotter{Plotter: graph.NewPlotter("test outputs", 1)}
+	produce := newFn("produce", func(ctx context.Context) (atom.Return, error) {
+		ret := atom.Return{State: state.StateSuccess, Outputs: atom.Outputs{}}
+		return ret, ret.Outputs.Set("n", 21)
+	})
+	consume := newFn("consume", func(ctx context.Context) (atom.Return, error) {
+		var n int
+		if err := flowcontext.UpstreamOutput(ctx, produce.AtomID(), "n", &n); err != nil {
+			return atom.Return{State: state.StateFail}, err
+		}
+		if err := flowcontext.UpstreamOutput(ctx, produce.AtomID(), "missing", &n); err != atom.ErrNoOutput {
+			return atom.Return{State: state.StateFail}, err
+		}
+		ret := atom.Return{State: state.StateSuccess, Outputs: atom.Outputs{}}
+		return ret, ret.Outputs.Set("double", 2*n)
+	})
+	produceNode, err := p.NewNode(ctx, req, produce, "produce", 0, time.Duration(0))
+	assert.Nil(t, err)
+	consumeNode, err := p.NewNode(ctx, req, consume, "consume", 0, time.Duration(0))
+	assert.Nil(t, err)
+	assert.Nil(t, consumeNode.SetUpstream(produceNode))
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	go p.Grow(ctx)
+
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	tr.Run(ctx)
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+	var double int
+	assert.Nil(t, g.Chain.JobOutputs(consume.AtomID()).Get("double", &double))
+	assert.Equal(t, 42, double)
+	status := tr.Status()
+	assert.Equal(t, `42`, string(status.Jobs[1].Outputs["double"]))
+}
+
+// newTriggerGrapher makes {a, b} -> c -> d, where a and b succeed or fail, c
+// has the trigger rule and d always runs.
+func newTriggerGrapher(t *testing.T, rule dag.TriggerRule, aSucceeds, bSucceeds bool) *graph.Grapher {
+	ctx := context.Background()
+	req := request.NewRequest()
+	p := &testPlotter{Plotter: graph.NewPlotter("test trigger", 1)}
+	result := func(success bool) func(ctx context.Context) (atom.Return, error) {
+		return func(ctx context.Context) (atom.Return, error) {
+			if success {
+				return atom.Return{State: state.StateSuccess}, nil
+			}
+			return atom.Return{State: state.StateFail}, nil
+		}
+	}
+	var nodes []*dag.Node
+	for _, f := range []*fn{
+		newFn("a", result(aSucceeds)),
+		newFn("b", result(bSucceeds)),
+		newFn("c", result(true)),
+		newFn("d", result(true)),
+	} {
+		node, err := p.NewNode(ctx, req, f, f.ID, 0, time.Duration(0))
+		assert.Nil(t, err)
+		nodes = append(nodes, node)
+	}
+	assert.Nil(t, nodes[2].SetUpstream(nodes[0]))
+	assert.Nil(t, nodes[2].SetUpstream(nodes[1]))
+	assert.Nil(t, nodes[3].SetUpstream(nodes[2]))
+	nodes[2].TriggerRule = rule
+	nodes[3].TriggerRule = dag.TriggerAlways
+
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	go p.Grow(ctx)
+	return g
+}
+
+func TestTriggerRules(t *testing.T) {
+	logger := &infra.Logger{Log: zap.NewNop()}
+	tests := []struct {
+		rule       dag.TriggerRule
+		aSucceeds  bool
+		bSucceeds  bool
+		cState     string
+		chainState string
+	}{
+		{dag.TriggerAllSuccess, true, true, "SUCCESS", "SUCCESS"},
+		{dag.TriggerAllSuccess, true, false, "UNKNOWN", "FAIL"},
+		{dag.TriggerAllDone, true, false, "SUCCESS", "FAIL"},
+		{dag.TriggerOneSuccess, true, false, "SUCCESS", "FAIL"},
+		{dag.TriggerOneSuccess, false, false, "UNKNOWN", "FAIL"},
+		{dag.TriggerOneFailed, true, false, "SUCCESS", "FAIL"},
+		{dag.TriggerOneFailed, true, true, "IGNORED", "SUCCESS"},
+		{dag.TriggerNoneFailed, true, true, "SUCCESS", "SUCCESS"},
+		{dag.TriggerNoneFailed, true, false, "UNKNOWN", "FAIL"},
+		{dag.TriggerAlways, false, false, "SUCCESS", "FAIL"},
+	}
+	for _, tt := range tests {
+		g := newTriggerGrapher(t, tt.rule, tt.aSucceeds, tt.bSucceeds)
+		tr := NewTraverser(g, logger, time.Second, time.Second)
+		tr.Run(context.Background())
+		status := tr.Status()
+		msg := fmt.Sprintf("%s a=%t b=%t", tt.rule, tt.aSucceeds, tt.bSucceeds)
+		assert.Equal(t, tt.chainState, status.StateText, msg)
+		assert.Equal(t, tt.cState, status.Jobs[2].StateText, msg)
+		// d always runs once the jobs before it are done or never will be.
+		assert.Equal(t, "SUCCESS", status.Jobs[3].StateText, msg)
+	}
+}
+
+// newBranchGrapher makes branch -> {x, y}, x -> z, y -> w, {z, w} -> join,
+// where branch chooses the given jobs.
+func newBranchGrapher(t *testing.T, choose func(nodes map[string]*dag.Node) []atom.AtomID) (*graph.Grapher, map[string]*dag.Node) {
+	ctx := context.Background()
+	req := request.NewRequest()
+	p := &testPlotter{Plotter: graph.NewPlotter("test branch", 1)}
+	nodes := map[string]*dag.Node{}
+	branch := builtin.NewBranch("branch", "", func(ctx context.Context) ([]atom.AtomID, error) {
+		return choose(nodes), nil
+	})
+	node, err := p.NewNode(ctx, req, branch, "branch", 0, time.Duration(0))
+	assert.Nil(t, err)
+	nodes["branch"] = node
+	for _, id := range []string{"x", "y", "z", "w", "join"} {
+		node, err := p.NewNode(ctx, req, builtin.NewNoop(id, ""), id, 0, time.Duration(0))
+		assert.Nil(t, err)
+		nodes[id] = node
+	}
+	for _, e := range [][2]string{{"branch", "x"}, {"branch", "y"}, {"x", "z"}, {"y", "w"}, {"z", "join"}, {"w", "join"}} {
+		assert.Nil(t, nodes[e[1]].SetUpstream(nodes[e[0]]))
+	}
+
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	go p.Grow(ctx)
+	return g, nodes
+}
+
+func TestBranch(t *testing.T) {
+	logger := &infra.Logger{Log: zap.NewNop()}
+	g, nodes := newBranchGrapher(t, func(nodes map[string]*dag.Node) []atom.AtomID {
+		return []atom.AtomID{nodes["x"].Datum.AtomID()}
+	})
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	tr.Run(context.Background())
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+	for id, want := range map[string]state.State{
+		"branch": state.StateSuccess,
+		"x":      state.StateSuccess,
+		"z":      state.StateSuccess,
+		"y":      state.StateIgnored,
+		"w":      state.StateIgnored,
+		"join":   state.StateSuccess, // reachable through x
+	} {
+		assert.Equal(t, state.StateText[want], state.StateText[g.Chain.JobState(nodes[id].Datum.AtomID())], id)
+	}
+	// The choice is in the status.
+	status := tr.Status()
+	assert.Equal(t, "branch", status.Jobs[0].Name)
+	assert.Equal(t, []atom.AtomID{nodes["x"].Datum.AtomID()}, status.Jobs[0].Branch)
+
+	// Choosing nothing ignores every job after the branch.
+	g, nodes = newBranchGrapher(t, func(nodes map[string]*dag.Node) []atom.AtomID {
+		return nil
+	})
+	tr = NewTraverser(g, logger, time.Second, time.Second)
+	tr.Run(context.Background())
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+	for _, id := range []string{"x", "y", "z", "w", "join"} {
+		assert.Equal(t, "IGNORED", state.StateText[g.Chain.JobState(nodes[id].Datum.AtomID())], id)
+	}
+
+	// Choosing a job that isn't next to the branch fails it.
+	g, nodes = newBranchGrapher(t, func(nodes map[string]*dag.Node) []atom.AtomID {
+		return []atom.AtomID{nodes["join"].Datum.AtomID()}
+	})
+	tr = NewTraverser(g, logger, time.Second, time.Second)
+	tr.Run(context.Background())
+	assert.Equal(t, state.StateFail, g.Chain.State())
+	assert.Equal(t, state.StateFail, g.Chain.JobState(nodes["branch"].Datum.AtomID()))
+	assert.Nil(t, g.Chain.JobBranch(nodes["branch"].Datum.AtomID()))
+}
+
+// growPlotter expands copies of a noop between block and end while block
+// runs, then closes.
+type growPlotter struct {
+	graph.Plotter
+	t     *testing.T
+	g     *graph.Grapher
+	block *block
+	end   atom.AtomID
+}
+
+func (p *growPlotter) Begin(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+func (p *growPlotter) Grow(ctx context.Context) {
+	defer p.Plotter.Close()
+	waitJobState(p.t, p.g, p.block.AtomID(), state.StateRunning)
+	tmpl := graph.Template{
+		Name: "noop",
+		Nodes: []graph.TemplateNode{{
+			Name: "noop",
+			New: func(i int, expansionDigest string) atom.Atom {
+				return builtin.NewNoop("copy", expansionDigest)
+			},
+		}},
+	}
+	_, err := p.Expand(ctx, p.g.Req, tmpl, 2, []atom.AtomID{p.block.AtomID()}, []atom.AtomID{p.end})
+	assert.Nil(p.t, err)
+	close(p.block.release)
+}
+
+func TestExpandWhileRunning(t *testing.T) {
+	bus := event.NewBus()
+	sub := bus.Subscribe(event.Filter{Kinds: []event.Kind{event.GraphGrown}}, 10)
+	defer sub.Close()
+	ctx := context.Background()
+	logger := &infra.Logger{Log: zap.NewNop()}
+	req := request.NewRequestWithContext(flowcontext.WithEvents(ctx, bus))
+	b := newBlock("block")
+	p := &growPlotter{Plotter: graph.NewPlotter("test grow", 1), t: t, block: b}
+	blockNode, err := p.NewNode(ctx, req, b, "block", 0, time.Duration(0))
+	assert.Nil(t, err)
+	endNode, err := p.NewNode(ctx, req, builtin.NewNoop("end", ""), "end", 0, time.Duration(0))
+	assert.Nil(t, err)
+	assert.Nil(t, endNode.SetUpstream(blockNode))
+	p.end = endNode.Datum.AtomID()
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	p.g = g
+
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	go p.Grow(ctx)
+	tr.Run(ctx)
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+	status := tr.Status()
+	assert.Len(t, status.Jobs, 4)
+	for _, j := range status.Jobs {
+		assert.Equal(t, "SUCCESS", j.StateText, j.Name)
+	}
+	// end ran after the copies.
+	end := status.Jobs[3]
+	assert.Equal(t, "end", end.Name)
+	for _, j := range status.Jobs[1:3] {
+		assert.Equal(t, "noop", j.Name)
+		assert.False(t, end.StartedAt.Before(j.FinishedAt))
+	}
+	if assert.Len(t, sub.Events(), 1) {
+		assert.Equal(t, 2, (<-sub.Events()).Jobs)
+	}
+}
+
+// batchPlotter grows a chain of noops after start, one batch per noop,
+// while the jobs before run and complete.
+type batchPlotter struct {
+	graph.Plotter
+	t     *testing.T
+	req   *request.Request
+	start *dag.Node
+	n     int
+}
+
+func (p *batchPlotter) Begin(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+func (p *batchPlotter) Grow(ctx context.Context) {
+	defer p.Plotter.Close()
+	prev := p.start
+	for i := 0; i < p.n; i++ {
+		b := p.NewBatch()
+		node, err := b.NewNode(ctx, p.req, builtin.NewNoop(fmt.Sprintf("grown%d", i), ""), "grown", 0, time.Duration(0))
+		assert.Nil(p.t, err)
+		b.SetUpstream(node, prev)
+		// Every other node also runs after start, which already completed.
+		if i%2 == 1 {
+			b.SetUpstream(node, p.start)
+		}
+		assert.Nil(p.t, b.Commit())
+		prev = node
+	}
+}
+
+func TestGrowWhileRunning(t *testing.T) {
+	ctx := context.Background()
+	logger := &infra.Logger{Log: zap.NewNop()}
+	req := request.NewRequest()
+	p := &batchPlotter{Plotter: graph.NewPlotter("test batches", 1), t: t, req: req, n: 50}
+	var err error
+	p.start, err = p.NewNode(ctx, req, builtin.NewNoop("start", ""), "start", 0, time.Duration(0))
+	assert.Nil(t, err)
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	go p.Grow(ctx)
+	// Read the chain while it grows.
+	go func() {
+		for {
+			select {
+			case <-tr.Done():
+				return
+			default:
+				tr.Status()
+				g.DAG.TopologicalSort()
+				for range p.start.Downstream() {
+				}
+			}
+		}
+	}()
+	tr.Run(ctx)
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+	status := tr.Status()
+	assert.Len(t, status.Jobs, p.n+1)
+	for _, j := range status.Jobs {
+		assert.Equal(t, "SUCCESS", j.StateText, j.Name)
+		assert.Equal(t, uint(1), j.Tries, j.Name)
+	}
+}
+
+// tracker counts the jobs running at once, in total and per pool.
+type tracker struct {
+	mux        sync.Mutex
+	running    map[string]int
+	maxRunning map[string]int
+}
+
+func newTracker() *tracker {
+	return &tracker{running: map[string]int{}, maxRunning: map[string]int{}}
+}
+
+func (tk *tracker) run(pool string) func(ctx context.Context) (atom.Return, error) {
+	return func(ctx context.Context) (atom.Return, error) {
+		tk.mux.Lock()
+		for _, k := range []string{"", pool} {
+			tk.running[k]++
+			if tk.running[k] > tk.maxRunning[k] {
+				tk.maxRunning[k] = tk.running[k]
+			}
+		}
+		tk.mux.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		tk.mux.Lock()
+		tk.running[""]--
+		tk.running[pool]--
+		tk.mux.Unlock()
+		return atom.Return{State: state.StateSuccess}, nil
+	}
+}
+
+// newFanOutGrapher makes start -> {db0, api1, db2, ...}: n jobs, every other
+// one in pool "db", the others in pool "api".
+func newFanOutGrapher(t *testing.T, n int, tk *tracker) *graph.Grapher {
+	ctx := context.Background()
+	req := request.NewRequest()
+	p := &testPlotter{Plotter: graph.NewPlotter("test fan out", 1)}
+	start, err := p.NewNode(ctx, req, builtin.NewNoop("start", ""), "start", 0, time.Duration(0))
+	assert.Nil(t, err)
+	for i := 0; i < n; i++ {
+		pool := "api"
+		if i%2 == 0 {
+			pool = "db"
+		}
+		id := fmt.Sprintf("%s%d", pool, i)
+		node, err := p.NewNode(ctx, req, newFn(id, tk.run(pool)), id, 0, time.Duration(0))
+		assert.Nil(t, err)
+		assert.Nil(t, node.SetUpstream(start))
+		node.Pool = pool
+	}
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	go p.Grow(ctx)
+	return g
+}
+
+func TestLimits(t *testing.T) {
+	logger := &infra.Logger{Log: zap.NewNop()}
+	tk := newTracker()
+	g := newFanOutGrapher(t, 8, tk)
+
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	tr.SetLimits(Limits{MaxParallel: 3, Pools: map[string]int{"db": 1}})
+	tr.Run(context.Background())
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+	assert.Equal(t, 3, tk.maxRunning[""])
+	assert.Equal(t, 1, tk.maxRunning["db"])
+	var waited int
+	for _, j := range tr.Status().Jobs {
+		if j.WaitTime >= 10*time.Millisecond {
+			waited++
+		}
+	}
+	assert.True(t, waited >= 5, "waited %d", waited)
+}
+
+func TestScheduler(t *testing.T) {
+	logger := &infra.Logger{Log: zap.NewNop()}
+	tk := newTracker()
+	s := scheduler.New(2, nil)
+	var wg sync.WaitGroup
+	var graphers []*graph.Grapher
+	for _, ns := range []string{"backfill", "interactive"} {
+		g := newFanOutGrapher(t, 4, tk)
+		graphers = append(graphers, g)
+		tr := NewTraverser(g, logger, time.Second, time.Second)
+		tr.SetScheduler(s, ns)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr.Run(context.Background())
+		}()
+	}
+	wg.Wait()
+	for _, g := range graphers {
+		assert.Equal(t, state.StateSuccess, g.Chain.State())
+	}
+	assert.Equal(t, 2, tk.maxRunning[""])
+	assert.Equal(t, map[string]int{}, s.Running())
+}
+
+// confirm waits for an "ok" input, and fails if it isn't true.
+type confirm struct {
+	fn
+}
+
+func (s *confirm) AtomID() atom.AtomID {
+	return atom.AtomID{Type: reflect.TypeOf(s).Elem().String(), ID: s.ID}
+}
+
+func (s *confirm) InputRequest(ctx context.Context) *atom.InputRequest {
+	return &atom.InputRequest{
+		Prompt: "ok?",
+		Schema: jio.Object().Keys(jio.K{"ok": jio.Bool().Required()}),
+	}
+}
+
+func TestWaitInput(t *testing.T) {
+	ctx := context.Background()
+	logger := &infra.Logger{Log: zap.NewNop()}
+	req := request.NewRequest()
+	p := &testPlotter{Plotter: graph.NewPlotter("test input", 1)}
+	c := &confirm{}
+	c.ID = "confirm"
+	c.run = func(ctx context.Context) (atom.Return, error) {
+		var input struct{ OK bool }
+		if err := flowcontext.Input(ctx, &input); err != nil || !input.OK {
+			return atom.Return{State: state.StateFail}, err
+		}
+		return atom.Return{State: state.StateSuccess}, nil
+	}
+	confirmNode, err := p.NewNode(ctx, req, c, "confirm", 0, 0)
+	assert.Nil(t, err)
+	confirmNode.SequenceID = c.AtomID()
+	confirmNode.SequenceRetry = 1
+	noop, err := p.NewNode(ctx, req, builtin.NewNoop("noop", ""), "noop", 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, noop.SetUpstream(confirmNode))
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	go p.Grow(ctx)
+
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	go tr.Run(ctx)
+	waitJobState(t, g, c.AtomID(), state.StateWaitInput)
+	assert.Equal(t, "ok?", tr.Status().Jobs[0].Prompt)
+	assert.Equal(t, uint(0), g.Chain.JobTries(c.AtomID()))
+	assert.Equal(t, uint(0), g.Chain.SequenceTries(c.AtomID()))
+
+	// Only valid input of a job waiting for it is accepted.
+	err = tr.SubmitInput(ctx, atom.AtomID{Type: "unknown"}, []byte(`{"ok": true}`))
+	assert.True(t, errors.Is(err, workflow.ErrNotRegisteredNode))
+	err = tr.SubmitInput(ctx, noop.Datum.AtomID(), []byte(`{"ok": true}`))
+	assert.True(t, errors.Is(err, workflow.ErrNotWaitingInput))
+	err = tr.SubmitInput(ctx, c.AtomID(), []byte(`{"ok": "yes"}`))
+	assert.True(t, errors.Is(err, workflow.ErrInvalidInput))
+	assert.Equal(t, state.StateWaitInput, g.Chain.JobState(c.AtomID()))
+
+	// A failed run consumed its input: the sequence retry waits for new input.
+	assert.Nil(t, tr.SubmitInput(ctx, c.AtomID(), []byte(`{"ok": false}`)))
+	waitJobState(t, g, c.AtomID(), state.StateWaitInput)
+	assert.Equal(t, uint(1), g.Chain.JobTries(c.AtomID()))
+	assert.Equal(t, uint(1), g.Chain.SequenceTries(c.AtomID()))
+	assert.Nil(t, g.Chain.JobInput(c.AtomID()))
+
+	// Still waiting after suspend and resume.
+	assert.Nil(t, tr.Suspend(ctx))
+	<-tr.Done()
+	assert.Equal(t, state.StateWaitInput, g.Chain.JobState(c.AtomID()))
+	tr, err = tr.Resume()
+	assert.Nil(t, err)
+	go tr.Run(ctx)
+	waitJobState(t, g, c.AtomID(), state.StateWaitInput)
+
+	assert.Nil(t, tr.SubmitInput(ctx, c.AtomID(), []byte(`{"ok": true}`)))
+	<-tr.Done()
+	status := tr.Status()
+	assert.Equal(t, "SUCCESS", status.StateText)
+	assert.Equal(t, "", status.Jobs[0].Prompt)
+	assert.Equal(t, uint(2), status.Jobs[0].Tries)
+	assert.Equal(t, "SUCCESS", status.Jobs[1].StateText)
+}
+
+func TestMarkJob(t *testing.T) {
+	ctx := context.Background()
+	logger := &infra.Logger{Log: zap.NewNop()}
+	req := request.NewRequest()
+	p := &testPlotter{Plotter: graph.NewPlotter("test mark", 1)}
+	mux := &sync.Mutex{}
+	succeeds := false
+	a := newFn("a", func(ctx context.Context) (atom.Return, error) {
+		mux.Lock()
+		defer mux.Unlock()
+		if !succeeds {
+			return atom.Return{State: state.StateFail, Exit: 1}, nil
+		}
+		return atom.Return{State: state.StateSuccess}, nil
+	})
+	aNode, err := p.NewNode(ctx, req, a, "a", 0, 0)
+	assert.Nil(t, err)
+	b, err := p.NewNode(ctx, req, builtin.NewNoop("b", ""), "b", 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, b.SetUpstream(aNode))
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	go p.Grow(ctx)
+
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	tr.Run(ctx)
+	assert.Equal(t, "FAIL", tr.Status().StateText)
+	_, err = tr.Resume()
+	assert.Equal(t, ErrNotSuspended, err)
+
+	// Skipping the failed job lets the job after it run.
+	assert.Nil(t, g.Chain.MarkJobSkipped(a.AtomID(), "ops", "not needed"))
+	tr, err = tr.Resume()
+	assert.Nil(t, err)
+	tr.Run(ctx)
+	status := tr.Status()
+	assert.Equal(t, "SUCCESS", status.StateText)
+	assert.Equal(t, "MARK_SKIPPED", status.Jobs[0].StateText)
+	assert.Equal(t, "SUCCESS", status.Jobs[1].StateText)
+	assert.Len(t, status.Audit, 1)
+	_, err = tr.Resume()
+	assert.Equal(t, ErrNotSuspended, err)
+
+	// Retrying it with the job after it runs both again.
+	mux.Lock()
+	succeeds = true
+	mux.Unlock()
+	assert.Nil(t, g.Chain.MarkJobRetry(a.AtomID(), true, "ops", "fixed"))
+	tr, err = tr.Resume()
+	assert.Nil(t, err)
+	tr.Run(ctx)
+	status = tr.Status()
+	assert.Equal(t, "SUCCESS", status.StateText)
+	assert.Equal(t, "SUCCESS", status.Jobs[0].StateText)
+	assert.Equal(t, uint(2), status.Jobs[0].Tries)
+	assert.Equal(t, "SUCCESS", status.Jobs[1].StateText)
+	assert.Equal(t, uint(2), status.Jobs[1].Tries)
+	assert.Len(t, status.Audit, 3)
+}
+
+func TestEvents(t *testing.T) {
+	bus := event.NewBus()
+	sub := bus.Subscribe(event.Filter{}, 100)
+	defer sub.Close()
+	ctx := context.Background()
+	logger := &infra.Logger{Log: zap.NewNop()}
+	req := request.NewRequestWithContext(flowcontext.WithEvents(ctx, bus))
+	p := &testPlotter{Plotter: graph.NewPlotter("test events", 1)}
+	tries := 0
+	flaky := newFn("flaky", func(ctx context.Context) (atom.Return, error) {
+		tries++
+		if tries < 3 {
+			return atom.Return{State: state.StateFail, Error: errors.New("flaky")}, nil
+		}
+		return atom.Return{State: state.StateSuccess}, nil
+	})
+	node, err := p.NewNode(ctx, req, flaky, "flaky", 1, 0)
+	assert.Nil(t, err)
+	node.SequenceID = flaky.AtomID()
+	node.SequenceRetry = 1
+	g, err := graph.NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	go p.Grow(ctx)
+
+	tr := NewTraverser(g, logger, time.Second, time.Second)
+	tr.Run(ctx)
+	assert.Equal(t, state.StateSuccess, g.Chain.State())
+
+	var events []event.Event
+	for len(sub.Events()) > 0 {
+		events = append(events, <-sub.Events())
+	}
+	expected := []event.Event{
+		{Kind: event.ChainStarted},
+		{Kind: event.JobEnqueued, AtomID: flaky.AtomID()},
+		{Kind: event.JobStarted, AtomID: flaky.AtomID(), Try: 1},
+		{Kind: event.JobTryFailed, AtomID: flaky.AtomID(), Try: 1, State: state.StateFail, Error: "flaky"},
+		{Kind: event.JobRetryWaiting, AtomID: flaky.AtomID(), Try: 2},
+		{Kind: event.JobStarted, AtomID: flaky.AtomID(), Try: 2},
+		{Kind: event.JobTryFailed, AtomID: flaky.AtomID(), Try: 2, State: state.StateFail, Error: "flaky"},
+		{Kind: event.JobFinished, AtomID: flaky.AtomID(), State: state.StateFail},
+		{Kind: event.SequenceRetried, AtomID: flaky.AtomID()},
+		{Kind: event.JobEnqueued, AtomID: flaky.AtomID()},
+		{Kind: event.JobStarted, AtomID: flaky.AtomID(), Try: 3},
+		{Kind: event.JobFinished, AtomID: flaky.AtomID(), State: state.StateSuccess},
+		{Kind: event.ChainFinished, State: state.StateSuccess},
+	}
+	if assert.Len(t, events, len(expected)) {
+		for i, e := range events {
+			assert.Equal(t, uint64(i+1), e.Seq)
+			assert.Equal(t, req.RequestUUID.String(), e.RequestUUID)
+			assert.False(t, e.At.IsZero())
+			e.Seq, e.RequestUUID, e.At = 0, "", time.Time{}
+			assert.Equal(t, expected[i], e)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/longsolong/flow/pkg/services/event"
+	"go.uber.org/zap"
+)
+
+const (
+	// EventsBuffer is how many events a stream buffers for a client reading
+	// them slower than they are published.
+	EventsBuffer = 256
+
+	// EventsHeartbeat is how often a stream with no events sends a comment,
+	// so proxies don't close it as idle.
+	EventsHeartbeat = 15 * time.Second
+
+	// EventsRetry is how long clients wait to reconnect once a stream ends.
+	EventsRetry = time.Second
+
+	// EventsReset is the type of the event a stream starts with when it
+	// can't replay every event after Last-Event-ID: the client missed some,
+	// and should get the Status of the flow again.
+	EventsReset = "reset"
+)
+
+// Events streams the events of a flow started by Run as Server-Sent Events:
+// the id of each is its event Seq, its type its Kind and its data the event
+// in json. A client reconnecting with the Last-Event-ID header first gets the
+// events it missed. If the server no longer keeps them all, see event.History,
+// it gets an EventsReset event first, then the ones kept.
+//
+// The stream ends once the event.ChainFinished of the flow is sent, and a
+// client resuming after it, when the flow is done, gets No Content, which
+// tells EventSource clients not to reconnect again.
+//
+// A server WriteTimeout cuts off responses that last longer, so the stream
+// ends a little before it, and EventSource clients reconnect by themselves.
+// It also ends once a client falls so far behind that events were dropped,
+// for it to resume after the last event it got.
+func (h SingleProcessorFlowHandler) Events() http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		requestID := chi.URLParam(r, "requestID")
+		t := h.traversers.Get(requestID)
+		if t == nil {
+			writeError(w, http.StatusNotFound, "unknown request id")
+			return
+		}
+		if h.events == nil {
+			writeError(w, http.StatusServiceUnavailable, "events are not published")
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, http.StatusInternalServerError, "streaming is not supported")
+			return
+		}
+		var after uint64
+		if lastID := r.Header.Get("Last-Event-ID"); lastID != "" {
+			var err error
+			if after, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid Last-Event-ID")
+				return
+			}
+		}
+
+		sub := h.events.SubscribeAfter(event.Filter{RequestUUID: requestID}, EventsBuffer, after)
+		defer sub.Close()
+		select {
+		case <-t.Done():
+			// Every event of the flow is published: none is coming.
+			if len(sub.Events()) == 0 {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		default:
+		}
+
+		var end <-chan time.Time
+		if d := streamDuration(r); d > 0 {
+			timer := time.NewTimer(d)
+			defer timer.Stop()
+			end = timer.C
+		}
+		heartbeat := time.NewTicker(EventsHeartbeat)
+		defer heartbeat.Stop()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", EventsRetry/time.Millisecond)
+		if sub.Incomplete() {
+			fmt.Fprintf(w, "event: %s\ndata: {}\n\n", EventsReset)
+		}
+		flusher.Flush()
+		for {
+			select {
+			case e := <-sub.Events():
+				if err := writeEvent(w, e); err != nil {
+					h.logger.Log.Warn("writing event failed", zap.String("request_id", requestID), zap.Error(err))
+					return
+				}
+				flusher.Flush()
+				if e.Kind == event.ChainFinished && len(sub.Events()) == 0 {
+					return
+				}
+				if sub.Dropped() > 0 && len(sub.Events()) == 0 {
+					return
+				}
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-end:
+				return
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+	return fn
+}
+
+// writeEvent writes e as a Server-Sent Event.
+func writeEvent(w http.ResponseWriter, e event.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Kind, data)
+	return err
+}
+
+// streamDuration returns how long a response can stream before the
+// WriteTimeout of the server cuts it off, 0 if it has none.
+func streamDuration(r *http.Request) time.Duration {
+	srv, ok := r.Context().Value(http.ServerContextKey).(*http.Server)
+	if !ok || srv.WriteTimeout <= 0 {
+		return 0
+	}
+	margin := srv.WriteTimeout / 10
+	if margin > time.Second {
+		margin = time.Second
+	}
+	return srv.WriteTimeout - margin
+}
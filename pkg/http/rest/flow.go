@@ -2,10 +2,14 @@ package rest
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"github.com/go-chi/valve"
-	"github.com/longsolong/flow/dev/workflows/pipeline"
-	"github.com/longsolong/flow/dev/workflows/standalone"
+	"github.com/longsolong/flow/pkg/execution/standalone/traverser"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/chain"
+	"github.com/longsolong/flow/pkg/registry"
+	"github.com/longsolong/flow/pkg/services/event"
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
 	"io/ioutil"
 	"net/http"
 
@@ -15,11 +19,20 @@ import (
 	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
 )
 
-// NewFlowHandler add route for flow
-func (h *Handler) NewFlowHandler(logger *infra.Logger) {
-	singleProcessorFlowHandler := SingleProcessorFlowHandler{logger: logger}
+// NewFlowHandler add route for flow. The flows it runs publish their events to
+// events.
+func (h *Handler) NewFlowHandler(logger *infra.Logger, traversers traverser.Repo, events *event.Bus) {
+	singleProcessorFlowHandler := SingleProcessorFlowHandler{logger: logger, traversers: traversers, events: events}
 	h.router.Route("/api/standalone/flows", func(r chi.Router) {
 		r.With(jio.ValidateBody(RunFlowValidator, jio.DefaultErrorHandler)).Post("/run", singleProcessorFlowHandler.Run())
+		r.Get("/{requestID}", singleProcessorFlowHandler.Status())
+		r.Get("/{requestID}/events", singleProcessorFlowHandler.Events())
+		r.Post("/{requestID}/stop", singleProcessorFlowHandler.Stop())
+		r.Post("/{requestID}/suspend", singleProcessorFlowHandler.Suspend())
+		r.Post("/{requestID}/resume", singleProcessorFlowHandler.Resume())
+		r.Post("/{requestID}/jobs/{atomID}/input", singleProcessorFlowHandler.Input())
+		r.Post("/{requestID}/jobs/{atomID}/skip", singleProcessorFlowHandler.MarkSkipped())
+		r.Post("/{requestID}/jobs/{atomID}/retry", singleProcessorFlowHandler.MarkRetry())
 	})
 	pipelineFlowHandler := PipelineFlowHandler{logger: logger}
 	h.router.Route("/api/pipeline/flows", func(r chi.Router) {
@@ -38,12 +51,28 @@ var RunFlowValidator = jio.Object().Keys(jio.K{
 	"requestTags": jio.Array().Required(),
 })
 
+// MarkJobValidator validates the body of the operator actions on a job: who
+// does it and why. downstream is only read to mark a job for retry.
+var MarkJobValidator = jio.Object().Keys(jio.K{
+	"operator":   jio.String().Min(1).Required(),
+	"reason":     jio.String(),
+	"downstream": jio.Bool(),
+})
+
 // SingleProcessorFlowHandler ...
 type SingleProcessorFlowHandler struct {
-	logger   *infra.Logger
+	logger     *infra.Logger
+	traversers traverser.Repo // server-wide, keyed on request UUID
+	events     *event.Bus     // server-wide
 }
 
-// Run ...
+// RunFlowResponse ...
+type RunFlowResponse struct {
+	RequestUUID string
+}
+
+// Run starts the flow in the background and responds 202 Accepted with the
+// request UUID to follow it with Status.
 func (h SingleProcessorFlowHandler) Run() http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
@@ -56,32 +85,231 @@ func (h SingleProcessorFlowHandler) Run() http.HandlerFunc {
 			jio.DefaultErrorHandler(w, r, err)
 			return
 		}
-		valv := valve.New()
-		baseCtx := valv.Context()
-		r = r.WithContext(baseCtx)
 		namespace := data["primaryRequestArgs"].(map[string]interface{})["namespace"]
 		name := data["primaryRequestArgs"].(map[string]interface{})["name"]
 		version := data["primaryRequestArgs"].(map[string]interface{})["version"]
-		grapher, err := standalone.SingleProcessorFactory.Make(
-			context.WithValue(r.Context(), flowcontext.LoggerCtxKey, h.logger),
+		t, err := registry.SingleProcessorFactory.Start(h.runContext(),
 			h.logger, namespace.(string), name.(string), int(version.(float64)), body)
 		if err != nil {
 			jio.DefaultErrorHandler(w, r, err)
 			return
 		}
-		b, err := json.Marshal(grapher.Chain.AllJobs())
+		requestID := t.Grapher().Req.RequestUUID.String()
+		h.traversers.Set(requestID, t)
+		writeJSON(w, http.StatusAccepted, RunFlowResponse{RequestUUID: requestID})
+	}
+	return fn
+}
+
+// Status responds with the state of the chain of a flow started by Run, and
+// the state, tries and timestamps of each of its jobs.
+func (h SingleProcessorFlowHandler) Status() http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		t := h.traversers.Get(chi.URLParam(r, "requestID"))
+		if t == nil {
+			writeError(w, http.StatusNotFound, "unknown request id")
+			return
+		}
+		writeJSON(w, http.StatusOK, t.Status())
+	}
+	return fn
+}
+
+// Stop stops a running flow and all of its running jobs.
+func (h SingleProcessorFlowHandler) Stop() http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		t := h.runningTraverser(w, r)
+		if t == nil {
+			return
+		}
+		if err := t.Stop(r.Context()); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, t.Status())
+	}
+	return fn
+}
+
+// Suspend stops a running flow and all of its running jobs, leaving the jobs
+// that did not finish up for retry so the flow can be resumed.
+func (h SingleProcessorFlowHandler) Suspend() http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		t := h.runningTraverser(w, r)
+		if t == nil {
+			return
+		}
+		if err := t.Suspend(r.Context()); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, t.Status())
+	}
+	return fn
+}
+
+// Resume continues running a suspended flow in the background.
+func (h SingleProcessorFlowHandler) Resume() http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		requestID := chi.URLParam(r, "requestID")
+		suspended := h.traversers.Get(requestID)
+		if suspended == nil {
+			writeError(w, http.StatusNotFound, "unknown request id")
+			return
+		}
+		t, err := suspended.Resume()
 		if err != nil {
-			jio.DefaultErrorHandler(w, r, err)
+			writeError(w, http.StatusConflict, err.Error())
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(b)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		return
+		h.traversers.Set(requestID, t)
+		go t.Run(h.runContext())
+		writeJSON(w, http.StatusAccepted, RunFlowResponse{RequestUUID: requestID})
 	}
 	return fn
 }
 
+// Input submits the input of a job waiting for it, see atom.InputRequester.
+// The job is given by the atom.AtomID Key in the url, and the body is the json
+// object validated by the schema of its input request. It responds 202
+// Accepted with the status of the flow once the job is enqueued to run with
+// the input.
+func (h SingleProcessorFlowHandler) Input() http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		t := h.runningTraverser(w, r)
+		if t == nil {
+			return
+		}
+		atomID, err := atom.ParseAtomID(chi.URLParam(r, "atomID"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := t.SubmitInput(r.Context(), atomID, body); err != nil {
+			switch {
+			case errors.Is(err, workflow.ErrNotRegisteredNode):
+				writeError(w, http.StatusNotFound, err.Error())
+			case errors.Is(err, workflow.ErrNotWaitingInput):
+				writeError(w, http.StatusConflict, err.Error())
+			case errors.Is(err, workflow.ErrInvalidInput):
+				writeError(w, http.StatusBadRequest, err.Error())
+			default:
+				writeError(w, http.StatusInternalServerError, err.Error())
+			}
+			return
+		}
+		writeJSON(w, http.StatusAccepted, t.Status())
+	}
+	return fn
+}
+
+// MarkSkipped marks a failed job of a flow skipped, so its next jobs run as if
+// it succeeded. The job is given by the atom.AtomID Key in the url. A flow
+// that is done runs again; a suspended one runs the next jobs once resumed.
+// It responds 202 Accepted with the status of the flow.
+func (h SingleProcessorFlowHandler) MarkSkipped() http.HandlerFunc {
+	return h.mark(func(c *chain.Chain, atomID atom.AtomID, data map[string]interface{}) error {
+		reason, _ := data["reason"].(string)
+		return c.MarkJobSkipped(atomID, data["operator"].(string), reason)
+	})
+}
+
+// MarkRetry marks a failed, stopped or skipped job of a flow to run again,
+// with the jobs after it if "downstream" is true. It runs the flow like MarkSkipped.
+func (h SingleProcessorFlowHandler) MarkRetry() http.HandlerFunc {
+	return h.mark(func(c *chain.Chain, atomID atom.AtomID, data map[string]interface{}) error {
+		reason, _ := data["reason"].(string)
+		downstream, _ := data["downstream"].(bool)
+		return c.MarkJobRetry(atomID, downstream, data["operator"].(string), reason)
+	})
+}
+
+// mark returns the handler of an operator action on a job, done by markJob
+// with the validated body.
+func (h SingleProcessorFlowHandler) mark(markJob func(c *chain.Chain, atomID atom.AtomID, data map[string]interface{}) error) http.HandlerFunc {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		requestID := chi.URLParam(r, "requestID")
+		t := h.traversers.Get(requestID)
+		if t == nil {
+			writeError(w, http.StatusNotFound, "unknown request id")
+			return
+		}
+		atomID, err := atom.ParseAtomID(chi.URLParam(r, "atomID"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		data, err := jio.ValidateJSON(&body, MarkJobValidator)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := markJob(t.Grapher().Chain, atomID, data); err != nil {
+			switch {
+			case errors.Is(err, workflow.ErrNotRegisteredNode):
+				writeError(w, http.StatusNotFound, err.Error())
+			case errors.Is(err, workflow.ErrInvalidTransition):
+				writeError(w, http.StatusConflict, err.Error())
+			default:
+				writeError(w, http.StatusBadRequest, err.Error())
+			}
+			return
+		}
+
+		// The reaper of a running flow enqueues the marked jobs, a flow that
+		// is done runs again. If the flow was finalized right after the jobs
+		// were marked, POST resume runs it again.
+		if !t.Suspended() {
+			select {
+			case <-t.Done():
+				if rerun, err := t.Resume(); err == nil {
+					h.traversers.Set(requestID, rerun)
+					go rerun.Run(h.runContext())
+					t = rerun
+				}
+			default:
+			}
+		}
+		writeJSON(w, http.StatusAccepted, t.Status())
+	}
+	return fn
+}
+
+// runningTraverser returns the traverser of the request in the url if it is
+// still running. Otherwise it writes the error response and returns nil.
+func (h SingleProcessorFlowHandler) runningTraverser(w http.ResponseWriter, r *http.Request) *traverser.Traverser {
+	t := h.traversers.Get(chi.URLParam(r, "requestID"))
+	if t == nil {
+		writeError(w, http.StatusNotFound, "unknown request id")
+		return nil
+	}
+	select {
+	case <-t.Done():
+		writeError(w, http.StatusConflict, "flow is not running")
+		return nil
+	default:
+	}
+	return t
+}
+
+// runContext returns the context to run a flow in. The flow outlives the http
+// request, so it must not run in its context.
+func (h SingleProcessorFlowHandler) runContext() context.Context {
+	valv := valve.New()
+	ctx := context.WithValue(valv.Context(), flowcontext.LoggerCtxKey, h.logger)
+	return flowcontext.WithEvents(ctx, h.events)
+}
+
 // PipelineFlowHandler ...
 type PipelineFlowHandler struct {
 	logger   *infra.Logger
@@ -106,7 +334,7 @@ func (h PipelineFlowHandler) Run() http.HandlerFunc {
 		namespace := data["primaryRequestArgs"].(map[string]interface{})["namespace"]
 		name := data["primaryRequestArgs"].(map[string]interface{})["name"]
 		version := data["primaryRequestArgs"].(map[string]interface{})["version"]
-		_, err = pipeline.PipelineFactory.Make(
+		_, err = registry.PipelineFactory.Make(
 			context.WithValue(r.Context(), flowcontext.LoggerCtxKey, h.logger),
 			h.logger, namespace.(string), name.(string), int(version.(float64)), body)
 		if err != nil {
@@ -3,12 +3,21 @@
 package rest
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/longsolong/flow/pkg/execution/standalone/traverser"
 	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/services/event"
+
+	// example workflows used by the tests
+	_ "github.com/longsolong/flow/dev/workflows/standalone"
 )
 
 func TestRunFlowHandler(t *testing.T) {
@@ -34,36 +43,445 @@ func TestRunFlowHandler(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	req.Header.Set("Content-Type", "application/json")
 
 	logger, err := infra.CreateLogger(0)
 	if err != nil {
 		t.Fatal(err)
 	}
+	handler := CreateHandler(logger)
+	events := event.NewBus()
+	sub := events.Subscribe(event.Filter{Kinds: []event.Kind{event.ChainStarted, event.JobTryFailed, event.ChainFinished}}, 100)
+	defer sub.Close()
+	handler.NewFlowHandler(logger, traverser.NewRepo(0), events)
+	router := handler.GetRouter()
 
 	// We create a ResponseRecorder (which satisfies http.ResponseWriter) to record the response.
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(SingleProcessorFlowHandler{logger: logger}.Run())
-
-	// Our handlers satisfy http.Handler, so we can call their ServeHTTP method
-	// directly and pass in our Request and ResponseRecorder.
-	handler.ServeHTTP(rr, req)
+	router.ServeHTTP(rr, req)
 
 	// Check the status code is what we expect.
-	if status := rr.Code; status != http.StatusOK {
-		t.Errorf("handler returned wrong status code: got %v want %v",
-			status, http.StatusOK)
-	}
-
-	// Check the response body is what we expect.
-	expected := `[{"Atom":{"ID":"","ExpansionDigest":"","NumberGuessParameter":{"Secret":1,"Low":1,"High":1}},"State":0,"StateText":"SUCCESS"}]`
-	if rr.Body.String() != expected {
-		t.Errorf("handler returned unexpected body: got %v want %v",
-			rr.Body.String(), expected)
+	if status := rr.Code; status != http.StatusAccepted {
+		t.Fatalf("handler returned wrong status code: got %v want %v",
+			status, http.StatusAccepted)
 	}
-
-	expected = "application/json; charset=utf-8"
+	expected := "application/json; charset=utf-8"
 	if contentType := rr.Header().Get("Content-Type"); contentType != expected {
 		t.Errorf("handler returned wrong content type header: got %v want %v",
 			contentType, expected)
 	}
+	var run RunFlowResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &run); err != nil {
+		t.Fatal(err)
+	}
+
+	// Poll the status of the run until it is done.
+	var status traverser.Status
+	for i := 0; i < 100; i++ {
+		req, err := http.NewRequest("GET", "/api/standalone/flows/"+run.RequestUUID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.FinishedAt.IsZero() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.StateText != "SUCCESS" {
+		t.Errorf("flow ended in state %s want SUCCESS", status.StateText)
+	}
+	if len(status.Jobs) != 1 || status.Jobs[0].StateText != "SUCCESS" || status.Jobs[0].Tries != 7 {
+		t.Errorf("unexpected jobs %+v", status.Jobs)
+	}
+	if status.Jobs[0].FinishedAt.Before(status.Jobs[0].StartedAt) {
+		t.Errorf("job finished before it started: %+v", status.Jobs[0])
+	}
+
+	// The flow published its events: every wrong guess failed a try.
+	var kinds []event.Kind
+	for len(kinds) == 0 || kinds[len(kinds)-1] != event.ChainFinished {
+		select {
+		case e := <-sub.Events():
+			if e.RequestUUID != run.RequestUUID {
+				t.Errorf("unexpected event %+v", e)
+			}
+			kinds = append(kinds, e.Kind)
+		case <-time.After(time.Second):
+			t.Fatalf("flow not finished after events %v", kinds)
+		}
+	}
+	if len(kinds) != 8 || kinds[0] != event.ChainStarted || kinds[1] != event.JobTryFailed || kinds[7] != event.ChainFinished {
+		t.Errorf("unexpected events %v", kinds)
+	}
+
+	// A done flow can't be stopped, suspended or resumed.
+	for _, action := range []string{"stop", "suspend", "resume"} {
+		req, err := http.NewRequest("POST", "/api/standalone/flows/"+run.RequestUUID+"/"+action, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("%s returned wrong status code: got %v want %v", action, rr.Code, http.StatusConflict)
+		}
+	}
+
+	// Unknown request ids are not found.
+	req, err = http.NewRequest("GET", "/api/standalone/flows/unknown", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
+
+func TestInputHandler(t *testing.T) {
+	logger, err := infra.CreateLogger(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := CreateHandler(logger)
+	handler.NewFlowHandler(logger, traverser.NewRepo(0), event.NewBus())
+	router := handler.GetRouter()
+	serve := func(method, uri, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, uri, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("POST", "/api/standalone/flows/run", `{
+		"primaryRequestArgs": {
+			"namespace": "examples",
+			"name": "interactive_number_guess",
+			"version": 1
+		},
+		"requestArgs": {
+			"secret": 7
+		},
+		"requestTags": []
+	}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("run returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	var run RunFlowResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &run); err != nil {
+		t.Fatal(err)
+	}
+	flow := "/api/standalone/flows/" + run.RequestUUID
+	input := flow + "/jobs/examples.InteractiveNumberGuess:guess/input"
+
+	// Poll the status of the run until the guess job waits for input.
+	var status traverser.Status
+	for i := 0; i < 100; i++ {
+		if err := json.Unmarshal(serve("GET", flow, "").Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if status.Jobs[0].StateText == "WAIT_INPUT" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.Jobs[0].Prompt != "guess the secret number between 0 and 100" {
+		t.Fatalf("unexpected job %+v", status.Jobs[0])
+	}
+
+	for _, tc := range []struct {
+		uri, body string
+		code      int
+	}{
+		{flow + "/jobs/examples.Unknown:guess/input", `{"guess": 7}`, http.StatusNotFound},
+		{flow + "/jobs/guess/input", `{"guess": 7}`, http.StatusBadRequest},
+		{input, `{"guess": "seven"}`, http.StatusBadRequest},
+		{input, `{"guess": 7}`, http.StatusAccepted},
+		{input, `{"guess": 7}`, http.StatusConflict},
+	} {
+		if rr := serve("POST", tc.uri, tc.body); rr.Code != tc.code {
+			t.Errorf("%s %s returned wrong status code: got %v want %v", tc.uri, tc.body, rr.Code, tc.code)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := json.Unmarshal(serve("GET", flow, "").Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		if !status.FinishedAt.IsZero() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status.StateText != "SUCCESS" {
+		t.Errorf("flow ended in state %s want SUCCESS", status.StateText)
+	}
+	if rr := serve("POST", input, `{"guess": 7}`); rr.Code != http.StatusConflict {
+		t.Errorf("input returned wrong status code: got %v want %v", rr.Code, http.StatusConflict)
+	}
+}
+
+func TestMarkJobHandler(t *testing.T) {
+	logger, err := infra.CreateLogger(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := CreateHandler(logger)
+	handler.NewFlowHandler(logger, traverser.NewRepo(0), event.NewBus())
+	router := handler.GetRouter()
+	serve := func(method, uri, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, uri, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("POST", "/api/standalone/flows/run", `{
+		"primaryRequestArgs": {
+			"namespace": "examples",
+			"name": "interactive_number_guess",
+			"version": 1
+		},
+		"requestArgs": {
+			"secret": 7
+		},
+		"requestTags": []
+	}`)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("run returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	var run RunFlowResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &run); err != nil {
+		t.Fatal(err)
+	}
+	flow := "/api/standalone/flows/" + run.RequestUUID
+	job := flow + "/jobs/examples.InteractiveNumberGuess:guess"
+	var status traverser.Status
+	poll := func(done func() bool) {
+		for i := 0; i < 100; i++ {
+			if err := json.Unmarshal(serve("GET", flow, "").Body.Bytes(), &status); err != nil {
+				t.Fatal(err)
+			}
+			if done() {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("unexpected flow %+v", status)
+	}
+	waitInput := func() bool { return status.Jobs[0].StateText == "WAIT_INPUT" }
+	finished := func() bool { return !status.FinishedAt.IsZero() }
+
+	// Fail the flow by guessing wrong every time.
+	for guess := 100; ; guess-- {
+		poll(func() bool { return waitInput() || finished() })
+		if finished() {
+			break
+		}
+		if rr := serve("POST", job+"/input", fmt.Sprintf(`{"guess": %d}`, guess)); rr.Code != http.StatusAccepted {
+			t.Fatalf("input returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+		}
+	}
+	if status.StateText != "FAIL" {
+		t.Fatalf("flow ended in state %s want FAIL", status.StateText)
+	}
+
+	for _, tc := range []struct {
+		uri, body string
+		code      int
+	}{
+		{flow + "/jobs/examples.Unknown:guess/retry", `{"operator": "ops"}`, http.StatusNotFound},
+		{flow + "/jobs/guess/retry", `{"operator": "ops"}`, http.StatusBadRequest},
+		{job + "/retry", `{"reason": "no operator"}`, http.StatusBadRequest},
+		{job + "/retry", `{"operator": "ops", "reason": "one more", "downstream": true}`, http.StatusAccepted},
+		{job + "/skip", `{"operator": "ops"}`, http.StatusConflict},
+	} {
+		if rr := serve("POST", tc.uri, tc.body); rr.Code != tc.code {
+			t.Errorf("%s %s returned wrong status code: got %v want %v", tc.uri, tc.body, rr.Code, tc.code)
+		}
+	}
+
+	// The flow runs again, and succeeds with the right guess.
+	poll(waitInput)
+	if rr := serve("POST", job+"/input", `{"guess": 7}`); rr.Code != http.StatusAccepted {
+		t.Fatalf("input returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	poll(finished)
+	if status.StateText != "SUCCESS" {
+		t.Errorf("flow ended in state %s want SUCCESS", status.StateText)
+	}
+	if len(status.Audit) != 1 || status.Audit[0].Operator != "ops" || status.Audit[0].Reason != "one more" {
+		t.Errorf("unexpected audit %+v", status.Audit)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	logger, err := infra.CreateLogger(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := CreateHandler(logger)
+	events := event.NewBus()
+	finished := events.Subscribe(event.Filter{Kinds: []event.Kind{event.ChainFinished}}, 1)
+	defer finished.Close()
+	traversers := traverser.NewRepo(0)
+	handler.NewFlowHandler(logger, traversers, events)
+	srv := httptest.NewUnstartedServer(handler.GetRouter())
+	srv.Config.WriteTimeout = 5 * time.Second
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/api/standalone/flows/run", "application/json", strings.NewReader(`{
+		"primaryRequestArgs": {"namespace": "examples", "name": "number_guess", "version": 1},
+		"requestArgs": {"secret": 1},
+		"requestTags": []
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var run RunFlowResponse
+	err = json.NewDecoder(resp.Body).Decode(&run)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished.Events():
+	case <-time.After(time.Second):
+		t.Fatal("flow not finished")
+	}
+	<-traversers.Get(run.RequestUUID).Done()
+
+	// stream reads the events streamed after lastID until the server ends
+	// the stream, right after the chain finished event, and whether it was
+	// reset.
+	stream := func(lastID string) ([]event.Event, bool) {
+		req, err := http.NewRequest("GET", srv.URL+"/api/standalone/flows/"+run.RequestUUID+"/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		start := time.Now()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("events returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+		}
+		if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+			t.Errorf("events returned wrong content type header: got %v", contentType)
+		}
+		var streamed []event.Event
+		var reset bool
+		var id, kind string
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				kind = strings.TrimPrefix(line, "event: ")
+			case kind == EventsReset && strings.HasPrefix(line, "data: "):
+				if len(streamed) > 0 {
+					t.Errorf("stream reset after events %+v", streamed)
+				}
+				reset = true
+				kind = ""
+			case strings.HasPrefix(line, "data: "):
+				var e event.Event
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+					t.Fatal(err)
+				}
+				if fmt.Sprint(e.Seq) != id || string(e.Kind) != kind {
+					t.Errorf("event %+v streamed with id %s and type %s", e, id, kind)
+				}
+				streamed = append(streamed, e)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatalf("stream cut off: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed >= time.Second {
+			t.Errorf("stream ended after %v, not once the flow finished", elapsed)
+		}
+		if len(streamed) > 0 && streamed[len(streamed)-1].Kind != event.ChainFinished {
+			t.Errorf("stream ended after %+v", streamed[len(streamed)-1])
+		}
+		return streamed, reset
+	}
+
+	all, reset := stream("")
+	if reset {
+		t.Error("new stream reset")
+	}
+	if len(all) == 0 || all[0].Kind != event.ChainStarted || all[len(all)-1].Kind != event.ChainFinished {
+		t.Fatalf("unexpected events %+v", all)
+	}
+	for _, e := range all {
+		if e.RequestUUID != run.RequestUUID {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+
+	// A client resuming after an event gets the ones after it.
+	resumed, reset := stream(fmt.Sprint(all[1].Seq))
+	if reset {
+		t.Error("resumed stream reset")
+	}
+	if len(resumed) != len(all)-2 || resumed[0].Seq != all[2].Seq {
+		t.Errorf("resumed with %+v want %+v", resumed, all[2:])
+	}
+
+	// One resuming after an unknown event, e.g. from before a restart, is
+	// told it missed events, then gets every one kept.
+	resumed, reset = stream(fmt.Sprint(all[len(all)-1].Seq + 100))
+	if !reset || len(resumed) != len(all) || resumed[0].Seq != all[0].Seq {
+		t.Errorf("resumed after unknown event with reset %v and %+v want %+v", reset, resumed, all)
+	}
+
+	for _, c := range []struct {
+		requestID, lastID string
+		code              int
+	}{
+		{"unknown", "", http.StatusNotFound},
+		{run.RequestUUID, "x", http.StatusBadRequest},
+		// The flow is done: there is nothing to resume after its last event.
+		{run.RequestUUID, fmt.Sprint(all[len(all)-1].Seq), http.StatusNoContent},
+	} {
+		req, err := http.NewRequest("GET", srv.URL+"/api/standalone/flows/"+c.requestID+"/events", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Last-Event-ID", c.lastID)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Errorf("events of %s after %q returned wrong status code: got %v want %v", c.requestID, c.lastID, resp.StatusCode, c.code)
+		}
+	}
 }
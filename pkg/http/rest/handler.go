@@ -1,6 +1,9 @@
 package rest
 
 import (
+	"encoding/json"
+	"net/http"
+
 	"github.com/go-chi/chi"
 	chimiddleware "github.com/go-chi/chi/middleware"
 	"github.com/longsolong/flow/pkg/http/rest/middleware"
@@ -40,3 +43,27 @@ func CreateHandler(l *infra.Logger) *Handler {
 func (h *Handler) GetRouter() chi.Router {
 	return h.router
 }
+
+// writeJSON writes v as the json body of a response with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+// writeError writes an HTTPError response.
+func writeError(w http.ResponseWriter, code int, message string) {
+	b, _ := json.Marshal(HTTPError{
+		ErrorCode:   code,
+		Message:     message,
+		UserMessage: http.StatusText(code),
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
@@ -4,12 +4,20 @@ import (
 	"encoding/json"
 	"github.com/longsolong/flow/pkg/workflow/atom"
 	"github.com/longsolong/flow/pkg/workflow/state"
+	"time"
 )
 
 // Job ...
 type Job struct {
 	atom.Atom             // step
 	State     state.State // State const
+
+	StartedAt  time.Time // when the job last started running
+	FinishedAt time.Time // when the job last reached a done state
+
+	WaitTime time.Duration // how long the job last waited for a running slot
+
+	Prompt string // input the job waits for in StateWaitInput, see atom.InputRequester
 }
 
 // NewJob ...
@@ -25,5 +33,9 @@ func (j Job) MarshalJSON() ([]byte, error) {
 		"Atom": j.Atom,
 		"State": j.State,
 		"StateText": state.StateText[j.State],
+		"StartedAt": j.StartedAt,
+		"FinishedAt": j.FinishedAt,
+		"WaitTime": j.WaitTime,
+		"Prompt": j.Prompt,
 	})
-}
\ No newline at end of file
+}
@@ -1,35 +1,151 @@
 package chain
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/longsolong/flow/pkg/orchestration/job"
+	"github.com/longsolong/flow/pkg/services/store"
+	"github.com/longsolong/flow/pkg/workflow"
 	"github.com/longsolong/flow/pkg/workflow/atom"
 	"github.com/longsolong/flow/pkg/workflow/dag"
 	"github.com/longsolong/flow/pkg/workflow/state"
+	"sort"
 	"sync"
+	"time"
 )
 
 // Chain represents a job chain and some meta information about it.
+//
+// The graph of a chain can grow while it runs, see AddBatch. Locks are taken
+// in this order: c.DAG.VerticesMux, c.jobsMux, c.triesMux, then the EdgeMux of
+// nodes; never take c.DAG.VerticesMux while holding one of the others.
 type Chain struct {
 	*dag.DAG
 
-	jobs    map[atom.AtomID]*job.Job
-	jobsMux *sync.RWMutex // for access to jobs maps
+	jobs     map[atom.AtomID]*job.Job
+	outputs  map[atom.AtomID]atom.Outputs       // outputs of the last run of each job
+	branches map[atom.AtomID][]atom.AtomID      // next jobs chosen by the last run of branch jobs
+	inputs   map[atom.AtomID]json.RawMessage    // input submitted for the next run of jobs
+	history  map[atom.AtomID][]state.Transition // state transitions of jobs, oldest first
+	audit    []store.Audit                      // operator actions on jobs, oldest first
+	jobsMux  *sync.RWMutex                      // for access to jobs maps
 
 	triesMux      *sync.RWMutex        // for access to sequence/job tries maps
 	sequenceTries map[atom.AtomID]uint // Number of sequence retries attempted so far
 	totalJobTries map[atom.AtomID]uint // Number of job retries attempted so far
+
+	stateMux   *sync.RWMutex // for access to the chain state and callbacks
+	state      state.State   // one of state.ChainState
+	startedAt  time.Time     // first time the chain started running
+	finishedAt time.Time     // last time the chain was finalized
+	onFinalize []FinalizeFunc
+
+	grownChan chan struct{} // signaled when jobs were added while running
+
+	runStore     store.Store // set by Persist, nil if the chain isn't persisted
+	runUUID      string
+	onStoreError func(err error)
+
+	recordMux *sync.Mutex        // for access to the queue
+	queue     []store.Transition // transitions not appended yet, oldest first
+	flushMux  *sync.Mutex        // held while appending the queue
 }
 
+// FinalizeFunc is a callback called when a chain is finalized.
+type FinalizeFunc func(c *Chain)
+
 // NewChain ...
 func NewChain(d *dag.DAG) *Chain {
 	return &Chain{
 		DAG:           d,
 		jobs:          make(map[atom.AtomID]*job.Job),
+		outputs:       make(map[atom.AtomID]atom.Outputs),
+		branches:      make(map[atom.AtomID][]atom.AtomID),
+		inputs:        make(map[atom.AtomID]json.RawMessage),
+		history:       make(map[atom.AtomID][]state.Transition),
 		jobsMux:       &sync.RWMutex{},
 		triesMux:      &sync.RWMutex{},
 		sequenceTries: make(map[atom.AtomID]uint),
 		totalJobTries: make(map[atom.AtomID]uint),
+		stateMux:      &sync.RWMutex{},
+		state:         state.StateUnknown,
+		grownChan:     make(chan struct{}, 1),
+		recordMux:     &sync.Mutex{},
+		flushMux:      &sync.Mutex{},
+	}
+}
+
+// State returns the state of the chain.
+func (c *Chain) State() state.State {
+	c.stateMux.RLock()
+	defer c.stateMux.RUnlock()
+	return c.state
+}
+
+// StartedAt returns when the chain first started running.
+func (c *Chain) StartedAt() time.Time {
+	c.stateMux.RLock()
+	defer c.stateMux.RUnlock()
+	return c.startedAt
+}
+
+// Deadline returns when the chain must be done running: DAG.Timeout after it
+// first started. It is zero if the DAG has no timeout or the chain hasn't
+// started.
+func (c *Chain) Deadline() time.Time {
+	c.stateMux.RLock()
+	defer c.stateMux.RUnlock()
+	if c.DAG.Timeout <= 0 || c.startedAt.IsZero() {
+		return time.Time{}
+	}
+	return c.startedAt.Add(c.DAG.Timeout)
+}
+
+// FinishedAt returns when the chain was last finalized, zero while it runs.
+func (c *Chain) FinishedAt() time.Time {
+	c.stateMux.RLock()
+	defer c.stateMux.RUnlock()
+	return c.finishedAt
+}
+
+// Start sets the chain state to running. A resumed chain keeps the time it
+// first started.
+func (c *Chain) Start() {
+	defer c.flush()
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	now := time.Now().UTC()
+	c.state = state.StateRunning
+	if c.startedAt.IsZero() {
+		c.startedAt = now
+	}
+	c.finishedAt = time.Time{}
+	c.record(store.Transition{Kind: store.ChainStateTransition, State: state.StateRunning, At: now})
+}
+
+// OnFinalize registers a callback called every time the chain is finalized,
+// e.g. once when it is suspended and once more when it is done after being
+// resumed. Callbacks are called in registration order, in the goroutine
+// finalizing the chain, so they must not block.
+func (c *Chain) OnFinalize(callback FinalizeFunc) {
+	c.stateMux.Lock()
+	defer c.stateMux.Unlock()
+	c.onFinalize = append(c.onFinalize, callback)
+}
+
+// Finalize sets the final state of the chain, one of SUCCESS, FAIL, STOPPED
+// or SUSPENDED, then calls the OnFinalize callbacks.
+func (c *Chain) Finalize(s state.State) {
+	c.stateMux.Lock()
+	c.state = s
+	c.finishedAt = time.Now().UTC()
+	c.record(store.Transition{Kind: store.ChainStateTransition, State: s, At: c.finishedAt})
+	callbacks := append([]FinalizeFunc(nil), c.onFinalize...)
+	c.stateMux.Unlock()
+	c.flush()
+
+	for _, callback := range callbacks {
+		callback(c)
 	}
 }
 
@@ -40,11 +156,198 @@ func (c *Chain) JobState(atomID atom.AtomID) state.State {
 	return c.jobs[atomID].State
 }
 
-// SetJobState set the state of a job in the chain.
-func (c *Chain) SetJobState(atomID atom.AtomID, state state.State) {
+// SetJobState set the state of a job in the chain. It also records when the
+// job started running and when it was done, and the transition in the history
+// of the job. It returns workflow.ErrNotRegisteredNode if the chain has no
+// such job, and an error wrapping workflow.ErrInvalidTransition, setting
+// nothing, if the job can't go to s, see state.CanTransition.
+func (c *Chain) SetJobState(atomID atom.AtomID, s state.State) error {
+	defer c.flush()
+	c.jobsMux.Lock()
+	defer c.jobsMux.Unlock()
+	j, ok := c.jobs[atomID]
+	if !ok {
+		return fmt.Errorf("%s: %w", atomID, workflow.ErrNotRegisteredNode)
+	}
+	if !state.CanTransition(j.State, s) {
+		return fmt.Errorf("%s: %w: %s to %s", atomID, workflow.ErrInvalidTransition, j.State, s)
+	}
+	c.setJobState(atomID, s)
+	return nil
+}
+
+func (c *Chain) setJobState(atomID atom.AtomID, s state.State) {
+	// CALLER MUST LOCK c.jobsMux, AND CHECK THE TRANSITION!
+	now := time.Now().UTC()
+	j := c.jobs[atomID]
+	if j.State != s {
+		c.history[atomID] = append(c.history[atomID], state.Transition{From: j.State, To: s, At: now})
+	}
+	j.State = s
+	if s == state.StateRunning {
+		j.StartedAt = now
+		j.FinishedAt = time.Time{}
+	} else if _, ok := state.JobDoneState[s]; ok {
+		j.FinishedAt = now
+	}
+	c.record(store.Transition{Kind: store.JobStateTransition, AtomID: atomID, State: s, At: now})
+}
+
+// JobHistory returns the state transitions of a job, oldest first.
+func (c *Chain) JobHistory(atomID atom.AtomID) []state.Transition {
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
+	return append([]state.Transition(nil), c.history[atomID]...)
+}
+
+// SetJobWaitTime sets how long the last run of a job waited for a running
+// slot before it ran.
+func (c *Chain) SetJobWaitTime(atomID atom.AtomID, wait time.Duration) {
 	c.jobsMux.Lock()
 	defer c.jobsMux.Unlock()
-	c.jobs[atomID].State = state
+	c.jobs[atomID].WaitTime = wait
+}
+
+// SetJobOutputs sets the outputs of the last run of a job, replacing the
+// outputs of any previous run.
+func (c *Chain) SetJobOutputs(atomID atom.AtomID, outputs atom.Outputs) {
+	defer c.flush()
+	c.jobsMux.Lock()
+	defer c.jobsMux.Unlock()
+	outputs = outputs.Copy()
+	if outputs == nil {
+		delete(c.outputs, atomID)
+	} else {
+		c.outputs[atomID] = outputs
+	}
+	c.record(store.Transition{Kind: store.JobOutputsTransition, AtomID: atomID, Outputs: outputs, At: time.Now().UTC()})
+}
+
+// JobOutputs returns a copy of the outputs of the last run of a job.
+func (c *Chain) JobOutputs(atomID atom.AtomID) atom.Outputs {
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
+	return c.outputs[atomID].Copy()
+}
+
+// SetJobBranch sets the next jobs chosen by the last run of a branch job; the
+// jobs reachable only through the other next jobs won't run. A nil branch
+// means the job isn't a branch and every next job can run. It returns
+// workflow.ErrNotDownstream, and sets nothing, if a chosen job isn't a next
+// job of the job.
+func (c *Chain) SetJobBranch(atomID atom.AtomID, branch []atom.AtomID) error {
+	node := c.DAG.MustGetNode(atomID)
+	downstream := node.Downstream()
+	for _, nextJobID := range branch {
+		if _, ok := downstream[nextJobID]; !ok {
+			return fmt.Errorf("%s: %w", nextJobID, workflow.ErrNotDownstream)
+		}
+	}
+
+	defer c.flush()
+	c.jobsMux.Lock()
+	defer c.jobsMux.Unlock()
+	_, wasBranch := c.branches[atomID]
+	if branch == nil {
+		if !wasBranch {
+			return nil
+		}
+		delete(c.branches, atomID)
+	} else {
+		c.branches[atomID] = append([]atom.AtomID{}, branch...)
+	}
+	c.record(store.Transition{Kind: store.JobBranchTransition, AtomID: atomID, Branch: branch, At: time.Now().UTC()})
+	return nil
+}
+
+// JobBranch returns a copy of the next jobs chosen by the last run of a
+// branch job, nil if it isn't a branch.
+func (c *Chain) JobBranch(atomID atom.AtomID) []atom.AtomID {
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
+	return copyBranch(c.branches[atomID])
+}
+
+// SetJobPrompt sets the prompt of the input a job waits for, see
+// atom.InputRequester.
+func (c *Chain) SetJobPrompt(atomID atom.AtomID, prompt string) {
+	c.jobsMux.Lock()
+	defer c.jobsMux.Unlock()
+	c.jobs[atomID].Prompt = prompt
+}
+
+// SetJobInput sets the input submitted for the next run of a job, nil for
+// none.
+func (c *Chain) SetJobInput(atomID atom.AtomID, input json.RawMessage) {
+	defer c.flush()
+	c.jobsMux.Lock()
+	defer c.jobsMux.Unlock()
+	c.setJobInput(atomID, input)
+}
+
+func (c *Chain) setJobInput(atomID atom.AtomID, input json.RawMessage) {
+	// CALLER MUST LOCK c.jobsMux!
+	if input == nil {
+		if _, ok := c.inputs[atomID]; !ok {
+			return
+		}
+		delete(c.inputs, atomID)
+	} else {
+		c.inputs[atomID] = append(json.RawMessage(nil), input...)
+	}
+	c.record(store.Transition{Kind: store.JobInputTransition, AtomID: atomID, Input: input, At: time.Now().UTC()})
+}
+
+// JobInput returns a copy of the input submitted for the next run of a job,
+// nil if there is none.
+func (c *Chain) JobInput(atomID atom.AtomID) json.RawMessage {
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
+	return append(json.RawMessage(nil), c.inputs[atomID]...)
+}
+
+// SubmitJobInput sets the input of a job waiting for it, and makes the job
+// runnable again: the running reaper is notified, like by NotifyGrown, to
+// enqueue it. It returns workflow.ErrNotWaitingInput, and sets nothing, if
+// the job isn't in StateWaitInput.
+func (c *Chain) SubmitJobInput(atomID atom.AtomID, input json.RawMessage) error {
+	defer c.flush()
+	c.jobsMux.Lock()
+	j, ok := c.jobs[atomID]
+	if !ok || j.State != state.StateWaitInput {
+		c.jobsMux.Unlock()
+		return fmt.Errorf("%s: %w", atomID, workflow.ErrNotWaitingInput)
+	}
+	c.setJobInput(atomID, input)
+	j.Prompt = ""
+	c.setJobState(atomID, state.StateUnknown)
+	c.jobsMux.Unlock()
+
+	c.NotifyGrown()
+	return nil
+}
+
+// copyBranch copies a branch, keeping nil and empty branches apart.
+func copyBranch(branch []atom.AtomID) []atom.AtomID {
+	if branch == nil {
+		return nil
+	}
+	return append([]atom.AtomID{}, branch...)
+}
+
+// UpstreamOutputs returns a copy of the outputs of the upstream jobs of a job,
+// by AtomID. Upstream jobs without outputs are missing.
+func (c *Chain) UpstreamOutputs(atomID atom.AtomID) map[atom.AtomID]atom.Outputs {
+	node := c.DAG.MustGetNode(atomID)
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
+	outputs := make(map[atom.AtomID]atom.Outputs)
+	for upstreamID := range node.Upstream() {
+		if o, ok := c.outputs[upstreamID]; ok {
+			outputs[upstreamID] = o.Copy()
+		}
+	}
+	return outputs
 }
 
 // AddJob ...
@@ -54,20 +357,62 @@ func (c *Chain) AddJob(j *job.Job) {
 	c.jobs[j.AtomID()] = j
 }
 
+// AddBatch adds the nodes and edges of a batch to the graph of the chain, and
+// a job per new node to the chain, at once: the running reaper never sees a
+// new node without its job or its edges. It adds nothing if the batch can't
+// be applied, see dag.DAG.Apply.
+func (c *Chain) AddBatch(b *dag.Batch) error {
+	c.DAG.VerticesMux.Lock()
+	defer c.DAG.VerticesMux.Unlock()
+	if err := c.DAG.ApplyLocked(b); err != nil {
+		return err
+	}
+	c.jobsMux.Lock()
+	defer c.jobsMux.Unlock()
+	for _, node := range b.Nodes() {
+		c.jobs[node.Datum.AtomID()] = job.NewJob(node.Datum)
+	}
+	return nil
+}
+
+// NotifyGrown tells the running reaper that jobs were added to the chain, and
+// wired in its graph, so it enqueues the ones that are runnable. Call it after
+// the new nodes are wired, never in between. It also wakes the reaper for
+// jobs that became runnable again, see SubmitJobInput.
+func (c *Chain) NotifyGrown() {
+	select {
+	case c.grownChan <- struct{}{}:
+	default: // the reaper has yet to handle an earlier notification
+	}
+}
+
+// Grown returns a channel that receives after NotifyGrown.
+func (c *Chain) Grown() <-chan struct{} {
+	return c.grownChan
+}
+
 // AllJobs ...
 func (c *Chain) AllJobs() (allJobs []*job.Job) {
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
 	for _, j := range c.jobs {
 		allJobs = append(allJobs, j)
 	}
 	return allJobs
 }
 
-// NextJobs finds all of the jobs adjacent to the given job.
+// NextJobs finds all of the jobs adjacent to the given job. It holds the lock
+// of the graph, so that jobs added by AddBatch come with their edges.
 func (c *Chain) NextJobs(jobID atom.AtomID) []*job.Job {
+	c.DAG.VerticesMux.RLock()
+	defer c.DAG.VerticesMux.RUnlock()
+	node, ok := c.DAG.Vertices[jobID]
+	if !ok {
+		panic(workflow.ErrNotRegisteredNode)
+	}
 	c.jobsMux.RLock()
 	defer c.jobsMux.RUnlock()
 	var nextJobs []*job.Job
-	node := c.DAG.MustGetNode(jobID)
 
 	for nextJobID := range node.Downstream() {
 		j := c.jobs[nextJobID]
@@ -81,15 +426,19 @@ func (c *Chain) NextJobs(jobID atom.AtomID) []*job.Job {
 func (c *Chain) IsRunnable(jobID atom.AtomID) bool {
 	c.DAG.VerticesMux.RLock()
 	defer c.DAG.VerticesMux.RUnlock()
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
 	return c.isRunnable(jobID)
 }
 
 // RunnableJobs ...
 func (c *Chain) RunnableJobs() (runnableJobs []*job.Job) {
+	c.DAG.VerticesMux.RLock()
+	defer c.DAG.VerticesMux.RUnlock()
 	c.jobsMux.RLock()
 	defer c.jobsMux.RUnlock()
 	for jobID, j := range c.jobs {
-		if !c.IsRunnable(jobID) {
+		if !c.isRunnable(jobID) {
 			continue
 		}
 		runnableJobs = append(runnableJobs, j)
@@ -123,7 +472,9 @@ func (c *Chain) IsDoneRunning() (done bool, complete bool) {
 		if _, ok := state.JobCompleteState[j.State]; ok {
 			continue
 		}
-		if j.State == state.StateUnknown {
+		if j.State == state.StateUnknown || j.State == state.StateUpForRetry || j.State == state.StateMarkRetry {
+			// Not run yet: e.g. the rest of a retried sequence whose first
+			// job failed never runs.
 			if c.isRunnable(j.AtomID()) {
 				return false, false
 			}
@@ -137,9 +488,12 @@ func (c *Chain) IsDoneRunning() (done bool, complete bool) {
 }
 
 // isRunnable returns true if the job is runnable. A job is runnable iff its
-// state is StateUnknown || StateUpForRetry || StateMarkRetry and all immediately previous jobs are state COMPLETE.
+// state is StateUnknown || StateUpForRetry || StateMarkRetry and the trigger
+// rule of its node is met by the states of the immediately previous jobs; by
+// default, all of them must be state COMPLETE. A job reachable only through
+// ignored jobs and untaken branches is not runnable, see IsIgnorable.
 func (c *Chain) isRunnable(jobID atom.AtomID) bool {
-	// CALLER MUST LOCK c.DAG.VerticesMux!
+	// CALLER MUST LOCK c.DAG.VerticesMux and c.jobsMux!
 	var j *job.Job
 	var ok bool
 	if j, ok = c.jobs[jobID]; !ok {
@@ -148,15 +502,11 @@ func (c *Chain) isRunnable(jobID atom.AtomID) bool {
 	if j.State != state.StateUnknown && j.State != state.StateUpForRetry && j.State != state.StateMarkRetry {
 		return false
 	}
-	// Check that all previous jobs are complete.
-	node := c.DAG.MustGetNode(jobID)
-	for prevJobID := range node.Upstream() {
-		j := c.jobs[prevJobID]
-		if _, ok := state.JobCompleteState[j.State]; !ok {
-			return false
-		}
-	}
-	return true
+	// Check the trigger rule against the previous jobs.
+	node := c.DAG.Vertices[jobID]
+	u := c.upstreamStates(node, map[atom.AtomID]bool{})
+	met, _ := triggered(node.TriggerRule, u)
+	return met && !skipped(node.TriggerRule, u)
 }
 
 // SequenceStartJob ...
@@ -165,6 +515,8 @@ func (c *Chain) SequenceStartJob(jobID atom.AtomID) *job.Job {
 	if node.SequenceID.IsEmpty() {
 		return nil
 	}
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
 	return c.jobs[node.SequenceID]
 }
 
@@ -180,19 +532,21 @@ func (c *Chain) CanRetrySequence(jobID atom.AtomID) bool {
 	if sequenceStartJob == nil {
 		return false
 	}
+	node := c.DAG.MustGetNode(sequenceStartJob.AtomID())
 	c.triesMux.RLock()
 	defer c.triesMux.RUnlock()
-	node := c.DAG.MustGetNode(sequenceStartJob.AtomID())
 	return c.sequenceTries[sequenceStartJob.AtomID()] <= node.SequenceRetry
 }
 
 // IncrementJobTries ...
 func (c *Chain) IncrementJobTries(jobID atom.AtomID, delta uint) {
+	defer c.flush()
 	c.triesMux.Lock()
 	defer c.triesMux.Unlock()
 	// Total job tries can only increase. This is the job try count
 	// that's monotonically increasing across all sequence retries.
 	c.totalJobTries[jobID] += delta
+	c.record(store.Transition{Kind: store.JobTriesTransition, AtomID: jobID, Delta: int(delta), At: time.Now().UTC()})
 }
 
 // JobTries ...
@@ -205,9 +559,25 @@ func (c *Chain) JobTries(jobID atom.AtomID) uint {
 // IncrementSequenceTries ...
 func (c *Chain) IncrementSequenceTries(jobID atom.AtomID, delta uint) {
 	node := c.DAG.MustGetNode(jobID)
+	defer c.flush()
 	c.triesMux.Lock()
 	defer c.triesMux.Unlock()
 	c.sequenceTries[node.SequenceID] += delta
+	c.record(store.Transition{Kind: store.SequenceTriesTransition, AtomID: node.SequenceID, Delta: int(delta), At: time.Now().UTC()})
+}
+
+// DecrementSequenceTries gives back sequence tries that didn't really happen,
+// e.g. a sequence try interrupted by a suspend. It stops at zero.
+func (c *Chain) DecrementSequenceTries(jobID atom.AtomID, delta uint) {
+	node := c.DAG.MustGetNode(jobID)
+	defer c.flush()
+	c.triesMux.Lock()
+	defer c.triesMux.Unlock()
+	if c.sequenceTries[node.SequenceID] < delta {
+		delta = c.sequenceTries[node.SequenceID]
+	}
+	c.sequenceTries[node.SequenceID] -= delta
+	c.record(store.Transition{Kind: store.SequenceTriesTransition, AtomID: node.SequenceID, Delta: -int(delta), At: time.Now().UTC()})
 }
 
 // SequenceTries ...
@@ -217,3 +587,62 @@ func (c *Chain) SequenceTries(jobID atom.AtomID) uint {
 	defer c.triesMux.RUnlock()
 	return c.sequenceTries[node.SequenceID]
 }
+
+// JobStatus is a point in time copy of the state of one job.
+type JobStatus struct {
+	AtomID     atom.AtomID
+	Name       string
+	State      state.State
+	StateText  string
+	Tries      uint // total tries, across sequence retries
+	StartedAt  time.Time
+	FinishedAt time.Time
+	WaitTime   time.Duration      // how long the last run waited for a running slot
+	Outputs    atom.Outputs       `json:",omitempty"`
+	Branch     []atom.AtomID      // next jobs chosen by a branch job, nil if it isn't one
+	Prompt     string             `json:",omitempty"` // input the job waits for in StateWaitInput
+	Input      json.RawMessage    `json:",omitempty"` // input submitted for its next run
+	History    []state.Transition // state transitions, oldest first
+}
+
+// JobStatuses returns the status of every job in the chain, in topological
+// order.
+func (c *Chain) JobStatuses() []JobStatus {
+	order, err := c.DAG.TopologicalSort()
+	if err != nil {
+		// Can't happen for a validated graph, fall back to AtomID order.
+		order = order[:0]
+		for _, j := range c.AllJobs() {
+			order = append(order, j.AtomID())
+		}
+		sort.Slice(order, func(i, j int) bool { return order[i].Less(order[j]) })
+	}
+
+	c.DAG.VerticesMux.RLock()
+	defer c.DAG.VerticesMux.RUnlock()
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
+	statuses := make([]JobStatus, 0, len(order))
+	for _, atomID := range order {
+		j, ok := c.jobs[atomID]
+		if !ok {
+			continue
+		}
+		statuses = append(statuses, JobStatus{
+			AtomID:     atomID,
+			Name:       c.DAG.Vertices[atomID].Name,
+			State:      j.State,
+			StateText:  state.StateText[j.State],
+			Tries:      c.JobTries(atomID),
+			StartedAt:  j.StartedAt,
+			FinishedAt: j.FinishedAt,
+			WaitTime:   j.WaitTime,
+			Outputs:    c.outputs[atomID].Copy(),
+			Branch:     copyBranch(c.branches[atomID]),
+			Prompt:     j.Prompt,
+			Input:      append(json.RawMessage(nil), c.inputs[atomID]...),
+			History:    append([]state.Transition(nil), c.history[atomID]...),
+		})
+	}
+	return statuses
+}
@@ -1,9 +1,15 @@
 package chain
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/longsolong/flow/pkg/orchestration/job"
+	"github.com/longsolong/flow/pkg/services/store"
 	"github.com/longsolong/flow/pkg/workflow"
 	"github.com/longsolong/flow/pkg/workflow/atom"
 	"github.com/longsolong/flow/pkg/workflow/dag"
+	"github.com/longsolong/flow/pkg/workflow/state"
 	"github.com/longsolong/flow/pkg/workflow/step/builtin"
 	"time"
 
@@ -38,4 +44,316 @@ func TestNewJobChain(t *testing.T) {
 
 	downstreams := noop2.Downstream()
 	assert.Equal(t, map[atom.AtomID]*dag.Node{}, downstreams)
-}
\ No newline at end of file
+}
+func TestJobStatuses(t *testing.T) {
+	d := dag.NewDAG("test noop chain", 1)
+
+	chain := NewChain(d)
+	noop1 := dag.NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	noop2 := dag.NewNode(builtin.NewNoop("2", ""), "noop2", 0, time.Duration(0))
+	chain.MustAddNode(noop2)
+	chain.MustAddNode(noop1)
+	assert.Nil(t, noop2.SetUpstream(noop1))
+	chain.AddJob(job.NewJob(noop1.Datum))
+	chain.AddJob(job.NewJob(noop2.Datum))
+
+	assert.Nil(t, chain.SetJobState(noop1.Datum.AtomID(), state.StateRunning))
+	chain.IncrementJobTries(noop1.Datum.AtomID(), 1)
+	statuses := chain.JobStatuses()
+	assert.Equal(t, 2, len(statuses))
+	assert.Equal(t, "noop1", statuses[0].Name)
+	assert.Equal(t, "RUNNING", statuses[0].StateText)
+	assert.Equal(t, uint(1), statuses[0].Tries)
+	assert.False(t, statuses[0].StartedAt.IsZero())
+	assert.True(t, statuses[0].FinishedAt.IsZero())
+	assert.Equal(t, "noop2", statuses[1].Name)
+	assert.True(t, statuses[1].StartedAt.IsZero())
+
+	assert.Nil(t, chain.SetJobState(noop1.Datum.AtomID(), state.StateSuccess))
+	statuses = chain.JobStatuses()
+	assert.Equal(t, "SUCCESS", statuses[0].StateText)
+	assert.False(t, statuses[0].FinishedAt.Before(statuses[0].StartedAt))
+}
+
+func TestPersist(t *testing.T) {
+	d := dag.NewDAG("test noop chain", 1)
+
+	chain := NewChain(d)
+	noop1 := dag.NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	noop2 := dag.NewNode(builtin.NewNoop("2", ""), "noop2", 0, time.Duration(0))
+	chain.MustAddNode(noop1)
+	chain.MustAddNode(noop2)
+	assert.Nil(t, noop2.SetUpstream(noop1))
+	noop1.SequenceID = noop1.Datum.AtomID()
+	noop2.SequenceID = noop1.Datum.AtomID()
+	chain.AddJob(job.NewJob(noop1.Datum))
+	chain.AddJob(job.NewJob(noop2.Datum))
+
+	s := store.NewMemory()
+	var storeErrs []error
+	err := chain.Persist(s, store.Run{RequestUUID: "a", Name: "test noop chain", Version: 1}, func(err error) {
+		storeErrs = append(storeErrs, err)
+	})
+	assert.Nil(t, err)
+
+	chain.Start()
+	chain.IncrementSequenceTries(noop1.Datum.AtomID(), 1)
+	assert.Nil(t, chain.SetJobState(noop1.Datum.AtomID(), state.StateRunning))
+	chain.IncrementJobTries(noop1.Datum.AtomID(), 1)
+	assert.Nil(t, chain.SetJobState(noop1.Datum.AtomID(), state.StateFail))
+	chain.DecrementSequenceTries(noop1.Datum.AtomID(), 2)
+	chain.Finalize(state.StateFail)
+
+	run, err := s.LoadRun("a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(7), run.LastSeq)
+	run.LastSeq = 0
+	assert.Equal(t, chain.Snapshot(store.Run{RequestUUID: "a", Name: "test noop chain", Version: 1}), run)
+	assert.Empty(t, storeErrs)
+}
+
+// slowStore appends transitions once released.
+type slowStore struct {
+	store.Store
+	release chan struct{}
+}
+
+func (s slowStore) AppendTransition(t store.Transition) (store.Transition, error) {
+	<-s.release
+	return s.Store.AppendTransition(t)
+}
+
+func TestPersistSlowStore(t *testing.T) {
+	d := dag.NewDAG("test noop chain", 1)
+
+	chain := NewChain(d)
+	noop1 := dag.NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	chain.MustAddNode(noop1)
+	chain.AddJob(job.NewJob(noop1.Datum))
+	s := slowStore{Store: store.NewMemory(), release: make(chan struct{})}
+	assert.Nil(t, chain.Persist(s, store.Run{RequestUUID: "a", Name: "test noop chain", Version: 1}, nil))
+	id := noop1.Datum.AtomID()
+
+	// A change is saved before it returns, but readers of the chain don't
+	// wait for the store meanwhile.
+	started := make(chan struct{})
+	go func() {
+		chain.Start()
+		close(started)
+	}()
+	for i := 0; i < 100 && chain.State() != state.StateRunning; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, state.StateRunning, chain.State())
+	assert.Equal(t, state.StateUnknown, chain.JobState(id))
+	select {
+	case <-started:
+		t.Error("change returned before it was saved")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(s.release)
+	<-started
+	assert.Nil(t, chain.SetJobState(id, state.StateRunning))
+	chain.IncrementJobTries(id, 1)
+	assert.Nil(t, chain.SetJobState(id, state.StateSuccess))
+	chain.Finalize(state.StateSuccess)
+
+	run, err := s.LoadRun("a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), run.LastSeq)
+	assert.Equal(t, state.StateSuccess, run.State)
+	assert.Equal(t, state.StateSuccess, run.Jobs[0].State)
+	assert.Equal(t, uint(1), run.Jobs[0].Tries)
+	assert.Equal(t, chain.JobHistory(id), run.Jobs[0].History)
+}
+
+func TestSubmitJobInput(t *testing.T) {
+	d := dag.NewDAG("test noop chain", 1)
+
+	chain := NewChain(d)
+	noop1 := dag.NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	chain.MustAddNode(noop1)
+	chain.AddJob(job.NewJob(noop1.Datum))
+	s := store.NewMemory()
+	assert.Nil(t, chain.Persist(s, store.Run{RequestUUID: "a", Name: "test noop chain", Version: 1}, nil))
+	id := noop1.Datum.AtomID()
+
+	err := chain.SubmitJobInput(id, json.RawMessage(`{"ok":true}`))
+	assert.True(t, errors.Is(err, workflow.ErrNotWaitingInput))
+	assert.Nil(t, chain.JobInput(id))
+
+	assert.Nil(t, chain.SetJobState(id, state.StateRunning))
+	assert.Nil(t, chain.SetJobState(id, state.StateWaitInput))
+	chain.SetJobPrompt(id, "ok?")
+	assert.Equal(t, "ok?", chain.JobStatuses()[0].Prompt)
+	assert.Nil(t, chain.SubmitJobInput(id, json.RawMessage(`{"ok":true}`)))
+	assert.Equal(t, state.StateUnknown, chain.JobState(id))
+	assert.Equal(t, json.RawMessage(`{"ok":true}`), chain.JobInput(id))
+	assert.Equal(t, "", chain.JobStatuses()[0].Prompt)
+	assert.True(t, chain.IsRunnable(id))
+	select {
+	case <-chain.Grown():
+	default:
+		t.Error("reaper not notified")
+	}
+	err = chain.SubmitJobInput(id, json.RawMessage(`{"ok":false}`))
+	assert.True(t, errors.Is(err, workflow.ErrNotWaitingInput))
+
+	// The input survives a restart, until the run consumes it.
+	run, err := s.LoadRun("a")
+	assert.Nil(t, err)
+	restored := NewChain(d)
+	restored.AddJob(job.NewJob(noop1.Datum))
+	restored.Restore(run)
+	assert.Equal(t, json.RawMessage(`{"ok":true}`), restored.JobInput(id))
+	chain.SetJobInput(id, nil)
+	run, err = s.LoadRun("a")
+	assert.Nil(t, err)
+	assert.Nil(t, run.Jobs[0].Input)
+}
+
+func TestMarkJob(t *testing.T) {
+	d := dag.NewDAG("test noop chain", 1)
+
+	chain := NewChain(d)
+	noop1 := dag.NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	noop2 := dag.NewNode(builtin.NewNoop("2", ""), "noop2", 0, time.Duration(0))
+	noop3 := dag.NewNode(builtin.NewNoop("3", ""), "noop3", 0, time.Duration(0))
+	for _, n := range []*dag.Node{noop1, noop2, noop3} {
+		chain.MustAddNode(n)
+		chain.AddJob(job.NewJob(n.Datum))
+	}
+	assert.Nil(t, noop2.SetUpstream(noop1))
+	assert.Nil(t, noop3.SetUpstream(noop2))
+	s := store.NewMemory()
+	assert.Nil(t, chain.Persist(s, store.Run{RequestUUID: "a", Name: "test noop chain", Version: 1}, nil))
+	id1, id2, id3 := noop1.Datum.AtomID(), noop2.Datum.AtomID(), noop3.Datum.AtomID()
+
+	// Only failed jobs can be skipped, by an operator.
+	assert.Nil(t, chain.SetJobState(id1, state.StateRunning))
+	assert.Nil(t, chain.SetJobState(id1, state.StateStopped))
+	assert.Nil(t, chain.SetJobState(id2, state.StateRunning))
+	assert.Nil(t, chain.SetJobState(id2, state.StateFail))
+	err := chain.MarkJobSkipped(id1, "ops", "")
+	assert.True(t, errors.Is(err, workflow.ErrInvalidTransition))
+	assert.Equal(t, workflow.ErrNoOperator, chain.MarkJobSkipped(id2, "", ""))
+	err = chain.MarkJobSkipped(atom.AtomID{Type: "unknown"}, "ops", "")
+	assert.True(t, errors.Is(err, workflow.ErrNotRegisteredNode))
+	assert.False(t, chain.IsRunnable(id3))
+	assert.Nil(t, chain.MarkJobSkipped(id2, "ops", "flaky"))
+	assert.Equal(t, state.StateMarkSkipped, chain.JobState(id2))
+	assert.True(t, chain.IsRunnable(id3))
+	select {
+	case <-chain.Grown():
+	default:
+		t.Error("reaper not notified")
+	}
+
+	// Retrying a job with its downstream jobs marks the done ones, or none
+	// if one of them is running.
+	assert.Nil(t, chain.SetJobState(id3, state.StateRunning))
+	err = chain.MarkJobRetry(id1, true, "ops", "")
+	assert.True(t, errors.Is(err, workflow.ErrInvalidTransition))
+	assert.Equal(t, state.StateStopped, chain.JobState(id1))
+	assert.Nil(t, chain.SetJobState(id3, state.StateSuccess))
+	assert.Nil(t, chain.MarkJobRetry(id1, true, "dev", "rerun all"))
+	assert.Equal(t, state.StateMarkRetry, chain.JobState(id1))
+	assert.Equal(t, state.StateMarkRetry, chain.JobState(id2))
+	assert.Equal(t, state.StateMarkRetry, chain.JobState(id3))
+	assert.True(t, chain.IsRunnable(id1))
+	assert.False(t, chain.IsRunnable(id2))
+
+	audit := chain.Audit()
+	if assert.Len(t, audit, 4) {
+		assert.Equal(t, "ops", audit[0].Operator)
+		assert.Equal(t, "flaky", audit[0].Reason)
+		assert.Equal(t, id2, audit[0].AtomID)
+		assert.Equal(t, state.StateFail, audit[0].From)
+		assert.Equal(t, state.StateMarkSkipped, audit[0].To)
+		for i, id := range []atom.AtomID{id1, id2, id3} {
+			assert.Equal(t, "dev", audit[i+1].Operator)
+			assert.Equal(t, id, audit[i+1].AtomID)
+		}
+	}
+	run, err := s.LoadRun("a")
+	assert.Nil(t, err)
+	assert.Equal(t, audit, run.Audit)
+}
+
+func TestSetJobState(t *testing.T) {
+	d := dag.NewDAG("test noop chain", 1)
+
+	chain := NewChain(d)
+	noop1 := dag.NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	chain.MustAddNode(noop1)
+	chain.AddJob(job.NewJob(noop1.Datum))
+	s := store.NewMemory()
+	assert.Nil(t, chain.Persist(s, store.Run{RequestUUID: "a", Name: "test noop chain", Version: 1}, nil))
+	id := noop1.Datum.AtomID()
+
+	err := chain.SetJobState(atom.AtomID{Type: "unknown"}, state.StateRunning)
+	assert.True(t, errors.Is(err, workflow.ErrNotRegisteredNode))
+	err = chain.SetJobState(id, state.StateSuccess)
+	assert.True(t, errors.Is(err, workflow.ErrInvalidTransition))
+	assert.Equal(t, "AtomID: builtin.Noop.1.: invalid job state transition: UNKNOWN to SUCCESS", err.Error())
+	assert.Nil(t, chain.SetJobState(id, state.StateRunning))
+	assert.Nil(t, chain.SetJobState(id, state.StateRunning))
+	assert.Nil(t, chain.SetJobState(id, state.StateSuccess))
+	err = chain.SetJobState(id, state.StateRunning)
+	assert.True(t, errors.Is(err, workflow.ErrInvalidTransition))
+	assert.Equal(t, state.StateSuccess, chain.JobState(id))
+
+	history := chain.JobHistory(id)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, state.StateUnknown, history[0].From)
+		assert.Equal(t, state.StateRunning, history[0].To)
+		assert.Equal(t, state.StateRunning, history[1].From)
+		assert.Equal(t, state.StateSuccess, history[1].To)
+		assert.False(t, history[1].At.Before(history[0].At))
+	}
+	assert.Equal(t, history, chain.JobStatuses()[0].History)
+
+	// The history survives a restart.
+	run, err := s.LoadRun("a")
+	assert.Nil(t, err)
+	assert.Equal(t, history, run.Jobs[0].History)
+	restored := NewChain(d)
+	restored.AddJob(job.NewJob(noop1.Datum))
+	restored.Restore(run)
+	assert.Equal(t, history, restored.JobHistory(id))
+}
+
+func TestNextJobsWhileAdding(t *testing.T) {
+	d := dag.NewDAG("test noop chain", 1)
+
+	chain := NewChain(d)
+	noop1 := dag.NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	chain.MustAddNode(noop1)
+	chain.AddJob(job.NewJob(noop1.Datum))
+
+	// The next jobs never include a node added without its job yet.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 2; i < 500; i++ {
+			next := dag.NewNode(builtin.NewNoop(fmt.Sprint(i), ""), "next", 0, time.Duration(0))
+			b := &dag.Batch{}
+			b.AddNode(next)
+			b.SetUpstream(next, noop1)
+			assert.Nil(t, chain.AddBatch(b))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		for _, j := range chain.NextJobs(noop1.Datum.AtomID()) {
+			if j == nil {
+				t.Fatal("next job without a job")
+			}
+		}
+	}
+	assert.Len(t, chain.NextJobs(noop1.Datum.AtomID()), 498)
+}
@@ -0,0 +1,116 @@
+package chain
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/longsolong/flow/pkg/services/store"
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+)
+
+// markableFrom are the states an operator can mark a job from, by the state
+// it is marked; fewer than state.JobTransitions allows.
+var markableFrom = map[state.State]map[state.State]bool{
+	state.StateMarkSkipped: {
+		state.StateFail:      true,
+		state.StateException: true,
+		state.StateTimeout:   true,
+	},
+	state.StateMarkRetry: {
+		state.StateFail:        true,
+		state.StateException:   true,
+		state.StateTimeout:     true,
+		state.StateStopped:     true,
+		state.StateMarkSkipped: true,
+	},
+}
+
+// MarkJobSkipped marks a failed job skipped for an operator: its next jobs
+// run as if it succeeded. The running reaper is notified, like by NotifyGrown,
+// to enqueue them; a chain that is done must be run again, see
+// traverser.Resume. It returns workflow.ErrInvalidTransition, and marks
+// nothing, if the job didn't fail.
+func (c *Chain) MarkJobSkipped(atomID atom.AtomID, operator, reason string) error {
+	return c.mark(atomID, state.StateMarkSkipped, false, operator, reason)
+}
+
+// MarkJobRetry marks a failed, stopped or skipped job for an operator to run
+// again, and if downstream is true, every job after it that is done too:
+// those that ran are marked for retry, those that were ignored are reset to
+// run if their trigger rule is met again. Like MarkJobSkipped, it notifies the
+// running reaper, and returns workflow.ErrInvalidTransition, marking nothing,
+// if the job can't be retried or one of the jobs after it is running or
+// waiting for input.
+func (c *Chain) MarkJobRetry(atomID atom.AtomID, downstream bool, operator, reason string) error {
+	return c.mark(atomID, state.StateMarkRetry, downstream, operator, reason)
+}
+
+// Audit returns the operator actions on the jobs of the chain, oldest first.
+func (c *Chain) Audit() []store.Audit {
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
+	return append([]store.Audit(nil), c.audit...)
+}
+
+func (c *Chain) mark(atomID atom.AtomID, to state.State, downstream bool, operator, reason string) error {
+	if operator == "" {
+		return workflow.ErrNoOperator
+	}
+	defer c.flush()
+	c.DAG.VerticesMux.RLock()
+	defer c.DAG.VerticesMux.RUnlock()
+	c.jobsMux.Lock()
+	defer c.jobsMux.Unlock()
+
+	if _, ok := c.DAG.Vertices[atomID]; !ok {
+		return fmt.Errorf("%s: %w", atomID, workflow.ErrNotRegisteredNode)
+	}
+	from := c.jobs[atomID].State
+	if !markableFrom[to][from] {
+		return fmt.Errorf("%s: %w: %s to %s", atomID, workflow.ErrInvalidTransition, state.StateText[from], state.StateText[to])
+	}
+
+	// Check the whole subtree before marking any of it.
+	order := []atom.AtomID{atomID}
+	marks := map[atom.AtomID]state.State{atomID: to}
+	for i := 0; downstream && i < len(order); i++ {
+		next := c.DAG.Vertices[order[i]].Downstream()
+		nextIDs := make([]atom.AtomID, 0, len(next))
+		for nextID := range next {
+			if _, seen := marks[nextID]; !seen {
+				nextIDs = append(nextIDs, nextID)
+			}
+		}
+		sort.Slice(nextIDs, func(i, j int) bool { return nextIDs[i].Less(nextIDs[j]) })
+		for _, nextID := range nextIDs {
+			switch s := c.jobs[nextID].State; {
+			case s == state.StateIgnored:
+				marks[nextID] = state.StateUnknown
+			case state.JobDoneState[s]:
+				marks[nextID] = state.StateMarkRetry
+			case s == state.StateRunning || s == state.StateWaitInput:
+				return fmt.Errorf("%s: %w: %s is %s", atomID, workflow.ErrInvalidTransition, nextID, state.StateText[s])
+			default:
+				marks[nextID] = s // not run yet, left as is
+			}
+			order = append(order, nextID)
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, id := range order {
+		from := c.jobs[id].State
+		if from == marks[id] {
+			continue
+		}
+		audit := store.Audit{At: now, Operator: operator, AtomID: id, From: from, To: marks[id], Reason: reason}
+		c.audit = append(c.audit, audit)
+		c.setJobState(id, marks[id])
+		c.record(store.Transition{Kind: store.AuditTransition, AtomID: id, Audit: &audit, At: now})
+	}
+	c.NotifyGrown()
+	return nil
+}
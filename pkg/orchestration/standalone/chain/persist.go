@@ -0,0 +1,148 @@
+package chain
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/longsolong/flow/pkg/services/store"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+)
+
+// Persist saves a snapshot of the chain in s, then makes every later change of
+// the chain state, job states and tries durable by appending a transition to
+// it before the method making the change returns. run gives the request and
+// workflow of the chain; its state is taken from the chain. Persist must be
+// called before the chain runs.
+//
+// A change of the chain can't fail because it could not be saved: onError is
+// called with the error instead, e.g. to log it.
+func (c *Chain) Persist(s store.Store, run store.Run, onError func(err error)) error {
+	if err := s.SaveRun(c.Snapshot(run)); err != nil {
+		return err
+	}
+	c.runStore = s
+	c.runUUID = run.RequestUUID
+	c.onStoreError = onError
+	return nil
+}
+
+// Snapshot returns run with the current state of the chain, its jobs and
+// sequences.
+func (c *Chain) Snapshot(run store.Run) store.Run {
+	c.stateMux.RLock()
+	run.State = c.state
+	run.StartedAt = c.startedAt
+	run.FinishedAt = c.finishedAt
+	c.stateMux.RUnlock()
+
+	c.jobsMux.RLock()
+	c.triesMux.RLock()
+	run.Jobs = make([]store.Job, 0, len(c.jobs))
+	for atomID, j := range c.jobs {
+		run.Jobs = append(run.Jobs, store.Job{
+			AtomID:     atomID,
+			State:      j.State,
+			Tries:      c.totalJobTries[atomID],
+			StartedAt:  j.StartedAt,
+			FinishedAt: j.FinishedAt,
+			Outputs:    c.outputs[atomID].Copy(),
+			Branch:     copyBranch(c.branches[atomID]),
+			Input:      append(json.RawMessage(nil), c.inputs[atomID]...),
+			History:    append([]state.Transition(nil), c.history[atomID]...),
+		})
+	}
+	run.SequenceTries = make([]store.SequenceTries, 0, len(c.sequenceTries))
+	for sequenceID, tries := range c.sequenceTries {
+		run.SequenceTries = append(run.SequenceTries, store.SequenceTries{SequenceID: sequenceID, Tries: tries})
+	}
+	run.Audit = append([]store.Audit(nil), c.audit...)
+	c.triesMux.RUnlock()
+	c.jobsMux.RUnlock()
+
+	sort.Slice(run.Jobs, func(i, j int) bool { return run.Jobs[i].AtomID.Less(run.Jobs[j].AtomID) })
+	sort.Slice(run.SequenceTries, func(i, j int) bool {
+		return run.SequenceTries[i].SequenceID.Less(run.SequenceTries[j].SequenceID)
+	})
+	return run
+}
+
+// Restore sets the state of the chain, its jobs and sequences from a run
+// loaded from a store, e.g. to continue the run after a restart. Jobs of the
+// run that aren't in the chain, like jobs of a part of the graph that isn't
+// grown yet, are ignored.
+func (c *Chain) Restore(run store.Run) {
+	c.stateMux.Lock()
+	c.state = run.State
+	c.startedAt = run.StartedAt
+	c.finishedAt = run.FinishedAt
+	c.stateMux.Unlock()
+
+	c.jobsMux.Lock()
+	defer c.jobsMux.Unlock()
+	c.triesMux.Lock()
+	defer c.triesMux.Unlock()
+	for _, rj := range run.Jobs {
+		j, ok := c.jobs[rj.AtomID]
+		if !ok {
+			continue
+		}
+		j.State = rj.State
+		j.StartedAt = rj.StartedAt
+		j.FinishedAt = rj.FinishedAt
+		c.totalJobTries[rj.AtomID] = rj.Tries
+		if rj.Outputs != nil {
+			c.outputs[rj.AtomID] = rj.Outputs.Copy()
+		}
+		if rj.Branch != nil {
+			c.branches[rj.AtomID] = copyBranch(rj.Branch)
+		}
+		if rj.Input != nil {
+			c.inputs[rj.AtomID] = append(json.RawMessage(nil), rj.Input...)
+		}
+		if rj.History != nil {
+			c.history[rj.AtomID] = append([]state.Transition(nil), rj.History...)
+		}
+	}
+	c.audit = append([]store.Audit(nil), run.Audit...)
+	c.sequenceTries = make(map[atom.AtomID]uint, len(run.SequenceTries))
+	for _, st := range run.SequenceTries {
+		c.sequenceTries[st.SequenceID] = st.Tries
+	}
+}
+
+// record queues a transition of the chain to be appended to its store, if it
+// is persisted. Callers hold the lock of what changed so transitions are
+// queued in the order they happened, then call flush once they released it.
+func (c *Chain) record(t store.Transition) {
+	if c.runStore == nil {
+		return
+	}
+	t.RequestUUID = c.runUUID
+	c.recordMux.Lock()
+	c.queue = append(c.queue, t)
+	c.recordMux.Unlock()
+}
+
+// flush appends the queued transitions to the store, in order. It doesn't
+// return before the transitions queued when it is called are appended, even
+// if another flush appends them, so a change of the chain is saved once the
+// method making it returns. The chain locks aren't held meanwhile: readers of
+// the chain don't wait on the store.
+func (c *Chain) flush() {
+	if c.runStore == nil {
+		return
+	}
+	c.flushMux.Lock()
+	defer c.flushMux.Unlock()
+	c.recordMux.Lock()
+	queue := c.queue
+	c.queue = nil
+	c.recordMux.Unlock()
+
+	for _, t := range queue {
+		if _, err := c.runStore.AppendTransition(t); err != nil && c.onStoreError != nil {
+			c.onStoreError(err)
+		}
+	}
+}
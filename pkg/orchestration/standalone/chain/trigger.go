@@ -0,0 +1,148 @@
+package chain
+
+import (
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/dag"
+	"github.com/longsolong/flow/pkg/workflow/state"
+)
+
+// upstreamStates counts the upstream jobs of a job by what they mean for its
+// trigger rule. An upstream branch job that didn't choose the job counts as
+// StateIgnored.
+type upstreamStates struct {
+	total     int
+	ignored   int // StateIgnored
+	succeeded int // StateSuccess, StateMarkSkipped
+	complete  int // state.JobCompleteState
+	failed    int // StateFail, StateException, StateTimeout
+	done      int // state.JobDoneState
+	blocked   int // not run yet and never will
+}
+
+// final counts the upstream jobs whose state won't change anymore.
+func (u upstreamStates) final() int {
+	return u.done + u.blocked
+}
+
+// skipped returns true if a job with the rule is reachable only through
+// ignored jobs and untaken branches, so it is ignored too. TriggerAlways jobs
+// run anyway.
+func skipped(rule dag.TriggerRule, u upstreamStates) bool {
+	return rule != dag.TriggerAlways && u.total > 0 && u.ignored == u.total
+}
+
+// triggered returns whether the trigger rule of a node is met, and whether
+// it never will be given the final states of its upstream jobs.
+func triggered(rule dag.TriggerRule, u upstreamStates) (met bool, never bool) {
+	switch rule {
+	case dag.TriggerAllDone:
+		return u.done == u.total, u.blocked > 0
+	case dag.TriggerOneSuccess:
+		return u.succeeded > 0, u.succeeded == 0 && u.final() == u.total
+	case dag.TriggerOneFailed:
+		return u.failed > 0, u.failed == 0 && u.final() == u.total
+	case dag.TriggerNoneFailed:
+		return u.done == u.total && u.failed == 0, u.failed > 0 || u.blocked > 0
+	case dag.TriggerAlways:
+		return u.final() == u.total, false
+	default: // dag.TriggerAllSuccess
+		return u.complete == u.total, u.final() > u.complete
+	}
+}
+
+// upstreamStates counts the upstream jobs of a node. blocked memoizes
+// isBlocked across the recursion.
+func (c *Chain) upstreamStates(node *dag.Node, blocked map[atom.AtomID]bool) (u upstreamStates) {
+	// CALLER MUST LOCK c.DAG.VerticesMux and c.jobsMux!
+	for prevJobID := range node.Upstream() {
+		u.total++
+		s := c.jobs[prevJobID].State
+		if s == state.StateSuccess && !c.taken(prevJobID, node.Datum.AtomID()) {
+			s = state.StateIgnored
+		}
+		if s == state.StateIgnored {
+			u.ignored++
+		}
+		if s == state.StateSuccess || s == state.StateMarkSkipped {
+			u.succeeded++
+		}
+		if _, ok := state.JobCompleteState[s]; ok {
+			u.complete++
+		}
+		if s == state.StateFail || s == state.StateException || s == state.StateTimeout {
+			u.failed++
+		}
+		if _, ok := state.JobDoneState[s]; ok {
+			u.done++
+		} else if c.isBlocked(prevJobID, blocked) {
+			u.blocked++
+		}
+	}
+	return u
+}
+
+// taken returns false if the job is a branch job that didn't choose the next
+// job.
+func (c *Chain) taken(jobID, nextJobID atom.AtomID) bool {
+	// CALLER MUST LOCK c.jobsMux!
+	branch, ok := c.branches[jobID]
+	if !ok {
+		return true
+	}
+	for _, id := range branch {
+		if id == nextJobID {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlocked returns true if the job has not run and never will: its trigger
+// rule can't be met anymore.
+func (c *Chain) isBlocked(jobID atom.AtomID, blocked map[atom.AtomID]bool) bool {
+	// CALLER MUST LOCK c.DAG.VerticesMux and c.jobsMux!
+	if b, ok := blocked[jobID]; ok {
+		return b
+	}
+	b := false
+	if c.jobs[jobID].State == state.StateUnknown {
+		node := c.DAG.Vertices[jobID]
+		u := c.upstreamStates(node, blocked)
+		_, never := triggered(node.TriggerRule, u)
+		b = never || skipped(node.TriggerRule, u)
+	}
+	blocked[jobID] = b
+	return b
+}
+
+// IsIgnorable returns true if the job never will run because it is reachable
+// only through ignored jobs and untaken branches, or because its trigger rule
+// can't be met although none of its upstream jobs failed: e.g. a
+// TriggerOneFailed job when all its upstream jobs succeeded. Such a job is
+// ignored rather than counted as a failure of the chain.
+func (c *Chain) IsIgnorable(jobID atom.AtomID) bool {
+	c.DAG.VerticesMux.RLock()
+	defer c.DAG.VerticesMux.RUnlock()
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
+	if c.jobs[jobID].State != state.StateUnknown {
+		return false
+	}
+	node := c.DAG.Vertices[jobID]
+	u := c.upstreamStates(node, map[atom.AtomID]bool{})
+	if skipped(node.TriggerRule, u) {
+		return true
+	}
+	_, never := triggered(node.TriggerRule, u)
+	return never && u.complete == u.total
+}
+
+// IsBlocked returns true if the job has not run and never will because its
+// trigger rule can't be met anymore.
+func (c *Chain) IsBlocked(jobID atom.AtomID) bool {
+	c.DAG.VerticesMux.RLock()
+	defer c.DAG.VerticesMux.RUnlock()
+	c.jobsMux.RLock()
+	defer c.jobsMux.RUnlock()
+	return c.isBlocked(jobID, map[atom.AtomID]bool{})
+}
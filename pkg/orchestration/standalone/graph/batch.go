@@ -0,0 +1,51 @@
+package graph
+
+import (
+	"context"
+	"time"
+
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/dag"
+)
+
+// Batch grows the graph of a plotter while its chain may be running: the
+// nodes and edges of the batch are added at once by Commit, which then tells
+// the running reaper to enqueue the new runnable jobs. Nodes added with
+// Plotter.NewNode and edges set with dag.Node.SetUpstream are only safe
+// before the chain runs, e.g. in Begin.
+type Batch struct {
+	p     *Plotter
+	batch dag.Batch
+}
+
+// NewBatch ...
+func (p *Plotter) NewBatch() *Batch {
+	return &Batch{p: p}
+}
+
+// NewNode creates the atom and adds a node for it to the batch.
+func (b *Batch) NewNode(ctx context.Context, req *request.Request, step atom.Atom, name string, retry uint, retryWait time.Duration) (*dag.Node, error) {
+	if err := step.Create(ctx, req); err != nil {
+		return nil, err
+	}
+	node := dag.NewNode(step, name, retry, retryWait)
+	b.batch.AddNode(node)
+	return node, nil
+}
+
+// SetUpstream adds the edge upstream -> node to the batch. Either node can be
+// a node of the batch or of the graph.
+func (b *Batch) SetUpstream(node, upstream *dag.Node) {
+	b.batch.SetUpstream(node, upstream)
+}
+
+// Commit adds the nodes and edges of the batch to the graph, and their jobs
+// to the chain, at once. It adds nothing on error, see dag.DAG.Apply.
+func (b *Batch) Commit() error {
+	if err := b.p.Chain.AddBatch(&b.batch); err != nil {
+		return err
+	}
+	b.p.Chain.NotifyGrown()
+	return nil
+}
@@ -0,0 +1,146 @@
+package graph
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/dag"
+	"github.com/longsolong/flow/pkg/workflow/retry"
+	"github.com/longsolong/flow/pkg/workflow/state"
+)
+
+var (
+	// ErrInvalidTemplate is returned by Expand for a template edge that
+	// references a node out of the template.
+	ErrInvalidTemplate = errors.New("template edge references an unknown node")
+	// ErrExpandBeforeStarted is returned by Expand when a node the copies are
+	// wired before already started running.
+	ErrExpandBeforeStarted = errors.New("can't expand before a job that already started")
+)
+
+// Expander is implemented by plotters that expand the graph from the outputs
+// of a completed job, e.g. run one copy of a sub-DAG per item it outputs. The
+// running reaper calls ExpandAfter when a job completes, before enqueueing
+// its next jobs, so the copies can be wired between the job and its next
+// jobs. An error fails the job.
+type Expander interface {
+	ExpandAfter(ctx context.Context, req *request.Request, jobID atom.AtomID, outputs atom.Outputs) error
+}
+
+// Template is a sub-DAG Expand clones.
+type Template struct {
+	Name  string // tells the expansions of a graph apart, part of the ExpansionDigest of the copies
+	Nodes []TemplateNode
+	Edges [][2]int // from, to: indexes in Nodes
+}
+
+// TemplateNode is a node of a Template. See dag.Node for the meaning of the
+// fields.
+type TemplateNode struct {
+	Name        string
+	Retry       uint
+	RetryWait   time.Duration
+	Backoff     retry.Backoff
+	RetryIf     retry.Predicate
+	TriggerRule dag.TriggerRule
+	Pool        string
+	Priority    int
+	Timeout     time.Duration
+
+	// New makes the atom of the node in copy i, with the ExpansionDigest of
+	// the copy.
+	New func(i int, expansionDigest string) atom.Atom
+}
+
+// ExpansionDigest returns the ExpansionDigest of copy i of an expansion.
+func ExpansionDigest(name string, i int) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s/%d", name, i)))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Expand clones the template n times and wires each copy between existing
+// nodes: the nodes of the copy without upstream in the template run after
+// every from node, the nodes without downstream run before every to node. The
+// copies are added in a single Batch, with their jobs. The to nodes must not
+// have started running. Expand returns the nodes of each copy, in template
+// order.
+//
+// Call Expand from Begin, Grow, or the ExpandAfter of an Expander: when it is
+// called from Grow while the chain runs, a to node whose upstream jobs are
+// all complete may already be enqueued without the copies.
+func (p *Plotter) Expand(ctx context.Context, req *request.Request, tmpl Template, n int, from, to []atom.AtomID) ([][]*dag.Node, error) {
+	hasUpstream := make([]bool, len(tmpl.Nodes))
+	hasDownstream := make([]bool, len(tmpl.Nodes))
+	for _, e := range tmpl.Edges {
+		if e[0] < 0 || e[0] >= len(tmpl.Nodes) || e[1] < 0 || e[1] >= len(tmpl.Nodes) {
+			return nil, ErrInvalidTemplate
+		}
+		hasDownstream[e[0]] = true
+		hasUpstream[e[1]] = true
+	}
+	fromNodes := make([]*dag.Node, 0, len(from))
+	for _, id := range from {
+		node, err := p.DAG.GetNode(id)
+		if err != nil {
+			return nil, err
+		}
+		fromNodes = append(fromNodes, node)
+	}
+	toNodes := make([]*dag.Node, 0, len(to))
+	for _, id := range to {
+		node, err := p.DAG.GetNode(id)
+		if err != nil {
+			return nil, err
+		}
+		if p.Chain.JobState(id) != state.StateUnknown {
+			return nil, fmt.Errorf("%s: %w", id, ErrExpandBeforeStarted)
+		}
+		toNodes = append(toNodes, node)
+	}
+
+	b := p.NewBatch()
+	copies := make([][]*dag.Node, 0, n)
+	for i := 0; i < n; i++ {
+		digest := ExpansionDigest(tmpl.Name, i)
+		nodes := make([]*dag.Node, 0, len(tmpl.Nodes))
+		for _, tn := range tmpl.Nodes {
+			node, err := b.NewNode(ctx, req, tn.New(i, digest), tn.Name, tn.Retry, tn.RetryWait)
+			if err != nil {
+				return nil, err
+			}
+			node.Backoff = tn.Backoff
+			node.RetryIf = tn.RetryIf
+			node.TriggerRule = tn.TriggerRule
+			node.Pool = tn.Pool
+			node.Priority = tn.Priority
+			node.Timeout = tn.Timeout
+			nodes = append(nodes, node)
+		}
+		for _, e := range tmpl.Edges {
+			b.SetUpstream(nodes[e[1]], nodes[e[0]])
+		}
+		for j, node := range nodes {
+			if !hasUpstream[j] {
+				for _, fromNode := range fromNodes {
+					b.SetUpstream(node, fromNode)
+				}
+			}
+			if !hasDownstream[j] {
+				for _, toNode := range toNodes {
+					b.SetUpstream(toNode, node)
+				}
+			}
+		}
+		copies = append(copies, nodes)
+	}
+	if err := b.Commit(); err != nil {
+		return nil, err
+	}
+	return copies, nil
+}
@@ -17,14 +17,19 @@ type Grapher struct {
 }
 
 // NewGrapher A new Grapher should be made for every request.
+// It refuses to build a Grapher, and so to start a traverser, on a graph that
+// does not pass dag.Validate.
 func NewGrapher(
-	req *request.Request, d *dag.DAG, c *chain.Chain, p graph.GraphPlotter) *Grapher {
+	req *request.Request, d *dag.DAG, c *chain.Chain, p graph.GraphPlotter) (*Grapher, error) {
 
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
 	g := &Grapher{
 		Req: req,
 		DAG: d,
 		Chain: c,
 		GraphPlotter: p,
 	}
-	return g
+	return g, nil
 }
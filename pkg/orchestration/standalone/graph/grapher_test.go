@@ -1 +1,117 @@
 package graph
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/longsolong/flow/pkg/workflow/step/builtin"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPlotter struct {
+	Plotter
+}
+
+func (p *testPlotter) Begin(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+func (p *testPlotter) Grow(ctx context.Context) {
+	p.Plotter.Close()
+}
+
+func TestNewGrapherRefusesCycle(t *testing.T) {
+	req := request.NewRequest()
+	p := &testPlotter{Plotter: NewPlotter("test cyclic grapher", 1)}
+	noop1, err := p.NewNode(context.Background(), req, builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	assert.Nil(t, err)
+	noop2, err := p.NewNode(context.Background(), req, builtin.NewNoop("2", ""), "noop2", 0, time.Duration(0))
+	assert.Nil(t, err)
+	assert.Nil(t, noop2.SetUpstream(noop1))
+
+	g, err := NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, err)
+	assert.NotNil(t, g)
+
+	assert.Nil(t, noop1.SetUpstream(noop2))
+	g, err = NewGrapher(req, p.DAG, p.Chain, p)
+	assert.Nil(t, g)
+	assert.True(t, errors.Is(err, workflow.ErrCyclicGraph))
+}
+
+func TestNewNodeRefusesDuplicate(t *testing.T) {
+	req := request.NewRequest()
+	p := NewPlotter("test duplicate node", 1)
+	_, err := p.NewNode(context.Background(), req, builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	assert.Nil(t, err)
+	_, err = p.NewNode(context.Background(), req, builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	assert.Equal(t, workflow.ErrAlreadyRegisteredNode, err)
+}
+
+func TestExpand(t *testing.T) {
+	ctx := context.Background()
+	req := request.NewRequest()
+	p := &testPlotter{Plotter: NewPlotter("test expand", 1)}
+	first, err := p.NewNode(ctx, req, builtin.NewNoop("first", ""), "first", 0, time.Duration(0))
+	assert.Nil(t, err)
+	last, err := p.NewNode(ctx, req, builtin.NewNoop("last", ""), "last", 0, time.Duration(0))
+	assert.Nil(t, err)
+	assert.Nil(t, last.SetUpstream(first))
+
+	// a -> b, three times between first and last.
+	tmpl := Template{
+		Name: "ab",
+		Nodes: []TemplateNode{
+			{Name: "a", New: func(i int, expansionDigest string) atom.Atom { return builtin.NewNoop("a", expansionDigest) }},
+			{Name: "b", New: func(i int, expansionDigest string) atom.Atom { return builtin.NewNoop("b", expansionDigest) }},
+		},
+		Edges: [][2]int{{0, 1}},
+	}
+	copies, err := p.Expand(ctx, req, tmpl, 3, []atom.AtomID{first.Datum.AtomID()}, []atom.AtomID{last.Datum.AtomID()})
+	assert.Nil(t, err)
+	assert.Len(t, copies, 3)
+	assert.Len(t, p.Chain.AllJobs(), 8)
+	digests := map[string]bool{}
+	for i, nodes := range copies {
+		a, b := nodes[0], nodes[1]
+		assert.Equal(t, ExpansionDigest("ab", i), a.Datum.AtomID().ExpansionDigest)
+		digests[a.Datum.AtomID().ExpansionDigest] = true
+		assert.Contains(t, a.Upstream(), first.Datum.AtomID())
+		assert.Contains(t, b.Upstream(), a.Datum.AtomID())
+		assert.Contains(t, last.Upstream(), b.Datum.AtomID())
+		assert.NotContains(t, last.Upstream(), a.Datum.AtomID())
+	}
+	assert.Len(t, digests, 3)
+	assert.Nil(t, p.DAG.Validate())
+	select {
+	case <-p.Chain.Grown():
+	default:
+		t.Error("the chain wasn't told it grew")
+	}
+
+	// The same expansion again would add the same atoms.
+	_, err = p.Expand(ctx, req, tmpl, 1, nil, nil)
+	assert.Equal(t, workflow.ErrAlreadyRegisteredNode, err)
+
+	tmpl.Name, tmpl.Edges = "bad", [][2]int{{0, 2}}
+	_, err = p.Expand(ctx, req, tmpl, 1, nil, nil)
+	assert.Equal(t, ErrInvalidTemplate, err)
+
+	// Nor a cycle, and nothing of it is added.
+	tmpl.Name, tmpl.Edges = "cyclic", [][2]int{{0, 1}, {1, 0}}
+	_, err = p.Expand(ctx, req, tmpl, 1, nil, nil)
+	assert.True(t, errors.Is(err, workflow.ErrCyclicGraph), err)
+	assert.Len(t, p.Chain.AllJobs(), 8)
+	assert.Nil(t, p.DAG.Validate())
+
+	tmpl.Name, tmpl.Edges = "started", nil
+	assert.Nil(t, p.Chain.SetJobState(last.Datum.AtomID(), state.StateRunning))
+	_, err = p.Expand(ctx, req, tmpl, 1, nil, []atom.AtomID{last.Datum.AtomID()})
+	assert.True(t, errors.Is(err, ErrExpandBeforeStarted))
+}
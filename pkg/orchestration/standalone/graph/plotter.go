@@ -2,7 +2,6 @@ package graph
 
 import (
 	"context"
-	"github.com/longsolong/flow/pkg/orchestration/job"
 	"time"
 
 	"github.com/longsolong/flow/pkg/orchestration/request"
@@ -35,11 +34,13 @@ func (p *Plotter) Close() {
 }
 
 func (p *Plotter) NewNode(ctx context.Context, req *request.Request, step atom.Atom, name string, retry uint, retryWait time.Duration) (*dag.Node, error) {
-	if err := step.Create(ctx, req); err != nil {
+	b := p.NewBatch()
+	node, err := b.NewNode(ctx, req, step, name, retry, retryWait)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Chain.AddBatch(&b.batch); err != nil {
 		return nil, err
 	}
-	node := dag.NewNode(step, name, retry, retryWait)
-	p.DAG.MustAddNode(node)
-	p.Chain.AddJob(job.NewJob(step))
 	return node, nil
 }
@@ -0,0 +1,176 @@
+package spec
+
+import (
+	"context"
+	"time"
+
+	"github.com/faceair/jio"
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/graph"
+	"github.com/longsolong/flow/pkg/workflow/dag"
+)
+
+// argSchemas builds the jio schema of a request arg, by Arg.Type.
+var argSchemas = map[string]func(arg Arg) jio.Schema{
+	"string": func(arg Arg) jio.Schema {
+		s := jio.String()
+		if arg.Min != nil {
+			s = s.Min(int(*arg.Min))
+		}
+		if arg.Max != nil {
+			s = s.Max(int(*arg.Max))
+		}
+		if arg.Required {
+			return s.Required()
+		}
+		return s.Optional()
+	},
+	"number": func(arg Arg) jio.Schema {
+		return numberSchema(jio.Number(), arg)
+	},
+	"integer": func(arg Arg) jio.Schema {
+		return numberSchema(jio.Number().Integer(), arg)
+	},
+	"boolean": func(arg Arg) jio.Schema {
+		if arg.Required {
+			return jio.Bool().Required()
+		}
+		return jio.Bool().Optional()
+	},
+	"object": func(arg Arg) jio.Schema {
+		if arg.Required {
+			return jio.Object().Required()
+		}
+		return jio.Object().Optional()
+	},
+	"array": func(arg Arg) jio.Schema {
+		s := jio.Array()
+		if arg.Min != nil {
+			s = s.Min(int(*arg.Min))
+		}
+		if arg.Max != nil {
+			s = s.Max(int(*arg.Max))
+		}
+		if arg.Required {
+			return s.Required()
+		}
+		return s.Optional()
+	},
+}
+
+func numberSchema(s *jio.NumberSchema, arg Arg) jio.Schema {
+	if arg.Min != nil {
+		s = s.Min(*arg.Min)
+	}
+	if arg.Max != nil {
+		s = s.Max(*arg.Max)
+	}
+	if arg.Required {
+		return s.Required()
+	}
+	return s.Optional()
+}
+
+// Schema returns the jio schema of the raw request data of the workflow, in
+// the same shape as the schema of a hand-written workflow.
+func (s *Spec) Schema() jio.Schema {
+	args := jio.K{}
+	for name, arg := range s.RequestArgs {
+		args[name] = argSchemas[arg.Type](arg)
+	}
+	return jio.Object().Keys(jio.K{
+		"requestArgs": jio.Object().Keys(args),
+		"requestTags": jio.Array().Items(jio.Object().Keys(jio.K{
+			"name":  jio.String().Required(),
+			"value": jio.String().Required(),
+		})),
+	})
+}
+
+// NewGrapher makes a Grapher for one request of the workflow. It has the
+// same signature as the NewGrapher generated by gengrapher.
+func (s *Spec) NewGrapher(ctx context.Context, rawRequestData []byte) (*graph.Grapher, error) {
+	req, err := s.newRequest(ctx, rawRequestData)
+	if err != nil {
+		return nil, err
+	}
+	p := &plotter{Plotter: graph.NewPlotter(s.Name, s.Version), spec: s}
+	p.DAG.Timeout = time.Duration(s.Timeout)
+	if err := p.Begin(ctx, req); err != nil {
+		return nil, err
+	}
+	return graph.NewGrapher(req, p.DAG, p.Chain, p)
+}
+
+func (s *Spec) newRequest(ctx context.Context, rawRequestData []byte) (*request.Request, error) {
+	requestArgs, err := jio.ValidateJSON(&rawRequestData, s.Schema())
+	if err != nil {
+		return nil, err
+	}
+	req := request.NewRequestWithContext(ctx)
+	if args, ok := requestArgs["requestArgs"].(map[string]interface{}); ok {
+		req.RequestArgs = args
+	} else {
+		req.RequestArgs = map[string]interface{}{}
+	}
+	if tags, ok := requestArgs["requestTags"].([]interface{}); ok {
+		for _, v := range tags {
+			v := v.(map[string]interface{})
+			req.RequestTags = append(req.RequestTags, request.Tag{Name: v["name"].(string), Value: v["value"].(string)})
+		}
+	}
+	return req, nil
+}
+
+// plotter plots the nodes and edges of a spec.
+type plotter struct {
+	graph.Plotter
+	spec *Spec
+}
+
+// Begin ...
+func (p *plotter) Begin(ctx context.Context, req *request.Request) error {
+	nodes := make(map[string]*dag.Node, len(p.spec.Nodes))
+	for _, n := range p.spec.Nodes {
+		a, err := n.newAtom()
+		if err != nil {
+			return err
+		}
+		name := n.Name
+		if name == "" {
+			name = n.ID
+		}
+		node, err := p.NewNode(ctx, req, a, name, n.Retry, time.Duration(n.RetryWait))
+		if err != nil {
+			return err
+		}
+		node.TriggerRule = dag.TriggerRule(n.Trigger)
+		node.Pool = n.Pool
+		node.Priority = n.Priority
+		node.Timeout = time.Duration(n.Timeout)
+		if n.Backoff != nil {
+			// Checked by Spec.Check.
+			node.Backoff, _ = n.Backoff.Backoff()
+		}
+		node.RetryIf, _ = n.NoRetry.Predicate()
+		nodes[n.ID] = node
+	}
+	for _, n := range p.spec.Nodes {
+		if n.Sequence == "" {
+			continue
+		}
+		nodes[n.ID].SequenceID = nodes[n.Sequence].Datum.AtomID()
+		nodes[n.ID].SequenceRetry = n.SequenceRetry
+	}
+	for _, e := range p.spec.Edges {
+		if err := nodes[e.To].SetUpstream(nodes[e.From]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Grow ...
+func (p *plotter) Grow(ctx context.Context) {
+	p.Plotter.Close()
+}
@@ -0,0 +1,290 @@
+// Package spec loads declarative workflow definitions, written in YAML or
+// JSON, and plots them into a standalone graph.Grapher. Every node of a spec
+// names the AtomID.Type of a step registered with atom.Register, so a new
+// workflow made of existing steps needs no new Go code.
+package spec
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/dag"
+	"github.com/longsolong/flow/pkg/workflow/retry"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"gopkg.in/yaml.v2"
+
+	// builtin steps are always available to specs
+	_ "github.com/longsolong/flow/pkg/workflow/step/builtin"
+	_ "github.com/longsolong/flow/pkg/workflow/step/builtin/command"
+)
+
+var (
+	// ErrMissingName ...
+	ErrMissingName = errors.New("workflow spec has no name")
+
+	// ErrInvalidVersion ...
+	ErrInvalidVersion = errors.New("workflow spec version must be positive")
+
+	// ErrDuplicateNode ...
+	ErrDuplicateNode = errors.New("workflow spec has duplicate node id")
+
+	// ErrUnknownNode ...
+	ErrUnknownNode = errors.New("workflow spec references unknown node id")
+
+	// ErrUnknownArgType ...
+	ErrUnknownArgType = errors.New("workflow spec has unknown request arg type")
+
+	// ErrUnknownBackoff ...
+	ErrUnknownBackoff = errors.New("workflow spec has unknown backoff strategy")
+
+	// ErrUnknownState ...
+	ErrUnknownState = errors.New("workflow spec has unknown state")
+)
+
+// Spec is a declarative workflow definition.
+type Spec struct {
+	Namespace   string         `yaml:"namespace"`
+	Name        string         `yaml:"name"`
+	Version     int            `yaml:"version"`
+	Nodes       []Node         `yaml:"nodes"`
+	Edges       []Edge         `yaml:"edges"`
+	RequestArgs map[string]Arg `yaml:"requestArgs"`
+	Timeout     Duration       `yaml:"timeout"` // max run time of a run, 0 for none
+}
+
+// Node is a vertex of the workflow. See dag.Node for the meaning of the fields.
+type Node struct {
+	ID            string   `yaml:"id"`
+	Type          string   `yaml:"type"` // AtomID.Type of a registered atom
+	Name          string   `yaml:"name"`
+	Retry         uint     `yaml:"retry"`
+	RetryWait     Duration `yaml:"retryWait"`
+	Sequence      string   `yaml:"sequence"` // id of the first node in the sequence
+	SequenceRetry uint     `yaml:"sequenceRetry"`
+	Trigger       string   `yaml:"trigger"` // dag.TriggerRule, all_success by default
+	Pool          string   `yaml:"pool"`    // resource pool the node takes a slot of while it runs
+	Priority      int      `yaml:"priority"`
+	Timeout       Duration `yaml:"timeout"` // max run time of each try
+	Backoff       *Backoff `yaml:"backoff"` // wait before each retry, retryWait if not set
+	NoRetry       NoRetry  `yaml:"noRetry"`
+
+	Args map[string]interface{} `yaml:"args"` // set on the atom, which must be an atom.ArgsSetter
+}
+
+// newAtom makes the atom of the node, and sets its args.
+func (n Node) newAtom() (atom.Atom, error) {
+	a, err := atom.New(n.Type, n.ID, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(n.Args) == 0 {
+		return a, nil
+	}
+	setter, ok := a.(atom.ArgsSetter)
+	if !ok {
+		return nil, atom.ErrNoArgs
+	}
+	if err := setter.SetArgs(n.Args); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Backoff describes the retry.Backoff of a node.
+type Backoff struct {
+	Strategy string   `yaml:"strategy"` // constant, linear or exponential
+	Wait     Duration `yaml:"wait"`     // wait before the first retry
+	Step     Duration `yaml:"step"`     // linear: added to the wait before each next retry
+	Factor   float64  `yaml:"factor"`   // exponential: multiplies the wait before each next retry, 2 if not set
+	Max      Duration `yaml:"max"`      // longest wait, no limit if not set
+	Jitter   bool     `yaml:"jitter"`   // wait a random time up to the wait
+}
+
+// Backoff returns the retry.Backoff described.
+func (b *Backoff) Backoff() (retry.Backoff, error) {
+	var backoff retry.Backoff
+	switch b.Strategy {
+	case "", "constant":
+		backoff = retry.Constant(b.Wait)
+	case "linear":
+		backoff = retry.Linear{Initial: time.Duration(b.Wait), Step: time.Duration(b.Step)}
+	case "exponential":
+		backoff = retry.Exponential{Initial: time.Duration(b.Wait), Factor: b.Factor}
+	default:
+		return nil, fmt.Errorf("%s: %w", b.Strategy, ErrUnknownBackoff)
+	}
+	if b.Max > 0 {
+		backoff = retry.Capped{Backoff: backoff, Max: time.Duration(b.Max)}
+	}
+	if b.Jitter {
+		backoff = retry.Jitter{Backoff: backoff}
+	}
+	return backoff, nil
+}
+
+// NoRetry describes the failures of a node that aren't retried.
+type NoRetry struct {
+	States []string `yaml:"states"` // e.g. EXCEPTION
+	Exits  []int64  `yaml:"exits"`
+}
+
+// Predicate returns the retry.Predicate described, nil if it retries every
+// failure.
+func (n NoRetry) Predicate() (retry.Predicate, error) {
+	if len(n.States) == 0 && len(n.Exits) == 0 {
+		return nil, nil
+	}
+	states := make([]state.State, 0, len(n.States))
+	for _, text := range n.States {
+		s, ok := state.StateValue[text]
+		if !ok || !state.JobState[s] {
+			return nil, fmt.Errorf("%s: %w", text, ErrUnknownState)
+		}
+		states = append(states, s)
+	}
+	return retry.All(retry.NotOnStates(states...), retry.NotOnExits(n.Exits...)), nil
+}
+
+// Edge runs node To after node From.
+type Edge struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// Arg describes one of the request args accepted by the workflow.
+type Arg struct {
+	Type     string   `yaml:"type"` // string, number, integer, boolean, object or array
+	Required bool     `yaml:"required"`
+	Min      *float64 `yaml:"min"`
+	Max      *float64 `yaml:"max"`
+}
+
+// Duration is a time.Duration written as a string such as "10ms" or "1m30s".
+type Duration time.Duration
+
+// UnmarshalYAML ...
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Parse parses and checks a YAML or JSON workflow spec. Unknown fields are
+// an error so that typos don't go unnoticed.
+func Parse(data []byte) (*Spec, error) {
+	s := &Spec{}
+	if err := yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, err
+	}
+	if err := s.Check(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ParseFile ...
+func ParseFile(path string) (*Spec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Load parses every .yaml, .yml and .json file in dir. A dir that does not
+// exist holds no specs.
+func Load(dir string) ([]*Spec, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var specs []*Spec
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(fi.Name())) {
+		case ".yaml", ".yml", ".json":
+		default:
+			continue
+		}
+		s, err := ParseFile(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, s)
+	}
+	return specs, nil
+}
+
+// Check checks the spec itself. The structure of the graph it describes
+// (cycles, orphans...) is checked by dag.Validate when it is plotted.
+func (s *Spec) Check() error {
+	if s.Name == "" {
+		return ErrMissingName
+	}
+	if s.Version <= 0 {
+		return ErrInvalidVersion
+	}
+	nodes := make(map[string]bool, len(s.Nodes))
+	for _, n := range s.Nodes {
+		if nodes[n.ID] {
+			return fmt.Errorf("node %s: %w", n.ID, ErrDuplicateNode)
+		}
+		nodes[n.ID] = true
+		if _, err := n.newAtom(); err != nil {
+			return fmt.Errorf("node %s type %s: %w", n.ID, n.Type, err)
+		}
+		if !dag.TriggerRules[dag.TriggerRule(n.Trigger)] {
+			return fmt.Errorf("node %s trigger %s: %w", n.ID, n.Trigger, workflow.ErrUnknownTriggerRule)
+		}
+		if n.Backoff != nil {
+			if _, err := n.Backoff.Backoff(); err != nil {
+				return fmt.Errorf("node %s backoff: %w", n.ID, err)
+			}
+		}
+		if _, err := n.NoRetry.Predicate(); err != nil {
+			return fmt.Errorf("node %s noRetry: %w", n.ID, err)
+		}
+	}
+	for _, n := range s.Nodes {
+		if n.Sequence != "" && !nodes[n.Sequence] {
+			return fmt.Errorf("sequence %s of node %s: %w", n.Sequence, n.ID, ErrUnknownNode)
+		}
+	}
+	for _, e := range s.Edges {
+		if !nodes[e.From] {
+			return fmt.Errorf("edge from %s: %w", e.From, ErrUnknownNode)
+		}
+		if !nodes[e.To] {
+			return fmt.Errorf("edge to %s: %w", e.To, ErrUnknownNode)
+		}
+	}
+	for name, arg := range s.RequestArgs {
+		if _, ok := argSchemas[arg.Type]; !ok {
+			return fmt.Errorf("request arg %s type %s: %w", name, arg.Type, ErrUnknownArgType)
+		}
+	}
+	return nil
+}
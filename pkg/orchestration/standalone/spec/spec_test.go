@@ -0,0 +1,189 @@
+package spec
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/longsolong/flow/pkg/workflow/step/builtin"
+	"github.com/longsolong/flow/pkg/workflow/step/builtin/command"
+	"github.com/stretchr/testify/assert"
+)
+
+const diamond = `
+namespace: test
+name: diamond
+version: 2
+timeout: 1h
+nodes:
+  - id: a
+    type: builtin.Noop
+    sequence: a
+    sequenceRetry: 1
+  - id: b
+    type: builtin.Noop
+    name: left
+    retry: 3
+    retryWait: 1s
+    sequence: a
+    pool: db
+    priority: 2
+    timeout: 1m
+  - id: c
+    type: builtin.Noop
+    retry: 2
+    backoff: {strategy: exponential, wait: 1s, max: 3s}
+    noRetry: {states: [EXCEPTION], exits: [2]}
+  - id: d
+    type: builtin.Noop
+edges:
+  - {from: a, to: b}
+  - {from: a, to: c}
+  - {from: b, to: d}
+  - {from: c, to: d}
+requestArgs:
+  n:
+    type: integer
+    required: true
+    min: 1
+`
+
+var rawRequestData = []byte(`{
+	"requestArgs": {"n": 2},
+	"requestTags": [{"name": "aa", "value": "bb"}]
+}`)
+
+func TestParse(t *testing.T) {
+	s, err := Parse([]byte(diamond))
+	assert.Nil(t, err)
+	assert.Equal(t, "test", s.Namespace)
+	assert.Equal(t, "diamond", s.Name)
+	assert.Equal(t, 2, s.Version)
+	assert.Len(t, s.Nodes, 4)
+	assert.Equal(t, Duration(time.Second), s.Nodes[1].RetryWait)
+	assert.Len(t, s.Edges, 4)
+
+	s, err = Parse([]byte(`{
+		"name": "json",
+		"version": 1,
+		"nodes": [{"id": "a", "type": "builtin.Noop", "retryWait": "5ms"}]
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Duration(5*time.Millisecond), s.Nodes[0].RetryWait)
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse([]byte(`version: 1`))
+	assert.Equal(t, ErrMissingName, err)
+
+	_, err = Parse([]byte(`name: x`))
+	assert.Equal(t, ErrInvalidVersion, err)
+
+	_, err = Parse([]byte(`{name: x, version: 1, nodes: [{id: a, type: nope}]}`))
+	assert.True(t, errors.Is(err, atom.ErrNotRegisteredType))
+
+	_, err = Parse([]byte(`{name: x, version: 1, nodes: [{id: a, type: builtin.Noop}, {id: a, type: builtin.Noop}]}`))
+	assert.True(t, errors.Is(err, ErrDuplicateNode))
+
+	_, err = Parse([]byte(`{name: x, version: 1, nodes: [{id: a, type: builtin.Noop}], edges: [{from: a, to: b}]}`))
+	assert.True(t, errors.Is(err, ErrUnknownNode))
+
+	_, err = Parse([]byte(`{name: x, version: 1, requestArgs: {n: {type: float}}}`))
+	assert.True(t, errors.Is(err, ErrUnknownArgType))
+
+	_, err = Parse([]byte(`{name: x, version: 1, nodes: [{id: a, type: builtin.Noop, trigger: most_success}]}`))
+	assert.True(t, errors.Is(err, workflow.ErrUnknownTriggerRule))
+
+	_, err = Parse([]byte(`{name: x, version: 1, nodes: [{id: a, type: builtin.Noop, backoff: {strategy: random}}]}`))
+	assert.True(t, errors.Is(err, ErrUnknownBackoff))
+
+	_, err = Parse([]byte(`{name: x, version: 1, nodes: [{id: a, type: builtin.Noop, noRetry: {states: [BROKEN]}}]}`))
+	assert.True(t, errors.Is(err, ErrUnknownState))
+
+	_, err = Parse([]byte(`{name: x, version: 1, nodes: [{id: a, type: builtin.Noop, retries: 1}]}`))
+	assert.NotNil(t, err)
+
+	_, err = Parse([]byte(`{name: x, version: 1, nodes: [{id: a, type: builtin.Noop, args: {n: 1}}]}`))
+	assert.True(t, errors.Is(err, atom.ErrNoArgs))
+
+	_, err = Parse([]byte(`{name: x, version: 1, nodes: [{id: a, type: command.ShellCommand, args: {cmd: ls}}]}`))
+	assert.True(t, errors.Is(err, atom.ErrUnknownArg))
+}
+
+func TestNewGrapher(t *testing.T) {
+	s, err := Parse([]byte(diamond))
+	assert.Nil(t, err)
+
+	g, err := s.NewGrapher(context.Background(), rawRequestData)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(2), g.Req.RequestArgs["n"])
+	assert.Equal(t, "bb", g.Req.RequestTags[0].Value)
+	assert.Equal(t, "diamond", g.DAG.Name)
+	assert.Equal(t, time.Hour, g.DAG.Timeout)
+
+	a := g.DAG.MustGetNode(builtin.NewNoop("a", "").AtomID())
+	b := g.DAG.MustGetNode(builtin.NewNoop("b", "").AtomID())
+	d := g.DAG.MustGetNode(builtin.NewNoop("d", "").AtomID())
+	assert.Equal(t, "left", b.Name)
+	assert.Equal(t, uint(3), b.Retry)
+	assert.Equal(t, time.Second, b.RetryWait)
+	assert.Equal(t, "db", b.Pool)
+	assert.Equal(t, 2, b.Priority)
+	assert.Equal(t, time.Minute, b.Timeout)
+	assert.Equal(t, time.Second, b.RetryBackoff().Wait(3))
+	c := g.DAG.MustGetNode(builtin.NewNoop("c", "").AtomID())
+	assert.Equal(t, 2*time.Second, c.RetryBackoff().Wait(2))
+	assert.Equal(t, 3*time.Second, c.RetryBackoff().Wait(3))
+	assert.True(t, c.RetryIf(atom.Return{State: state.StateFail, Exit: 1}))
+	assert.False(t, c.RetryIf(atom.Return{State: state.StateFail, Exit: 2}))
+	assert.False(t, c.RetryIf(atom.Return{State: state.StateException}))
+	assert.Equal(t, a.Datum.AtomID(), b.SequenceID)
+	assert.Equal(t, uint(1), a.SequenceRetry)
+	assert.Len(t, d.Upstream(), 2)
+	assert.Len(t, g.Chain.RunnableJobs(), 1)
+
+	_, err = s.NewGrapher(context.Background(), []byte(`{"requestArgs": {"n": 0}, "requestTags": []}`))
+	assert.NotNil(t, err)
+}
+
+func TestNewGrapherArgs(t *testing.T) {
+	s, err := Parse([]byte(`
+name: shell
+version: 1
+nodes:
+  - id: count
+    type: command.ShellCommand
+    args:
+      argv: [wc, -l, "{{.file}}"]
+      env: [LC_ALL=C]
+      dir: /tmp
+`))
+	assert.Nil(t, err)
+	g, err := s.NewGrapher(context.Background(), []byte(`{"requestArgs": {"file": "a.txt"}, "requestTags": []}`))
+	assert.Nil(t, err)
+	node := g.DAG.MustGetNode(command.NewShellCommand("count", "").AtomID())
+	count := node.Datum.(*command.ShellCommand)
+	assert.Equal(t, []string{"wc", "-l", "{{.file}}"}, count.Argv)
+	assert.Equal(t, []string{"LC_ALL=C"}, count.Env)
+	assert.Equal(t, "/tmp", count.Dir)
+}
+
+func TestNewGrapherInvalidGraph(t *testing.T) {
+	s, err := Parse([]byte(`
+name: cyclic
+version: 1
+nodes:
+  - {id: a, type: builtin.Noop}
+  - {id: b, type: builtin.Noop}
+edges:
+  - {from: a, to: b}
+  - {from: b, to: a}
+`))
+	assert.Nil(t, err)
+	_, err = s.NewGrapher(context.Background(), []byte(`{"requestArgs": {}, "requestTags": []}`))
+	assert.True(t, errors.Is(err, workflow.ErrCyclicGraph))
+}
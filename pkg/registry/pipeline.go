@@ -0,0 +1,57 @@
+package registry
+
+import (
+	"context"
+
+	pipe "github.com/longsolong/flow/pkg/execution/pipeline"
+	"github.com/longsolong/flow/pkg/infra"
+)
+
+// PipelineConstructor makes the Pipeline of one request of a pipeline workflow.
+type PipelineConstructor func(ctx context.Context, rawRequestData []byte) (pipe.Pipeline, error)
+
+// Pipeline holds the PipelineConstructor of every pipeline workflow.
+var Pipeline = New()
+
+// RegisterPipeline ...
+func RegisterPipeline(namespace, name string, version int, constructor PipelineConstructor) error {
+	return Pipeline.Register(Key{Namespace: namespace, Name: name, Version: version}, constructor)
+}
+
+// MustRegisterPipeline ...
+func MustRegisterPipeline(namespace, name string, version int, constructor PipelineConstructor) {
+	if err := RegisterPipeline(namespace, name, version, constructor); err != nil {
+		panic(err)
+	}
+}
+
+// LookupPipeline ...
+func LookupPipeline(namespace, name string, version int) (PipelineConstructor, Key, error) {
+	constructor, key, err := Pipeline.Lookup(Key{Namespace: namespace, Name: name, Version: version})
+	if err != nil {
+		return nil, key, err
+	}
+	return constructor.(PipelineConstructor), key, nil
+}
+
+// PipelineFactory ...
+var PipelineFactory = pipelineFactory{}
+
+// pipelineFactory ...
+type pipelineFactory struct{}
+
+// Make makes the Pipeline of a registered workflow and runs it.
+// Version 0 means the latest registered version.
+func (pf *pipelineFactory) Make(ctx context.Context, logger *infra.Logger, namespace, name string, version int, rawRequestData []byte) (p pipe.Pipeline, err error) {
+	constructor, _, err := LookupPipeline(namespace, name, version)
+	if err != nil {
+		return nil, err
+	}
+	p, err = constructor(ctx, rawRequestData)
+	if err != nil {
+		return nil, err
+	}
+	err = p.Run(ctx)
+
+	return p, err
+}
@@ -0,0 +1,121 @@
+// Package registry maps workflows, identified by namespace, name and
+// version, to their constructors. Workflow packages register themselves in
+// an init function, so adding a workflow never means editing a factory;
+// importing the package is enough.
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrAlreadyRegistered ...
+	ErrAlreadyRegistered = errors.New("already registered workflow")
+
+	// ErrNotRegistered ...
+	ErrNotRegistered = errors.New("not registered workflow")
+)
+
+// Key identifies one version of a workflow.
+type Key struct {
+	Namespace string
+	Name      string
+	Version   int
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%s.%s.%d", k.Namespace, k.Name, k.Version)
+}
+
+// Registry stores one constructor per Key. The type of the constructors is
+// up to the caller; see Standalone and Pipeline.
+type Registry struct {
+	entries    map[Key]interface{}
+	entriesMux *sync.RWMutex // for access to entries map
+}
+
+// New ...
+func New() *Registry {
+	return &Registry{
+		entries:    make(map[Key]interface{}),
+		entriesMux: &sync.RWMutex{},
+	}
+}
+
+// Register ...
+func (r *Registry) Register(key Key, constructor interface{}) error {
+	if key.Version <= 0 {
+		return fmt.Errorf("%s: version must be positive", key)
+	}
+	r.entriesMux.Lock()
+	defer r.entriesMux.Unlock()
+	if _, ok := r.entries[key]; ok {
+		return fmt.Errorf("%s: %w", key, ErrAlreadyRegistered)
+	}
+	r.entries[key] = constructor
+	return nil
+}
+
+// Lookup returns the constructor registered under key. A key with version 0
+// resolves to the latest registered version of the workflow. The returned
+// Key is the resolved one.
+func (r *Registry) Lookup(key Key) (interface{}, Key, error) {
+	r.entriesMux.RLock()
+	defer r.entriesMux.RUnlock()
+	if key.Version == 0 {
+		latest, err := r.latest(key.Namespace, key.Name)
+		if err != nil {
+			return nil, key, err
+		}
+		key = latest
+	}
+	constructor, ok := r.entries[key]
+	if !ok {
+		return nil, key, fmt.Errorf("%s: %w", key, ErrNotRegistered)
+	}
+	return constructor, key, nil
+}
+
+// Latest returns the key of the highest registered version of a workflow.
+func (r *Registry) Latest(namespace, name string) (Key, error) {
+	r.entriesMux.RLock()
+	defer r.entriesMux.RUnlock()
+	return r.latest(namespace, name)
+}
+
+func (r *Registry) latest(namespace, name string) (Key, error) {
+	// CALLER MUST LOCK r.entriesMux!
+	found := Key{Namespace: namespace, Name: name}
+	for key := range r.entries {
+		if key.Namespace == namespace && key.Name == name && key.Version > found.Version {
+			found = key
+		}
+	}
+	if found.Version == 0 {
+		return found, fmt.Errorf("%s.%s: %w", namespace, name, ErrNotRegistered)
+	}
+	return found, nil
+}
+
+// List returns every registered key ordered by namespace, name and version.
+func (r *Registry) List() []Key {
+	r.entriesMux.RLock()
+	defer r.entriesMux.RUnlock()
+	keys := make([]Key, 0, len(r.entries))
+	for key := range r.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Namespace != keys[j].Namespace {
+			return keys[i].Namespace < keys[j].Namespace
+		}
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].Version < keys[j].Version
+	})
+	return keys
+}
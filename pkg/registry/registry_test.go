@@ -0,0 +1,46 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New()
+	assert.Nil(t, r.Register(Key{"ns", "flow", 1}, "v1"))
+	assert.Nil(t, r.Register(Key{"ns", "flow", 3}, "v3"))
+	assert.Nil(t, r.Register(Key{"ns", "flow", 2}, "v2"))
+	assert.Nil(t, r.Register(Key{"other", "flow", 7}, "other"))
+
+	err := r.Register(Key{"ns", "flow", 2}, "again")
+	assert.True(t, errors.Is(err, ErrAlreadyRegistered))
+	assert.NotNil(t, r.Register(Key{"ns", "flow", 0}, "zero"))
+
+	c, key, err := r.Lookup(Key{"ns", "flow", 2})
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", c)
+	assert.Equal(t, Key{"ns", "flow", 2}, key)
+
+	c, key, err = r.Lookup(Key{"ns", "flow", 0})
+	assert.Nil(t, err)
+	assert.Equal(t, "v3", c)
+	assert.Equal(t, Key{"ns", "flow", 3}, key)
+
+	_, _, err = r.Lookup(Key{"ns", "flow", 4})
+	assert.True(t, errors.Is(err, ErrNotRegistered))
+	_, _, err = r.Lookup(Key{"ns", "missing", 0})
+	assert.True(t, errors.Is(err, ErrNotRegistered))
+
+	latest, err := r.Latest("other", "flow")
+	assert.Nil(t, err)
+	assert.Equal(t, 7, latest.Version)
+
+	assert.Equal(t, []Key{
+		{"ns", "flow", 1},
+		{"ns", "flow", 2},
+		{"ns", "flow", 3},
+		{"other", "flow", 7},
+	}, r.List())
+}
@@ -0,0 +1,252 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/longsolong/flow/pkg/execution/standalone/scheduler"
+	"github.com/longsolong/flow/pkg/execution/standalone/traverser"
+	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/orchestration/standalone/graph"
+	"github.com/longsolong/flow/pkg/services/store"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"go.uber.org/zap"
+)
+
+// GrapherConstructor makes the Grapher of one request of a standalone
+// workflow, e.g. the NewGrapher generated by gengrapher.
+type GrapherConstructor func(ctx context.Context, rawRequestData []byte) (*graph.Grapher, error)
+
+// Standalone holds the GrapherConstructor of every standalone workflow.
+var Standalone = New()
+
+// RegisterGrapher ...
+func RegisterGrapher(namespace, name string, version int, constructor GrapherConstructor) error {
+	return Standalone.Register(Key{Namespace: namespace, Name: name, Version: version}, constructor)
+}
+
+// MustRegisterGrapher ...
+func MustRegisterGrapher(namespace, name string, version int, constructor GrapherConstructor) {
+	if err := RegisterGrapher(namespace, name, version, constructor); err != nil {
+		panic(err)
+	}
+}
+
+// LookupGrapher ...
+func LookupGrapher(namespace, name string, version int) (GrapherConstructor, Key, error) {
+	constructor, key, err := Standalone.Lookup(Key{Namespace: namespace, Name: name, Version: version})
+	if err != nil {
+		return nil, key, err
+	}
+	return constructor.(GrapherConstructor), key, nil
+}
+
+// DefaultTimeout is how long the traversers of the runs the factory starts
+// wait for their jobs to stop, and for a done job to be reaped, unless set
+// otherwise with SetTimeouts.
+const DefaultTimeout = 10 * time.Second
+
+// SingleProcessorFactory ...
+var SingleProcessorFactory = singleProcessorFactory{stopTimeout: DefaultTimeout, sendTimeout: DefaultTimeout}
+
+// singleProcessorFactory ...
+type singleProcessorFactory struct {
+	runStore    store.Store          // persists started runs if not nil
+	limits      traverser.Limits     // bounds the jobs each run runs at once
+	scheduler   *scheduler.Scheduler // shares the running slots of the process between runs if not nil
+	stopTimeout time.Duration        // time traversers wait for jobs to stop
+	sendTimeout time.Duration        // time traversers wait for a done job to be reaped
+}
+
+// SetStore makes the factory persist the runs it starts in s. Call it before
+// starting any run.
+func (gf *singleProcessorFactory) SetStore(s store.Store) {
+	gf.runStore = s
+}
+
+// SetLimits bounds the jobs each run the factory starts runs at once. Call it
+// before starting any run.
+func (gf *singleProcessorFactory) SetLimits(l traverser.Limits) {
+	gf.limits = l
+}
+
+// SetScheduler makes the runs the factory starts share the running slots of
+// s, by the namespace of their workflow. Call it before starting any run.
+func (gf *singleProcessorFactory) SetScheduler(s *scheduler.Scheduler) {
+	gf.scheduler = s
+}
+
+// SetTimeouts sets how long the traversers of the runs the factory starts wait
+// for their jobs to stop, and for a done job to be reaped, see
+// traverser.NewTraverser. Call it before starting any run.
+func (gf *singleProcessorFactory) SetTimeouts(stop, send time.Duration) {
+	gf.stopTimeout = stop
+	gf.sendTimeout = send
+}
+
+// MakeGrapher makes the Grapher of a registered workflow without running it.
+// Version 0 means the latest registered version.
+func (gf *singleProcessorFactory) MakeGrapher(ctx context.Context, namespace, name string, version int, rawRequestData []byte) (*graph.Grapher, error) {
+	constructor, _, err := LookupGrapher(namespace, name, version)
+	if err != nil {
+		return nil, err
+	}
+	return constructor(ctx, rawRequestData)
+}
+
+// Start makes the Grapher of a registered workflow and runs it in the
+// background. The returned traverser is running; use its Done channel to wait
+// for the end of the run.
+func (gf *singleProcessorFactory) Start(ctx context.Context, logger *infra.Logger, namespace, name string, version int, rawRequestData []byte) (*traverser.Traverser, error) {
+	constructor, key, err := LookupGrapher(namespace, name, version)
+	if err != nil {
+		return nil, err
+	}
+	g, err := constructor(ctx, rawRequestData)
+	if err != nil {
+		return nil, err
+	}
+	t, err := gf.newTraverser(logger, g, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	go g.GraphPlotter.Grow(ctx)
+	go t.Run(ctx)
+
+	return t, nil
+}
+
+// Resume continues a persisted run, e.g. one that was running when the
+// process running it died. It makes the Grapher again from the request the run
+// was started with, restores the state of its chain and runs it in the
+// background; the jobs that were running are run again (see
+// traverser.Recover). The graph is expanded again after the jobs that
+// succeeded, like it was while the run was running.
+func (gf *singleProcessorFactory) Resume(ctx context.Context, logger *infra.Logger, run store.Run) (*traverser.Traverser, error) {
+	requestUUID, err := uuid.Parse(run.RequestUUID)
+	if err != nil {
+		return nil, err
+	}
+	constructor, key, err := LookupGrapher(run.Namespace, run.Name, run.Version)
+	if err != nil {
+		return nil, err
+	}
+	rawRequestData, err := rawRequest(run)
+	if err != nil {
+		return nil, err
+	}
+	g, err := constructor(ctx, rawRequestData)
+	if err != nil {
+		return nil, err
+	}
+	g.Req.RequestUUID = requestUUID
+	if err := reexpand(ctx, g, run); err != nil {
+		return nil, err
+	}
+	g.Chain.Restore(run)
+
+	t, err := gf.newTraverser(logger, g, key, run.LastSeq)
+	if err != nil {
+		return nil, err
+	}
+	t.Recover()
+	go g.GraphPlotter.Grow(ctx)
+	go t.Run(ctx)
+
+	return t, nil
+}
+
+// newTraverser returns a traverser of g, persisting its chain if the factory
+// has a store. lastSeq is the Seq of the last transition of a resumed run,
+// which its restored chain includes, 0 for a new run.
+func (gf *singleProcessorFactory) newTraverser(logger *infra.Logger, g *graph.Grapher, key Key, lastSeq uint64) (*traverser.Traverser, error) {
+	if gf.runStore != nil {
+		run := store.Run{
+			RequestUUID: g.Req.RequestUUID.String(),
+			Namespace:   key.Namespace,
+			Name:        key.Name,
+			Version:     key.Version,
+			RequestArgs: g.Req.RequestArgs,
+			RequestTags: g.Req.RequestTags,
+			LastSeq:     lastSeq,
+		}
+		onError := func(err error) {
+			logger.Log.Error("saving chain transition failed",
+				zap.String("request_id", run.RequestUUID), zap.Error(err))
+		}
+		if err := g.Chain.Persist(gf.runStore, run, onError); err != nil {
+			return nil, err
+		}
+	}
+	t := traverser.NewTraverser(g, logger, gf.stopTimeout, gf.sendTimeout)
+	t.SetLimits(gf.limits)
+	if gf.scheduler != nil {
+		t.SetScheduler(gf.scheduler, key.Namespace)
+	}
+	return t, nil
+}
+
+// reexpand calls the Expander of the grapher of a resumed run, if it has one,
+// after each job that succeeded in the run, until no more job of the run is
+// added to the graph: the copies expanded after a job can expand in turn.
+func reexpand(ctx context.Context, g *graph.Grapher, run store.Run) error {
+	expander, ok := g.GraphPlotter.(graph.Expander)
+	if !ok {
+		return nil
+	}
+	expanded := make(map[atom.AtomID]bool)
+	for {
+		n := len(expanded)
+		for _, rj := range run.Jobs {
+			if expanded[rj.AtomID] || rj.State != state.StateSuccess {
+				continue
+			}
+			if _, err := g.DAG.GetNode(rj.AtomID); err != nil {
+				continue // not expanded yet
+			}
+			expanded[rj.AtomID] = true
+			if err := expander.ExpandAfter(ctx, g.Req, rj.AtomID, rj.Outputs); err != nil {
+				return err
+			}
+		}
+		if len(expanded) == n {
+			return nil
+		}
+	}
+}
+
+// rawRequest rebuilds the body of the run flow request of a run.
+func rawRequest(run store.Run) ([]byte, error) {
+	requestTags := make([]map[string]string, 0, len(run.RequestTags))
+	for _, tag := range run.RequestTags {
+		requestTags = append(requestTags, map[string]string{"name": tag.Name, "value": tag.Value})
+	}
+	requestArgs := run.RequestArgs
+	if requestArgs == nil {
+		requestArgs = map[string]interface{}{}
+	}
+	return json.Marshal(map[string]interface{}{
+		"primaryRequestArgs": map[string]interface{}{
+			"namespace": run.Namespace,
+			"name":      run.Name,
+			"version":   run.Version,
+		},
+		"requestArgs": requestArgs,
+		"requestTags": requestTags,
+	})
+}
+
+// Make makes the Grapher of a registered workflow and runs it to the end.
+func (gf *singleProcessorFactory) Make(ctx context.Context, logger *infra.Logger, namespace, name string, version int, rawRequestData []byte) (*graph.Grapher, error) {
+	t, err := gf.Start(ctx, logger, namespace, name, version, rawRequestData)
+	if err != nil {
+		return nil, err
+	}
+	<-t.Done()
+
+	return t.Grapher(), nil
+}
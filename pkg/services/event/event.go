@@ -0,0 +1,288 @@
+// Package event publishes the lifecycle events of chains and their jobs to
+// subscribers, e.g. to export metrics, notify people or stream the progress of
+// runs, without them being wired in the traverser, reapers and runners.
+package event
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+)
+
+// Kind ...
+type Kind string
+
+// Kind const ...
+const (
+	ChainStarted    Kind = "chain_started"     // the chain runs, or runs again once resumed
+	ChainFinished   Kind = "chain_finished"    // the chain was finalized in State
+	JobEnqueued     Kind = "job_enqueued"      // the job is runnable, it waits to run
+	JobStarted      Kind = "job_started"       // a try of the job runs
+	JobTryFailed    Kind = "job_try_failed"    // a try of the job ended in State, not a success
+	JobRetryWaiting Kind = "job_retry_waiting" // the job waits Wait before its next try
+	JobFinished     Kind = "job_finished"      // the job was reaped in State
+	SequenceRetried Kind = "sequence_retried"  // the sequence of AtomID runs again
+	GraphGrown      Kind = "graph_grown"       // Jobs jobs were added to the chain
+)
+
+// Event is something that happened to a chain, or to one of its jobs.
+type Event struct {
+	Seq         uint64 // set by the bus, increasing
+	Kind        Kind
+	RequestUUID string
+	AtomID      atom.AtomID   // the job, or the sequence start job; empty for chain events
+	State       state.State   // chain or job state, for finished and try failed events
+	Try         uint          // total tries of the job, for job started, try failed and retry waiting
+	Wait        time.Duration // for retry waiting
+	Jobs        int           // for graph grown
+	Error       string        `json:",omitempty"`
+	At          time.Time
+}
+
+const (
+	// History is how many of the last events of each run a bus keeps, to
+	// replay them to the subscribers resuming after an event, see
+	// SubscribeAfter.
+	History = 1024
+
+	// HistoryRuns is how many runs a bus keeps the events of: the events of
+	// the run that published longest ago are dropped first.
+	HistoryRuns = 256
+)
+
+// Filter selects events. Zero fields match every event.
+type Filter struct {
+	RequestUUID string
+	Kinds       []Kind // event kind is any of them
+}
+
+// Match reports whether e is selected by the filter.
+func (f Filter) Match(e Event) bool {
+	if f.RequestUUID != "" && f.RequestUUID != e.RequestUUID {
+		return false
+	}
+	if len(f.Kinds) == 0 {
+		return true
+	}
+	for _, kind := range f.Kinds {
+		if kind == e.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// Bus fans the events published to it out to its subscribers. Publish never
+// blocks: each subscription buffers a bounded number of events, and the
+// events it has no room for are dropped, see Subscription.Dropped. A nil *Bus
+// drops every event, so events can be published whether or not anyone
+// listens.
+type Bus struct {
+	mux     *sync.Mutex
+	seq     uint64
+	history map[string]*history // request UUID -> its last events
+	evicted uint64              // Seq of the last event dropped from the history
+	subs    map[*Subscription]bool
+}
+
+// history is the events of one run a Bus keeps.
+type history struct {
+	events  []Event // the last History events, oldest first
+	evicted uint64  // Seq of the last event dropped
+}
+
+// NewBus ...
+func NewBus() *Bus {
+	return &Bus{
+		mux:     &sync.Mutex{},
+		history: make(map[string]*history),
+		subs:    make(map[*Subscription]bool),
+	}
+}
+
+// Publish sets the Seq of e, and its At if it is zero, and sends it to the
+// subscriptions it matches.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.At.IsZero() {
+		e.At = time.Now().UTC()
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.seq++
+	e.Seq = b.seq
+	b.keep(e)
+	for s := range b.subs {
+		if !s.filter.Match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns a subscription to the events published from now on that
+// match filter. It buffers up to size events not received yet; size is at
+// least 1.
+func (b *Bus) Subscribe(filter Filter, size int) *Subscription {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.subscribe(filter, size, nil)
+}
+
+// SubscribeAfter is like Subscribe, but the subscription first receives the
+// events the bus still keeps that were published after the event with Seq
+// after, e.g. to resume a stream of events without missing any. The buffer
+// has room for those on top of size. If the bus no longer keeps all of them,
+// see History and HistoryRuns, the subscription is Incomplete. So is it for
+// an after past the last event, e.g. from before the process restarted; it
+// replays every event kept.
+func (b *Bus) SubscribeAfter(filter Filter, size int, after uint64) *Subscription {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	incomplete := false
+	if after > b.seq {
+		after = 0
+		incomplete = true
+	}
+	var missed []Event
+	if filter.RequestUUID != "" {
+		h, ok := b.history[filter.RequestUUID]
+		if !ok {
+			// Its events were all dropped, if it published any.
+			incomplete = incomplete || after > 0
+		} else {
+			incomplete = incomplete || after < h.evicted
+			missed = h.matching(filter, after)
+		}
+	} else {
+		incomplete = incomplete || after < b.evicted
+		for _, h := range b.history {
+			missed = append(missed, h.matching(filter, after)...)
+		}
+		sort.Slice(missed, func(i, j int) bool { return missed[i].Seq < missed[j].Seq })
+	}
+	s := b.subscribe(filter, size, missed)
+	s.incomplete = incomplete
+	return s
+}
+
+func (b *Bus) subscribe(filter Filter, size int, missed []Event) *Subscription {
+	// CALLER MUST LOCK b.mux!
+	if size < 1 {
+		size = 1
+	}
+	s := &Subscription{
+		bus:    b,
+		filter: filter,
+		events: make(chan Event, len(missed)+size),
+	}
+	for _, e := range missed {
+		s.events <- e
+	}
+	b.subs[s] = true
+	return s
+}
+
+// keep adds e to the history of its run, dropping the oldest events of the
+// run past History, and the events of the run that published longest ago
+// past HistoryRuns.
+func (b *Bus) keep(e Event) {
+	// CALLER MUST LOCK b.mux!
+	h, ok := b.history[e.RequestUUID]
+	if !ok {
+		if len(b.history) >= HistoryRuns {
+			b.evictRun()
+		}
+		h = &history{}
+		b.history[e.RequestUUID] = h
+	}
+	h.events = append(h.events, e)
+	if n := len(h.events) - History; n > 0 {
+		h.evicted = h.events[n-1].Seq
+		b.evict(h.evicted)
+		h.events = append([]Event(nil), h.events[n:]...)
+	}
+}
+
+// evictRun drops the events of the run that published longest ago.
+func (b *Bus) evictRun() {
+	// CALLER MUST LOCK b.mux!
+	var oldest string
+	var oldestSeq uint64
+	for requestUUID, h := range b.history {
+		if seq := h.events[len(h.events)-1].Seq; oldestSeq == 0 || seq < oldestSeq {
+			oldest, oldestSeq = requestUUID, seq
+		}
+	}
+	b.evict(oldestSeq)
+	delete(b.history, oldest)
+}
+
+// evict records that the event with Seq seq, and the ones before it, may be
+// dropped.
+func (b *Bus) evict(seq uint64) {
+	// CALLER MUST LOCK b.mux!
+	if seq > b.evicted {
+		b.evicted = seq
+	}
+}
+
+// matching returns the events kept published after the event with Seq after
+// that match filter.
+func (h *history) matching(filter Filter, after uint64) []Event {
+	var events []Event
+	for _, e := range h.events {
+		if e.Seq > after && filter.Match(e) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// Subscription receives the events of a Bus matching its filter.
+type Subscription struct {
+	dropped uint64 // atomic, first for its 64-bit alignment
+
+	bus        *Bus
+	filter     Filter
+	events     chan Event
+	incomplete bool // set by SubscribeAfter
+}
+
+// Events returns the channel the events are received on, in Seq order. It is
+// closed by Close.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Incomplete reports whether SubscribeAfter could not replay every event
+// published after the given one, because the bus no longer kept them.
+func (s *Subscription) Incomplete() bool {
+	return s.incomplete
+}
+
+// Dropped returns how many events the subscription had no room for.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close unsubscribes from the bus, and closes the events channel.
+func (s *Subscription) Close() {
+	s.bus.mux.Lock()
+	defer s.bus.mux.Unlock()
+	if !s.bus.subs[s] {
+		return
+	}
+	delete(s.bus.subs, s)
+	close(s.events)
+}
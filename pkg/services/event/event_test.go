@@ -0,0 +1,104 @@
+package event
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus(t *testing.T) {
+	var nilBus *Bus
+	nilBus.Publish(Event{Kind: ChainStarted}) // dropped
+
+	b := NewBus()
+	all := b.Subscribe(Filter{}, 0)
+	jobs := b.Subscribe(Filter{RequestUUID: "a", Kinds: []Kind{JobStarted, JobFinished}}, 2)
+
+	b.Publish(Event{Kind: ChainStarted, RequestUUID: "a"})
+	b.Publish(Event{Kind: JobStarted, RequestUUID: "b"})
+	b.Publish(Event{Kind: JobStarted, RequestUUID: "a"})
+	b.Publish(Event{Kind: JobFinished, RequestUUID: "a"})
+	b.Publish(Event{Kind: ChainFinished, RequestUUID: "a"})
+
+	// Publish doesn't wait for slow subscribers: they miss events.
+	e := <-all.Events()
+	assert.Equal(t, uint64(1), e.Seq)
+	assert.Equal(t, ChainStarted, e.Kind)
+	assert.False(t, e.At.IsZero())
+	assert.Equal(t, uint64(4), all.Dropped())
+
+	e = <-jobs.Events()
+	assert.Equal(t, uint64(3), e.Seq)
+	assert.Equal(t, JobStarted, e.Kind)
+	e = <-jobs.Events()
+	assert.Equal(t, uint64(4), e.Seq)
+	assert.Equal(t, JobFinished, e.Kind)
+	assert.Equal(t, uint64(0), jobs.Dropped())
+
+	// Closed subscriptions receive nothing more.
+	jobs.Close()
+	jobs.Close()
+	_, ok := <-jobs.Events()
+	assert.False(t, ok)
+	b.Publish(Event{Kind: JobStarted, RequestUUID: "a"})
+	e = <-all.Events()
+	assert.Equal(t, uint64(6), e.Seq)
+}
+
+func TestSubscribeAfter(t *testing.T) {
+	b := NewBus()
+	for i := 0; i < History+2; i++ {
+		b.Publish(Event{Kind: JobStarted, RequestUUID: "a"})
+	}
+	b.Publish(Event{Kind: JobStarted, RequestUUID: "b"})
+
+	// The events kept after the given one are replayed, then the new ones.
+	s := b.SubscribeAfter(Filter{RequestUUID: "a"}, 1, History)
+	defer s.Close()
+	b.Publish(Event{Kind: ChainFinished, RequestUUID: "a"})
+	var seqs []uint64
+	for len(seqs) < 3 {
+		seqs = append(seqs, (<-s.Events()).Seq)
+	}
+	assert.Equal(t, []uint64{History + 1, History + 2, History + 4}, seqs)
+	assert.False(t, s.Incomplete())
+	assert.Equal(t, uint64(0), s.Dropped())
+
+	// Each run keeps its last events, however many other runs publish.
+	s = b.SubscribeAfter(Filter{RequestUUID: "a"}, 1, 0)
+	defer s.Close()
+	assert.True(t, s.Incomplete())
+	assert.Equal(t, History, len(s.Events()))
+	assert.Equal(t, uint64(4), (<-s.Events()).Seq)
+	s = b.SubscribeAfter(Filter{RequestUUID: "b"}, 1, 0)
+	defer s.Close()
+	assert.False(t, s.Incomplete())
+	assert.Equal(t, uint64(History+3), (<-s.Events()).Seq)
+
+	// Replays of every run are in Seq order.
+	s = b.SubscribeAfter(Filter{}, 1, History+2)
+	defer s.Close()
+	assert.False(t, s.Incomplete())
+	assert.Equal(t, uint64(History+3), (<-s.Events()).Seq)
+	assert.Equal(t, uint64(History+4), (<-s.Events()).Seq)
+
+	// An unknown event replays every event kept, but some may be missing.
+	s = b.SubscribeAfter(Filter{RequestUUID: "b"}, 1, History+100)
+	defer s.Close()
+	assert.True(t, s.Incomplete())
+	assert.Equal(t, uint64(History+3), (<-s.Events()).Seq)
+
+	// So may the events of runs that no longer publish.
+	for i := 0; i < HistoryRuns; i++ {
+		b.Publish(Event{Kind: ChainStarted, RequestUUID: fmt.Sprint(i)})
+	}
+	s = b.SubscribeAfter(Filter{RequestUUID: "b"}, 1, History+3)
+	defer s.Close()
+	assert.True(t, s.Incomplete())
+	assert.Equal(t, 0, len(s.Events()))
+	s = b.SubscribeAfter(Filter{RequestUUID: "0"}, 1, 0)
+	defer s.Close()
+	assert.False(t, s.Incomplete())
+	assert.Equal(t, 1, len(s.Events()))
+}
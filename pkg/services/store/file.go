@@ -0,0 +1,224 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// file keeps each run in two files of a directory: <uuid>.json, the last
+// snapshot of the run, and <uuid>.transitions, every transition appended to
+// it, one json object per line.
+type file struct {
+	dir string
+
+	mux     *sync.Mutex       // serializes writes
+	lastSeq map[string]uint64 // request UUID -> Seq of its last transition
+}
+
+// NewFile returns a Store that keeps runs in files of dir, creating it if
+// needed. Only one Store may use a directory at a time.
+func NewFile(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &file{
+		dir:     dir,
+		mux:     &sync.Mutex{},
+		lastSeq: make(map[string]uint64),
+	}, nil
+}
+
+func (f *file) path(requestUUID, ext string) (string, error) {
+	if requestUUID == "" || strings.ContainsAny(requestUUID, `/\.`) {
+		return "", fmt.Errorf("invalid request uuid %q", requestUUID)
+	}
+	return filepath.Join(f.dir, requestUUID+ext), nil
+}
+
+// SaveRun ...
+func (f *file) SaveRun(run Run) error {
+	path, err := f.path(run.RequestUUID, ".json")
+	if err != nil {
+		return err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	seq, err := f.seq(run.RequestUUID)
+	if err != nil {
+		return err
+	}
+	if seq > run.LastSeq {
+		run.LastSeq = seq
+	}
+	b, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	// Write then rename so a crash never leaves a partial snapshot.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadRun ...
+func (f *file) LoadRun(requestUUID string) (Run, error) {
+	path, err := f.path(requestUUID, ".json")
+	if err != nil {
+		return Run{}, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return Run{}, ErrNotFound
+	}
+	if err != nil {
+		return Run{}, err
+	}
+	var run Run
+	if err := json.Unmarshal(b, &run); err != nil {
+		return Run{}, fmt.Errorf("%s: %w", path, err)
+	}
+	transitions, err := f.transitions(requestUUID)
+	if err != nil {
+		return Run{}, err
+	}
+	return replay(run, transitions), nil
+}
+
+// AppendTransition ...
+func (f *file) AppendTransition(t Transition) (Transition, error) {
+	path, err := f.path(t.RequestUUID, ".transitions")
+	if err != nil {
+		return t, err
+	}
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if _, ok := f.lastSeq[t.RequestUUID]; !ok {
+		if _, err := os.Stat(strings.TrimSuffix(path, ".transitions") + ".json"); os.IsNotExist(err) {
+			return t, ErrNotFound
+		}
+	}
+	seq, err := f.seq(t.RequestUUID)
+	if err != nil {
+		return t, err
+	}
+	t.Seq = seq + 1
+	b, err := json.Marshal(t)
+	if err != nil {
+		return t, err
+	}
+
+	fd, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return t, err
+	}
+	if _, err := fd.Write(append(b, '\n')); err != nil {
+		fd.Close()
+		return t, err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return t, err
+	}
+	if err := fd.Close(); err != nil {
+		return t, err
+	}
+	f.lastSeq[t.RequestUUID] = t.Seq
+	return t, nil
+}
+
+// seq returns the Seq of the last transition appended to a run, 0 if none
+// was.
+func (f *file) seq(requestUUID string) (uint64, error) {
+	// CALLER MUST LOCK f.mux!
+	if seq, ok := f.lastSeq[requestUUID]; ok {
+		return seq, nil
+	}
+	transitions, err := f.transitions(requestUUID)
+	if err != nil {
+		return 0, err
+	}
+	var seq uint64
+	if n := len(transitions); n > 0 {
+		seq = transitions[n-1].Seq
+	}
+	f.lastSeq[requestUUID] = seq
+	return seq, nil
+}
+
+// Transitions ...
+func (f *file) Transitions(requestUUID string) ([]Transition, error) {
+	path, err := f.path(requestUUID, ".json")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f.transitions(requestUUID)
+}
+
+// transitions reads the transitions appended to a run, none if its file
+// doesn't exist, e.g. because the run isn't saved yet.
+func (f *file) transitions(requestUUID string) ([]Transition, error) {
+	path, err := f.path(requestUUID, ".transitions")
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var transitions []Transition
+	scanner := bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var t Transition
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			// Skip a line left partial by a crash while appending.
+			continue
+		}
+		transitions = append(transitions, t)
+	}
+	return transitions, scanner.Err()
+}
+
+// ListRuns ...
+func (f *file) ListRuns(filter Filter) ([]Run, error) {
+	paths, err := filepath.Glob(filepath.Join(f.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var runs []Run
+	var corrupt []string
+	for _, path := range paths {
+		run, err := f.LoadRun(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err == ErrNotFound {
+			continue // removed since
+		}
+		if err != nil {
+			corrupt = append(corrupt, err.Error())
+			continue
+		}
+		if filter.Match(run) {
+			runs = append(runs, run)
+		}
+	}
+	sortRuns(runs)
+	if len(corrupt) > 0 {
+		return runs, fmt.Errorf("%w: %s", ErrCorruptRun, strings.Join(corrupt, "; "))
+	}
+	return runs, nil
+}
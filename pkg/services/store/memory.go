@@ -0,0 +1,89 @@
+package store
+
+import (
+	"sync"
+)
+
+type memoryRun struct {
+	snapshot    Run
+	transitions []Transition
+}
+
+type memory struct {
+	runs    map[string]*memoryRun // request UUID -> run
+	runsMux *sync.RWMutex
+}
+
+// NewMemory returns a Store that keeps runs in memory, e.g. for tests.
+func NewMemory() Store {
+	return &memory{
+		runs:    make(map[string]*memoryRun),
+		runsMux: &sync.RWMutex{},
+	}
+}
+
+// SaveRun ...
+func (m *memory) SaveRun(run Run) error {
+	m.runsMux.Lock()
+	defer m.runsMux.Unlock()
+	r, ok := m.runs[run.RequestUUID]
+	if !ok {
+		r = &memoryRun{}
+		m.runs[run.RequestUUID] = r
+	}
+	r.snapshot = run.clone()
+	if seq := uint64(len(r.transitions)); seq > r.snapshot.LastSeq {
+		r.snapshot.LastSeq = seq
+	}
+	return nil
+}
+
+// LoadRun ...
+func (m *memory) LoadRun(requestUUID string) (Run, error) {
+	m.runsMux.RLock()
+	defer m.runsMux.RUnlock()
+	r, ok := m.runs[requestUUID]
+	if !ok {
+		return Run{}, ErrNotFound
+	}
+	return replay(r.snapshot.clone(), r.transitions), nil
+}
+
+// AppendTransition ...
+func (m *memory) AppendTransition(t Transition) (Transition, error) {
+	m.runsMux.Lock()
+	defer m.runsMux.Unlock()
+	r, ok := m.runs[t.RequestUUID]
+	if !ok {
+		return t, ErrNotFound
+	}
+	t.Seq = uint64(len(r.transitions)) + 1
+	r.transitions = append(r.transitions, t)
+	return t, nil
+}
+
+// Transitions ...
+func (m *memory) Transitions(requestUUID string) ([]Transition, error) {
+	m.runsMux.RLock()
+	defer m.runsMux.RUnlock()
+	r, ok := m.runs[requestUUID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]Transition(nil), r.transitions...), nil
+}
+
+// ListRuns ...
+func (m *memory) ListRuns(filter Filter) ([]Run, error) {
+	m.runsMux.RLock()
+	defer m.runsMux.RUnlock()
+	var runs []Run
+	for _, r := range m.runs {
+		run := replay(r.snapshot.clone(), r.transitions)
+		if filter.Match(run) {
+			runs = append(runs, run)
+		}
+	}
+	sortRuns(runs)
+	return runs, nil
+}
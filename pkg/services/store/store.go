@@ -0,0 +1,288 @@
+// Package store persists chain runs: a snapshot of each run, and the state
+// transitions of its chain and jobs since the snapshot.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+)
+
+var (
+	// ErrNotFound ...
+	ErrNotFound = errors.New("run not found")
+
+	// ErrCorruptRun is wrapped by the error ListRuns returns along with the
+	// runs it could load, when it had to leave others out.
+	ErrCorruptRun = errors.New("run can't be loaded")
+)
+
+// Store persists runs. Implementations must be safe for concurrent use.
+type Store interface {
+	// SaveRun saves a snapshot of a run, replacing any previous one. The
+	// snapshot includes every transition appended to the run before: LoadRun
+	// doesn't apply them to it again, whatever its LastSeq.
+	SaveRun(run Run) error
+
+	// LoadRun returns the last snapshot of a run with every transition
+	// appended since applied to it, or ErrNotFound.
+	LoadRun(requestUUID string) (Run, error)
+
+	// AppendTransition durably appends a transition to a saved run and
+	// returns it with its Seq set.
+	AppendTransition(t Transition) (Transition, error)
+
+	// Transitions returns every transition appended to a saved run, in
+	// order, or ErrNotFound.
+	Transitions(requestUUID string) ([]Transition, error)
+
+	// ListRuns returns the runs matching filter, as LoadRun would, ordered
+	// by start time. A run that can't be loaded, e.g. one whose snapshot is
+	// corrupt, is left out: ListRuns then returns the others with an error
+	// wrapping ErrCorruptRun.
+	ListRuns(filter Filter) ([]Run, error)
+}
+
+// Run is the state of one run of a workflow.
+type Run struct {
+	RequestUUID string
+	Namespace   string // workflow namespace, name and version
+	Name        string
+	Version     int
+	RequestArgs map[string]interface{}
+	RequestTags []request.Tag
+
+	State      state.State // chain state
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	Jobs          []Job
+	SequenceTries []SequenceTries
+	Audit         []Audit // operator actions on jobs, oldest first
+
+	LastSeq uint64 // Seq of the last transition applied
+}
+
+// Job is the state of one job of a run.
+type Job struct {
+	AtomID     atom.AtomID
+	State      state.State
+	Tries      uint
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Outputs    atom.Outputs       `json:",omitempty"`
+	Branch     []atom.AtomID      // next jobs chosen by a branch job, nil if it isn't one
+	Input      json.RawMessage    `json:",omitempty"` // input submitted for the next run of the job
+	History    []state.Transition `json:",omitempty"` // state transitions, oldest first
+}
+
+// SequenceTries counts the tries of one sequence of a run.
+type SequenceTries struct {
+	SequenceID atom.AtomID
+	Tries      uint
+}
+
+// Audit records an operator action on a job of a run, e.g. marking it
+// skipped.
+type Audit struct {
+	At       time.Time
+	Operator string // who did it
+	AtomID   atom.AtomID
+	From     state.State // job state before
+	To       state.State // job state after
+	Reason   string      `json:",omitempty"`
+}
+
+// TransitionKind ...
+type TransitionKind string
+
+// TransitionKind const ...
+const (
+	ChainStateTransition    TransitionKind = "chain_state"
+	JobStateTransition      TransitionKind = "job_state"
+	JobTriesTransition      TransitionKind = "job_tries"
+	JobOutputsTransition    TransitionKind = "job_outputs"
+	JobBranchTransition     TransitionKind = "job_branch"
+	JobInputTransition      TransitionKind = "job_input"
+	AuditTransition         TransitionKind = "audit"
+	SequenceTriesTransition TransitionKind = "sequence_tries"
+)
+
+// Transition is one change of a run.
+type Transition struct {
+	Seq         uint64 // set by the store, increasing per run
+	RequestUUID string
+	Kind        TransitionKind
+	AtomID      atom.AtomID     // the job, or the sequence start job; empty for chain state
+	State       state.State     // new state, for chain and job state
+	Delta       int             // change of the count, for tries
+	Outputs     atom.Outputs    `json:",omitempty"` // new outputs, for job outputs
+	Branch      []atom.AtomID   // chosen next jobs, for job branch
+	Input       json.RawMessage `json:",omitempty"` // new input, for job input
+	Audit       *Audit          `json:",omitempty"` // operator action, for audit
+	At          time.Time
+}
+
+// Filter selects runs. Zero fields match every run.
+type Filter struct {
+	Namespace string
+	Name      string
+	Version   int
+	States    []state.State // run state is any of them
+	Tags      []request.Tag // run has all of them
+}
+
+// Match reports whether run is selected by the filter.
+func (f Filter) Match(run Run) bool {
+	if f.Namespace != "" && f.Namespace != run.Namespace {
+		return false
+	}
+	if f.Name != "" && f.Name != run.Name {
+		return false
+	}
+	if f.Version != 0 && f.Version != run.Version {
+		return false
+	}
+	if len(f.States) > 0 {
+		found := false
+		for _, s := range f.States {
+			if s == run.State {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+TAGS:
+	for _, tag := range f.Tags {
+		for _, runTag := range run.RequestTags {
+			if runTag == tag {
+				continue TAGS
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Apply applies a transition to the run.
+func (r *Run) Apply(t Transition) {
+	if t.Seq > r.LastSeq {
+		r.LastSeq = t.Seq
+	}
+	switch t.Kind {
+	case ChainStateTransition:
+		r.State = t.State
+		if t.State == state.StateRunning {
+			if r.StartedAt.IsZero() {
+				r.StartedAt = t.At
+			}
+			r.FinishedAt = time.Time{}
+		} else {
+			r.FinishedAt = t.At
+		}
+	case JobStateTransition:
+		j := r.job(t.AtomID)
+		if j.State != t.State {
+			j.History = append(j.History, state.Transition{From: j.State, To: t.State, At: t.At})
+		}
+		j.State = t.State
+		if t.State == state.StateRunning {
+			j.StartedAt = t.At
+			j.FinishedAt = time.Time{}
+		} else if _, ok := state.JobDoneState[t.State]; ok {
+			j.FinishedAt = t.At
+		}
+	case JobOutputsTransition:
+		j := r.job(t.AtomID)
+		j.Outputs = t.Outputs.Copy()
+	case JobBranchTransition:
+		j := r.job(t.AtomID)
+		j.Branch = append([]atom.AtomID(nil), t.Branch...)
+	case JobInputTransition:
+		j := r.job(t.AtomID)
+		j.Input = append(json.RawMessage(nil), t.Input...)
+	case JobTriesTransition:
+		j := r.job(t.AtomID)
+		j.Tries = addDelta(j.Tries, t.Delta)
+	case AuditTransition:
+		if t.Audit != nil {
+			r.Audit = append(r.Audit, *t.Audit)
+		}
+	case SequenceTriesTransition:
+		for i := range r.SequenceTries {
+			if r.SequenceTries[i].SequenceID == t.AtomID {
+				r.SequenceTries[i].Tries = addDelta(r.SequenceTries[i].Tries, t.Delta)
+				return
+			}
+		}
+		r.SequenceTries = append(r.SequenceTries, SequenceTries{SequenceID: t.AtomID, Tries: addDelta(0, t.Delta)})
+	}
+}
+
+// job returns the job of the run, adding it if it is not there yet.
+func (r *Run) job(atomID atom.AtomID) *Job {
+	for i := range r.Jobs {
+		if r.Jobs[i].AtomID == atomID {
+			return &r.Jobs[i]
+		}
+	}
+	r.Jobs = append(r.Jobs, Job{AtomID: atomID, State: state.StateUnknown})
+	return &r.Jobs[len(r.Jobs)-1]
+}
+
+func addDelta(n uint, delta int) uint {
+	if delta < 0 && uint(-delta) > n {
+		return 0
+	}
+	return uint(int(n) + delta)
+}
+
+// sortRuns orders runs by start time, then request UUID.
+func sortRuns(runs []Run) {
+	sort.Slice(runs, func(i, j int) bool {
+		if !runs[i].StartedAt.Equal(runs[j].StartedAt) {
+			return runs[i].StartedAt.Before(runs[j].StartedAt)
+		}
+		return runs[i].RequestUUID < runs[j].RequestUUID
+	})
+}
+
+// replay applies the transitions that came after the snapshot of a run.
+func replay(run Run, transitions []Transition) Run {
+	for _, t := range transitions {
+		if t.Seq > run.LastSeq {
+			run.Apply(t)
+		}
+	}
+	return run
+}
+
+// clone returns a deep copy of the run, but for the values of RequestArgs.
+func (r Run) clone() Run {
+	c := r
+	if r.RequestArgs != nil {
+		c.RequestArgs = make(map[string]interface{}, len(r.RequestArgs))
+		for k, v := range r.RequestArgs {
+			c.RequestArgs[k] = v
+		}
+	}
+	c.RequestTags = append([]request.Tag(nil), r.RequestTags...)
+	c.Jobs = append([]Job(nil), r.Jobs...)
+	for i := range c.Jobs {
+		c.Jobs[i].Outputs = c.Jobs[i].Outputs.Copy()
+		c.Jobs[i].Branch = append([]atom.AtomID(nil), c.Jobs[i].Branch...)
+		c.Jobs[i].Input = append(json.RawMessage(nil), c.Jobs[i].Input...)
+		c.Jobs[i].History = append([]state.Transition(nil), c.Jobs[i].History...)
+	}
+	c.SequenceTries = append([]SequenceTries(nil), r.SequenceTries...)
+	c.Audit = append([]Audit(nil), r.Audit...)
+	return c
+}
@@ -0,0 +1,149 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func testStore(t *testing.T, s Store) {
+	job1 := atom.AtomID{Type: "noop", ID: "1"}
+	started := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := s.LoadRun("a")
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.AppendTransition(Transition{RequestUUID: "a"})
+	assert.Equal(t, ErrNotFound, err)
+	_, err = s.Transitions("a")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, s.SaveRun(Run{
+		RequestUUID: "a",
+		Namespace:   "examples",
+		Name:        "noop",
+		Version:     1,
+		RequestTags: []request.Tag{{Name: "team", Value: "ops"}},
+		State:       state.StateUnknown,
+		Jobs:        []Job{{AtomID: job1, State: state.StateUnknown}},
+	}))
+	assert.Nil(t, s.SaveRun(Run{RequestUUID: "b", Name: "other", Version: 1, State: state.StateUnknown}))
+
+	for i, tr := range []Transition{
+		{Kind: ChainStateTransition, State: state.StateRunning, At: started},
+		{Kind: SequenceTriesTransition, AtomID: job1, Delta: 1, At: started},
+		{Kind: JobStateTransition, AtomID: job1, State: state.StateRunning, At: started},
+		{Kind: JobTriesTransition, AtomID: job1, Delta: 2, At: started.Add(time.Second)},
+		{Kind: JobStateTransition, AtomID: job1, State: state.StateSuccess, At: started.Add(time.Second)},
+		{Kind: JobOutputsTransition, AtomID: job1, Outputs: atom.Outputs{"n": []byte(`1`)}, At: started.Add(time.Second)},
+		{Kind: JobBranchTransition, AtomID: job1, Branch: []atom.AtomID{job1}, At: started.Add(time.Second)},
+		{Kind: JobInputTransition, AtomID: job1, Input: []byte(`{"ok":true}`), At: started.Add(time.Second)},
+	} {
+		tr.RequestUUID = "a"
+		tr, err := s.AppendTransition(tr)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(i+1), tr.Seq)
+	}
+
+	run, err := s.LoadRun("a")
+	assert.Nil(t, err)
+	assert.Equal(t, state.StateRunning, run.State)
+	assert.Equal(t, started, run.StartedAt)
+	assert.Equal(t, uint64(8), run.LastSeq)
+	assert.Equal(t, []Job{{
+		AtomID:     job1,
+		State:      state.StateSuccess,
+		Tries:      2,
+		StartedAt:  started,
+		FinishedAt: started.Add(time.Second),
+		Outputs:    atom.Outputs{"n": []byte(`1`)},
+		Branch:     []atom.AtomID{job1},
+		Input:      []byte(`{"ok":true}`),
+		History: []state.Transition{
+			{From: state.StateUnknown, To: state.StateRunning, At: started},
+			{From: state.StateRunning, To: state.StateSuccess, At: started.Add(time.Second)},
+		},
+	}}, run.Jobs)
+	assert.Equal(t, []SequenceTries{{SequenceID: job1, Tries: 1}}, run.SequenceTries)
+
+	transitions, err := s.Transitions("a")
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(transitions))
+	transitions, err = s.Transitions("b")
+	assert.Nil(t, err)
+	assert.Empty(t, transitions)
+
+	// A new snapshot includes the transitions before it; they aren't
+	// applied twice.
+	assert.Nil(t, s.SaveRun(run))
+	_, err = s.AppendTransition(Transition{RequestUUID: "a", Kind: SequenceTriesTransition, AtomID: job1, Delta: -3})
+	assert.Nil(t, err)
+	run, err = s.LoadRun("a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), run.Jobs[0].Tries)
+	assert.Equal(t, uint(0), run.SequenceTries[0].Tries)
+	assert.Equal(t, uint64(9), run.LastSeq)
+
+	// Even when the snapshot has no LastSeq, e.g. one of a restored chain.
+	run.LastSeq = 0
+	assert.Nil(t, s.SaveRun(run))
+	run, err = s.LoadRun("a")
+	assert.Nil(t, err)
+	assert.Equal(t, uint(2), run.Jobs[0].Tries)
+	assert.Equal(t, 2, len(run.Jobs[0].History))
+	assert.Equal(t, uint(0), run.SequenceTries[0].Tries)
+	assert.Equal(t, uint64(9), run.LastSeq)
+
+	runs, err := s.ListRuns(Filter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(runs))
+	runs, err = s.ListRuns(Filter{States: []state.State{state.StateRunning}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(runs))
+	assert.Equal(t, "a", runs[0].RequestUUID)
+	runs, err = s.ListRuns(Filter{Namespace: "examples", Name: "noop", Version: 1, Tags: []request.Tag{{Name: "team", Value: "ops"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(runs))
+	runs, err = s.ListRuns(Filter{Tags: []request.Tag{{Name: "team", Value: "dev"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(runs))
+}
+
+func TestMemory(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s, err := NewFile(dir)
+	assert.Nil(t, err)
+	testStore(t, s)
+
+	// Runs survive reopening the store.
+	s, err = NewFile(dir)
+	assert.Nil(t, err)
+	run, err := s.LoadRun("a")
+	assert.Nil(t, err)
+	assert.Equal(t, state.StateSuccess, run.Jobs[0].State)
+	tr, err := s.AppendTransition(Transition{RequestUUID: "a", Kind: ChainStateTransition, State: state.StateSuccess})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), tr.Seq)
+
+	_, err = s.LoadRun("../a")
+	assert.NotNil(t, err)
+
+	// A corrupt run is left out of the list, not the others.
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "c.json"), []byte(`{"RequestUUID":`), 0644))
+	runs, err := s.ListRuns(Filter{})
+	assert.True(t, errors.Is(err, ErrCorruptRun), err)
+	assert.Equal(t, 2, len(runs))
+}
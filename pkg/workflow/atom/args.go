@@ -0,0 +1,24 @@
+package atom
+
+import (
+	"errors"
+)
+
+var (
+	// ErrNoArgs ...
+	ErrNoArgs = errors.New("atom takes no args")
+
+	// ErrUnknownArg ...
+	ErrUnknownArg = errors.New("unknown atom arg")
+
+	// ErrInvalidArg ...
+	ErrInvalidArg = errors.New("invalid atom arg")
+)
+
+// ArgsSetter is implemented by atoms configured by the node they are the
+// Datum of, e.g. by the args of a node of a declarative workflow spec, rather
+// than from Go code. SetArgs is called once, right after the atom is made by
+// its Constructor.
+type ArgsSetter interface {
+	SetArgs(args map[string]interface{}) error
+}
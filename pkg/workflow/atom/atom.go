@@ -2,8 +2,15 @@ package atom
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/longsolong/flow/pkg/orchestration/request"
+	"strings"
+)
+
+var (
+	// ErrInvalidAtomID ...
+	ErrInvalidAtomID = errors.New("invalid atom id")
 )
 
 // Atom ...
@@ -26,4 +33,38 @@ func (id AtomID) String() string {
 
 func (id AtomID) IsEmpty() bool {
 	return id.Type == "" && id.ID == "" && id.ExpansionDigest == ""
-}
\ No newline at end of file
+}
+
+// Less orders AtomIDs by Type, then ID, then ExpansionDigest.
+func (id AtomID) Less(other AtomID) bool {
+	if id.Type != other.Type {
+		return id.Type < other.Type
+	}
+	if id.ID != other.ID {
+		return id.ID < other.ID
+	}
+	return id.ExpansionDigest < other.ExpansionDigest
+}
+
+// Key returns the id as Type:ID:ExpansionDigest, without the last colon if
+// there is no ExpansionDigest; unlike String, it is parsed by ParseAtomID and
+// safe in an url path.
+func (id AtomID) Key() string {
+	if id.ExpansionDigest == "" {
+		return id.Type + ":" + id.ID
+	}
+	return id.Type + ":" + id.ID + ":" + id.ExpansionDigest
+}
+
+// ParseAtomID parses an id formatted by AtomID.Key.
+func ParseAtomID(key string) (AtomID, error) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		return AtomID{}, fmt.Errorf("%q: %w", key, ErrInvalidAtomID)
+	}
+	id := AtomID{Type: parts[0], ID: parts[1]}
+	if len(parts) == 3 {
+		id.ExpansionDigest = parts[2]
+	}
+	return id, nil
+}
@@ -0,0 +1,30 @@
+package atom
+
+import (
+	"context"
+	"errors"
+
+	"github.com/faceair/jio"
+)
+
+var (
+	// ErrNoInput ...
+	ErrNoInput = errors.New("no input")
+)
+
+// InputRequester is implemented by atoms that need input from a person before
+// they run. A job of such an atom doesn't run until the input is submitted:
+// it waits in StateWaitInput without holding a goroutine. The submitted input
+// is read from the run context, see flowcontext.Input; it is consumed by the
+// run it was submitted for, so a sequence retry waits for new input.
+type InputRequester interface {
+	// InputRequest returns the input the atom needs to run, nil if it needs
+	// none.
+	InputRequest(ctx context.Context) *InputRequest
+}
+
+// InputRequest describes the input an atom waits for.
+type InputRequest struct {
+	Prompt string     // shown to the person who submits the input
+	Schema jio.Schema // validates the submitted json object
+}
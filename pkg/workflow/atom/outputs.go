@@ -0,0 +1,47 @@
+package atom
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+var (
+	// ErrNoOutput ...
+	ErrNoOutput = errors.New("no such output")
+)
+
+// Outputs are the named results a job publishes in its Return. They are kept
+// as json so they survive persistence and can be read by downstream jobs.
+type Outputs map[string]json.RawMessage
+
+// Set marshals v as the output name.
+func (o Outputs) Set(name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	o[name] = b
+	return nil
+}
+
+// Get unmarshals the output name into v. It returns ErrNoOutput if there is
+// no such output.
+func (o Outputs) Get(name string, v interface{}) error {
+	b, ok := o[name]
+	if !ok {
+		return ErrNoOutput
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Copy returns a copy of the outputs, nil if there are none.
+func (o Outputs) Copy() Outputs {
+	if len(o) == 0 {
+		return nil
+	}
+	c := make(Outputs, len(o))
+	for name, b := range o {
+		c[name] = append(json.RawMessage(nil), b...)
+	}
+	return c
+}
@@ -0,0 +1,67 @@
+package atom
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrAlreadyRegisteredType ...
+	ErrAlreadyRegisteredType = errors.New("already registered atom type")
+
+	// ErrNotRegisteredType ...
+	ErrNotRegisteredType = errors.New("not registered atom type")
+)
+
+// Constructor makes a new Atom of one type. Atoms built by a Constructor get
+// everything else they need from the request in Create.
+type Constructor func(id, expansionDigest string) Atom
+
+var (
+	constructors    = make(map[string]Constructor) // AtomID.Type -> Constructor
+	constructorsMux = &sync.RWMutex{}              // for access to constructors map
+)
+
+// Register registers a constructor under the AtomID.Type of the atoms it
+// makes. Step packages should call it from an init function.
+func Register(c Constructor) error {
+	typ := c("", "").AtomID().Type
+	constructorsMux.Lock()
+	defer constructorsMux.Unlock()
+	if _, ok := constructors[typ]; ok {
+		return ErrAlreadyRegisteredType
+	}
+	constructors[typ] = c
+	return nil
+}
+
+// MustRegister ...
+func MustRegister(c Constructor) {
+	if err := Register(c); err != nil {
+		panic(err)
+	}
+}
+
+// New makes a new Atom of the registered type typ.
+func New(typ, id, expansionDigest string) (Atom, error) {
+	constructorsMux.RLock()
+	c, ok := constructors[typ]
+	constructorsMux.RUnlock()
+	if !ok {
+		return nil, ErrNotRegisteredType
+	}
+	return c(id, expansionDigest), nil
+}
+
+// Types returns the registered atom types, sorted.
+func Types() []string {
+	constructorsMux.RLock()
+	defer constructorsMux.RUnlock()
+	types := make([]string, 0, len(constructors))
+	for typ := range constructors {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
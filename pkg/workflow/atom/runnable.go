@@ -16,4 +16,11 @@ type Return struct {
 	State state.State // State const
 	Exit  int64       // Unix exit code
 	Error error       // Go error
+
+	Outputs Outputs // named results, read by downstream jobs through their context
+
+	// Branch makes the atom a branch: only the downstream atoms it lists
+	// run, those reachable only through the others are ignored. nil runs
+	// every downstream atom.
+	Branch []AtomID
 }
\ No newline at end of file
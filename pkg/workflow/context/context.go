@@ -2,13 +2,19 @@ package context
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/services/event"
+	"github.com/longsolong/flow/pkg/workflow/atom"
 )
 
 type FlowContextKey string
 
 var (
-	LoggerCtxKey     = FlowContextKey("Logger")
+	LoggerCtxKey          = FlowContextKey("Logger")
+	UpstreamOutputsCtxKey = FlowContextKey("UpstreamOutputs")
+	InputCtxKey           = FlowContextKey("Input")
+	EventsCtxKey          = FlowContextKey("Events")
 )
 
 // Logger returns the logger from a context object.
@@ -20,3 +26,58 @@ func Logger(ctx context.Context) *infra.Logger {
 	return logger
 }
 
+// WithUpstreamOutputs returns a copy of ctx carrying the outputs of the
+// upstream jobs of the job about to run, by AtomID.
+func WithUpstreamOutputs(ctx context.Context, outputs map[atom.AtomID]atom.Outputs) context.Context {
+	return context.WithValue(ctx, UpstreamOutputsCtxKey, outputs)
+}
+
+// UpstreamOutputs returns the outputs of the upstream jobs of the running job,
+// by AtomID. Upstream jobs without outputs are missing.
+func UpstreamOutputs(ctx context.Context) map[atom.AtomID]atom.Outputs {
+	outputs, _ := ctx.Value(UpstreamOutputsCtxKey).(map[atom.AtomID]atom.Outputs)
+	return outputs
+}
+
+// UpstreamOutput unmarshals the output name of the upstream job upstreamID into
+// v. It returns atom.ErrNoOutput if there is no such output.
+func UpstreamOutput(ctx context.Context, upstreamID atom.AtomID, name string, v interface{}) error {
+	return UpstreamOutputs(ctx)[upstreamID].Get(name, v)
+}
+
+// WithInput returns a copy of ctx carrying the input submitted for the job
+// about to run, see atom.InputRequester.
+func WithInput(ctx context.Context, input json.RawMessage) context.Context {
+	return context.WithValue(ctx, InputCtxKey, input)
+}
+
+// InputData returns the input submitted for the running job, nil if there is
+// none.
+func InputData(ctx context.Context) json.RawMessage {
+	input, _ := ctx.Value(InputCtxKey).(json.RawMessage)
+	return input
+}
+
+// Input unmarshals the input submitted for the running job into v. It returns
+// atom.ErrNoInput if there is none.
+func Input(ctx context.Context, v interface{}) error {
+	input := InputData(ctx)
+	if input == nil {
+		return atom.ErrNoInput
+	}
+	return json.Unmarshal(input, v)
+}
+
+// WithEvents returns a copy of ctx carrying the bus the lifecycle events of a
+// chain and its jobs are published to. The context of the request of the chain
+// must carry it.
+func WithEvents(ctx context.Context, bus *event.Bus) context.Context {
+	return context.WithValue(ctx, EventsCtxKey, bus)
+}
+
+// Events returns the event bus from a context, nil if it has none: the events
+// published to it are dropped.
+func Events(ctx context.Context) *event.Bus {
+	bus, _ := ctx.Value(EventsCtxKey).(*event.Bus)
+	return bus
+}
@@ -0,0 +1,144 @@
+package dag
+
+import (
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+)
+
+// Batch is a set of nodes and edges added to a DAG at once by Apply, so that
+// the readers of a growing DAG never see a part of them: a new node is never
+// reachable without its edges. The zero value is an empty batch.
+type Batch struct {
+	nodes []*Node
+	edges []edge
+}
+
+type edge struct {
+	node     *Node
+	upstream *Node
+}
+
+// AddNode adds a new node to the batch.
+func (b *Batch) AddNode(node *Node) {
+	b.nodes = append(b.nodes, node)
+}
+
+// SetUpstream adds the edge upstream -> node to the batch. Either node can be
+// a node of the batch or of the DAG.
+func (b *Batch) SetUpstream(node, upstream *Node) {
+	b.edges = append(b.edges, edge{node: node, upstream: upstream})
+}
+
+// Nodes returns the new nodes of the batch.
+func (b *Batch) Nodes() []*Node {
+	return append([]*Node(nil), b.nodes...)
+}
+
+// Apply adds the nodes and edges of the batch to the graph. It adds nothing
+// if one of the nodes is already registered, or one of the edges is already
+// registered or references a node neither in the graph nor in the batch. Nor
+// does it if the graph with the batch applied has a cycle or an edge to a
+// node not registered: then it returns a *workflow.InvalidGraphError, like
+// Validate.
+func (g *DAG) Apply(b *Batch) error {
+	g.VerticesMux.Lock()
+	defer g.VerticesMux.Unlock()
+	return g.ApplyLocked(b)
+}
+
+// ApplyLocked is Apply for callers that hold the lock, e.g. to update
+// something else along with the graph.
+func (g *DAG) ApplyLocked(b *Batch) error {
+	// CALLER MUST LOCK g.VerticesMux!
+	added := make(map[atom.AtomID]*Node, len(b.nodes))
+	for _, node := range b.nodes {
+		id := node.Datum.AtomID()
+		if _, ok := g.Vertices[id]; ok {
+			return workflow.ErrAlreadyRegisteredNode
+		}
+		if _, ok := added[id]; ok {
+			return workflow.ErrAlreadyRegisteredNode
+		}
+		added[id] = node
+	}
+	registered := func(node *Node) bool {
+		id := node.Datum.AtomID()
+		return g.Vertices[id] == node || added[id] == node
+	}
+	seen := make(map[edge]bool, len(b.edges))
+	for _, e := range b.edges {
+		if !registered(e.node) || !registered(e.upstream) {
+			return workflow.ErrNotRegisteredNode
+		}
+		if seen[e] {
+			return workflow.ErrAlreadyRegisteredUpstream
+		}
+		seen[e] = true
+		unlock := lockEdges(e.node, e.upstream)
+		err := e.node.checkUpstream(e.upstream)
+		unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := g.checkApplied(added, b.edges); err != nil {
+		return err
+	}
+
+	for id, node := range added {
+		g.Vertices[id] = node
+	}
+	for _, e := range b.edges {
+		unlock := lockEdges(e.node, e.upstream)
+		e.node.Prev[e.upstream.Datum.AtomID()] = e.upstream
+		e.upstream.Next[e.node.Datum.AtomID()] = e.node
+		unlock()
+	}
+	return nil
+}
+
+// checkApplied checks the graph as it would be with the nodes and edges of a
+// batch added, for cycles and edges to nodes not registered. It returns nil
+// or a *workflow.InvalidGraphError.
+func (g *DAG) checkApplied(added map[atom.AtomID]*Node, edges []edge) error {
+	// CALLER MUST LOCK g.VerticesMux!
+	adj := g.adjacencyLocked()
+	for id, node := range added {
+		node.EdgeMux.RLock()
+		adj.next[id] = sortedIDs(node.Next)
+		adj.prev[id] = sortedIDs(node.Prev)
+		node.EdgeMux.RUnlock()
+		adj.ids = insertSorted(adj.ids, id)
+	}
+	for _, e := range edges {
+		id, upstreamID := e.node.Datum.AtomID(), e.upstream.Datum.AtomID()
+		adj.prev[id] = insertSorted(adj.prev[id], upstreamID)
+		adj.next[upstreamID] = insertSorted(adj.next[upstreamID], id)
+	}
+
+	var errs []*workflow.NodeError
+	for _, id := range adj.ids {
+		for _, nextID := range adj.next[id] {
+			if _, ok := adj.next[nextID]; !ok {
+				errs = append(errs, &workflow.NodeError{Err: workflow.ErrDanglingEdge, Path: []atom.AtomID{id, nextID}})
+			}
+		}
+		for _, prevID := range adj.prev[id] {
+			if _, ok := adj.prev[prevID]; !ok {
+				errs = append(errs, &workflow.NodeError{Err: workflow.ErrDanglingEdge, Path: []atom.AtomID{prevID, id}})
+			}
+		}
+	}
+	for _, cycle := range findCycles(adj.ids, adj.next) {
+		errs = append(errs, &workflow.NodeError{Err: workflow.ErrCyclicGraph, Path: cycle})
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return &workflow.InvalidGraphError{
+		Name:    g.Name,
+		Version: g.Version,
+		Errors:  errs,
+	}
+}
@@ -3,6 +3,7 @@ package dag
 import (
 	"github.com/longsolong/flow/pkg/workflow"
 	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/retry"
 	"sync"
 	"time"
 )
@@ -12,6 +13,8 @@ type DAG struct {
 	Name    string // Name of the Graph
 	Version int    // Version of the Graph
 
+	Timeout time.Duration // max run time of a chain of the graph, 0 for none
+
 	Vertices    map[atom.AtomID]*Node // All vertices in the graph (node id -> node)
 	VerticesMux *sync.RWMutex         // for access to vertices maps
 }
@@ -28,11 +31,19 @@ type Node struct {
 	Prev    map[atom.AtomID]*Node // in edges ( node id -> Node )
 	EdgeMux *sync.RWMutex         // for access to vertices maps
 
-	Name          string        // the name of the node
-	Retry         uint          // the number of times to retry a node
-	RetryWait     time.Duration // the time, in seconds, to sleep between retries
-	SequenceID    atom.AtomID   // AtomID for first node in sequence
-	SequenceRetry uint          // Number of times to retry a sequence. Only set for first node in sequence.
+	Name          string          // the name of the node
+	Retry         uint            // the number of times to retry a node
+	RetryWait     time.Duration   // the time, in seconds, to sleep between retries
+	Backoff       retry.Backoff   // the time to sleep before each retry; nil sleeps RetryWait
+	RetryIf       retry.Predicate // the failures that can be retried; nil retries all
+	SequenceID    atom.AtomID     // AtomID for first node in sequence
+	SequenceRetry uint            // Number of times to retry a sequence. Only set for first node in sequence.
+	TriggerRule   TriggerRule     // when the node runs given the states of its upstream nodes; empty means TriggerAllSuccess
+	Pool          string          // resource pool the node takes a slot of while it runs; empty for none
+	Priority      int             // among jobs waiting for a running slot, higher ones run first
+	Timeout       time.Duration   // max run time of each try of the node, 0 for none
+
+	EstimatedDuration time.Duration // expected run time, used by DAG.CriticalPath when no duration was recorded
 }
 
 // NewDAG ...
@@ -59,14 +70,22 @@ func NewNode(a atom.Atom, name string, retry uint, retryWait time.Duration) *Nod
 	}
 }
 
-// MustAddNode ...
-func (g *DAG) MustAddNode(node *Node) {
+// AddNode ...
+func (g *DAG) AddNode(node *Node) error {
 	g.VerticesMux.Lock()
 	defer g.VerticesMux.Unlock()
 	if _, ok := g.Vertices[node.Datum.AtomID()]; ok {
-		panic(workflow.ErrAlreadyRegisteredNode)
+		return workflow.ErrAlreadyRegisteredNode
 	}
 	g.Vertices[node.Datum.AtomID()] = node
+	return nil
+}
+
+// MustAddNode ...
+func (g *DAG) MustAddNode(node *Node) {
+	if err := g.AddNode(node); err != nil {
+		panic(err)
+	}
 }
 
 // GetNode ...
@@ -91,29 +110,73 @@ func (g *DAG) MustGetNode(atomID atom.AtomID) *Node {
 
 // SetUpstream ...
 func (n *Node) SetUpstream(upstream *Node) error {
-	n.EdgeMux.Lock()
-	defer n.EdgeMux.Unlock()
+	unlock := lockEdges(n, upstream)
+	defer unlock()
+	if err := n.checkUpstream(upstream); err != nil {
+		return err
+	}
+	n.Prev[upstream.Datum.AtomID()] = upstream
+	upstream.Next[n.Datum.AtomID()] = n
+	return nil
+}
+
+func (n *Node) checkUpstream(upstream *Node) error {
+	// CALLER MUST LOCK n.EdgeMux and upstream.EdgeMux!
 	if _, ok := n.Prev[upstream.Datum.AtomID()]; ok {
 		return workflow.ErrAlreadyRegisteredUpstream
 	}
 	if _, ok := upstream.Next[n.Datum.AtomID()]; ok {
 		return workflow.ErrAlreadyRegisteredDownstream
 	}
-	n.Prev[upstream.Datum.AtomID()] = upstream
-	upstream.Next[n.Datum.AtomID()] = n
 	return nil
 }
 
-// Upstream ...
+// lockEdges locks the edges of two nodes, in AtomID order so that concurrent
+// calls can't deadlock, and returns the func unlocking them.
+func lockEdges(a, b *Node) (unlock func()) {
+	if b.Datum.AtomID().Less(a.Datum.AtomID()) {
+		a, b = b, a
+	}
+	a.EdgeMux.Lock()
+	if a == b {
+		return a.EdgeMux.Unlock
+	}
+	b.EdgeMux.Lock()
+	return func() {
+		b.EdgeMux.Unlock()
+		a.EdgeMux.Unlock()
+	}
+}
+
+// Upstream returns a copy of the in edges of the node; the graph can grow
+// while the copy is used.
 func (n *Node) Upstream() map[atom.AtomID]*Node {
 	n.EdgeMux.RLock()
 	defer n.EdgeMux.RUnlock()
-	return n.Prev
+	return copyEdges(n.Prev)
 }
 
-// Downstream ...
+// Downstream returns a copy of the out edges of the node; the graph can grow
+// while the copy is used.
 func (n *Node) Downstream() map[atom.AtomID]*Node {
 	n.EdgeMux.RLock()
 	defer n.EdgeMux.RUnlock()
-	return n.Next
+	return copyEdges(n.Next)
+}
+
+// RetryBackoff returns the Backoff of the node, or a retry.Constant of
+// RetryWait if it has none.
+func (n *Node) RetryBackoff() retry.Backoff {
+	if n.Backoff != nil {
+		return n.Backoff
+	}
+	return retry.Constant(n.RetryWait)
+}
+
+func copyEdges(edges map[atom.AtomID]*Node) map[atom.AtomID]*Node {
+	c := make(map[atom.AtomID]*Node, len(edges))
+	for id, node := range edges {
+		c[id] = node
+	}
+	return c
 }
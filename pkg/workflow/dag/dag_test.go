@@ -1,6 +1,7 @@
 package dag
 
 import (
+	"errors"
 	"github.com/longsolong/flow/pkg/workflow"
 	"github.com/longsolong/flow/pkg/workflow/atom"
 	"github.com/longsolong/flow/pkg/workflow/step/builtin"
@@ -34,3 +35,232 @@ func TestNewDAG(t *testing.T) {
 	downstreams := noop2.Downstream()
 	assert.Equal(t, map[atom.AtomID]*Node{}, downstreams)
 }
+
+func TestValidateCycle(t *testing.T) {
+	dag := NewDAG("test cyclic dag", 1)
+	noop1 := NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	noop2 := NewNode(builtin.NewNoop("2", ""), "noop2", 0, time.Duration(0))
+	noop3 := NewNode(builtin.NewNoop("3", ""), "noop3", 0, time.Duration(0))
+	dag.MustAddNode(noop1)
+	dag.MustAddNode(noop2)
+	dag.MustAddNode(noop3)
+
+	assert.Nil(t, noop2.SetUpstream(noop1))
+	assert.Nil(t, noop3.SetUpstream(noop2))
+	assert.Nil(t, dag.Validate())
+
+	assert.Nil(t, noop1.SetUpstream(noop3))
+	err := dag.Validate()
+	assert.True(t, errors.Is(err, workflow.ErrInvalidGraph))
+	assert.True(t, errors.Is(err, workflow.ErrCyclicGraph))
+
+	invalid := err.(*workflow.InvalidGraphError)
+	assert.Len(t, invalid.Errors, 1)
+	assert.Equal(t, []atom.AtomID{
+		noop1.Datum.AtomID(),
+		noop2.Datum.AtomID(),
+		noop3.Datum.AtomID(),
+		noop1.Datum.AtomID(),
+	}, invalid.Errors[0].Path)
+}
+
+func TestValidateStructure(t *testing.T) {
+	dag := NewDAG("test invalid dag", 1)
+	noop1 := NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0))
+	noop2 := NewNode(builtin.NewNoop("2", ""), "noop2", 0, time.Duration(0))
+	orphan := NewNode(builtin.NewNoop("3", ""), "orphan", 0, time.Duration(0))
+	dag.MustAddNode(noop1)
+	dag.MustAddNode(noop2)
+	dag.MustAddNode(orphan)
+	assert.Nil(t, noop2.SetUpstream(noop1))
+
+	noop1.SequenceID = noop1.Datum.AtomID()
+	noop1.SequenceRetry = 1
+	noop2.SequenceID = noop1.Datum.AtomID()
+	noop2.SequenceRetry = 1
+	orphan.SequenceID = builtin.NewNoop("missing", "").AtomID()
+
+	err := dag.Validate()
+	assert.True(t, errors.Is(err, workflow.ErrOrphanNode))
+	assert.True(t, errors.Is(err, workflow.ErrDanglingSequence))
+	assert.True(t, errors.Is(err, workflow.ErrSequenceRetryNotOnStart))
+	assert.False(t, errors.Is(err, workflow.ErrCyclicGraph))
+
+	noop2.SequenceRetry = 0
+	err = dag.Validate()
+	assert.False(t, errors.Is(err, workflow.ErrSequenceRetryNotOnStart))
+	assert.False(t, errors.Is(err, workflow.ErrUnknownTriggerRule))
+
+	noop2.TriggerRule = "most_success"
+	err = dag.Validate()
+	assert.True(t, errors.Is(err, workflow.ErrUnknownTriggerRule))
+}
+
+func TestValidateSingleNode(t *testing.T) {
+	dag := NewDAG("test single node dag", 1)
+	dag.MustAddNode(NewNode(builtin.NewNoop("1", ""), "noop1", 0, time.Duration(0)))
+	assert.Nil(t, dag.Validate())
+}
+
+// diamond builds 1 -> {2, 3} -> 4.
+func diamond() (*DAG, []*Node) {
+	dag := NewDAG("test diamond dag", 1)
+	var nodes []*Node
+	for _, id := range []string{"1", "2", "3", "4"} {
+		node := NewNode(builtin.NewNoop(id, ""), "noop"+id, 0, time.Duration(0))
+		dag.MustAddNode(node)
+		nodes = append(nodes, node)
+	}
+	nodes[1].SetUpstream(nodes[0])
+	nodes[2].SetUpstream(nodes[0])
+	nodes[3].SetUpstream(nodes[1])
+	nodes[3].SetUpstream(nodes[2])
+	return dag, nodes
+}
+
+func ids(nodes ...*Node) []atom.AtomID {
+	var atomIDs []atom.AtomID
+	for _, node := range nodes {
+		atomIDs = append(atomIDs, node.Datum.AtomID())
+	}
+	return atomIDs
+}
+
+func TestTopology(t *testing.T) {
+	dag, nodes := diamond()
+
+	order, err := dag.TopologicalSort()
+	assert.Nil(t, err)
+	assert.Equal(t, ids(nodes...), order)
+
+	levels, err := dag.Levels()
+	assert.Nil(t, err)
+	assert.Equal(t, map[atom.AtomID]int{
+		nodes[0].Datum.AtomID(): 0,
+		nodes[1].Datum.AtomID(): 1,
+		nodes[2].Datum.AtomID(): 1,
+		nodes[3].Datum.AtomID(): 2,
+	}, levels)
+
+	assert.Equal(t, ids(nodes[0]), dag.Roots())
+	assert.Equal(t, ids(nodes[3]), dag.Leaves())
+
+	ancestors, err := dag.Ancestors(nodes[3].Datum.AtomID())
+	assert.Nil(t, err)
+	assert.Equal(t, ids(nodes[0], nodes[1], nodes[2]), ancestors)
+
+	descendants, err := dag.Descendants(nodes[1].Datum.AtomID())
+	assert.Nil(t, err)
+	assert.Equal(t, ids(nodes[3]), descendants)
+
+	_, err = dag.Descendants(builtin.NewNoop("missing", "").AtomID())
+	assert.Equal(t, workflow.ErrNotRegisteredNode, err)
+
+	nodes[0].SetUpstream(nodes[3])
+	_, err = dag.TopologicalSort()
+	assert.Equal(t, workflow.ErrCyclicGraph, err)
+
+	// An edge to a node not in the graph is no cycle.
+	dag, nodes = diamond()
+	missing := NewNode(builtin.NewNoop("missing", ""), "missing", 0, time.Duration(0))
+	assert.Nil(t, nodes[1].SetUpstream(missing))
+	_, err = dag.TopologicalSort()
+	assert.True(t, errors.Is(err, workflow.ErrDanglingEdge))
+	assert.Equal(t, []atom.AtomID{missing.Datum.AtomID(), nodes[1].Datum.AtomID()}, err.(*workflow.NodeError).Path)
+	_, err = dag.Levels()
+	assert.True(t, errors.Is(err, workflow.ErrDanglingEdge))
+	err = dag.Validate()
+	assert.True(t, errors.Is(err, workflow.ErrDanglingEdge))
+	assert.False(t, errors.Is(err, workflow.ErrCyclicGraph))
+}
+
+func TestCriticalPath(t *testing.T) {
+	dag, nodes := diamond()
+	for _, node := range nodes {
+		node.EstimatedDuration = time.Second
+	}
+	nodes[1].EstimatedDuration = 2 * time.Second
+
+	path, total, err := dag.CriticalPath(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, ids(nodes[0], nodes[1], nodes[3]), path)
+	assert.Equal(t, 4*time.Second, total)
+
+	// Recorded durations win over estimates.
+	path, total, err = dag.CriticalPath(map[atom.AtomID]time.Duration{
+		nodes[2].Datum.AtomID(): 5 * time.Second,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ids(nodes[0], nodes[2], nodes[3]), path)
+	assert.Equal(t, 7*time.Second, total)
+}
+
+func TestBatch(t *testing.T) {
+	dag, nodes := diamond()
+	upstream := nodes[3].Upstream()
+	five := NewNode(builtin.NewNoop("5", ""), "noop5", 0, time.Duration(0))
+	six := NewNode(builtin.NewNoop("6", ""), "noop6", 0, time.Duration(0))
+
+	// Nothing is added if a part of the batch is invalid.
+	var b Batch
+	b.AddNode(five)
+	b.SetUpstream(five, nodes[3])
+	b.SetUpstream(six, five)
+	assert.Equal(t, workflow.ErrNotRegisteredNode, dag.Apply(&b))
+	_, err := dag.GetNode(five.Datum.AtomID())
+	assert.Equal(t, workflow.ErrNotRegisteredNode, err)
+	assert.Len(t, nodes[3].Downstream(), 0)
+
+	b = Batch{}
+	b.AddNode(five)
+	b.AddNode(six)
+	b.SetUpstream(five, nodes[3])
+	b.SetUpstream(six, five)
+	b.SetUpstream(six, nodes[0])
+	assert.Nil(t, dag.Apply(&b))
+	assert.Nil(t, dag.Validate())
+	assert.Equal(t, ids(five), ids(nodeList(nodes[3].Downstream())...))
+	assert.Len(t, six.Upstream(), 2)
+
+	// Upstream and Downstream return copies.
+	assert.Len(t, upstream, 2)
+	upstream[five.Datum.AtomID()] = five
+	assert.Len(t, nodes[3].Upstream(), 2)
+
+	b = Batch{}
+	b.AddNode(NewNode(builtin.NewNoop("5", ""), "noop5", 0, time.Duration(0)))
+	assert.Equal(t, workflow.ErrAlreadyRegisteredNode, dag.Apply(&b))
+	b = Batch{}
+	b.SetUpstream(six, five)
+	assert.Equal(t, workflow.ErrAlreadyRegisteredUpstream, dag.Apply(&b))
+
+	// Nor if it makes a cycle, or brings an edge to a node not registered.
+	b = Batch{}
+	b.SetUpstream(nodes[0], six)
+	err = dag.Apply(&b)
+	assert.True(t, errors.Is(err, workflow.ErrCyclicGraph), err)
+	var invalid *workflow.InvalidGraphError
+	assert.True(t, errors.As(err, &invalid))
+	assert.Len(t, nodes[0].Upstream(), 0)
+	assert.Nil(t, dag.Validate())
+
+	seven := NewNode(builtin.NewNoop("7", ""), "noop7", 0, time.Duration(0))
+	eight := NewNode(builtin.NewNoop("8", ""), "noop8", 0, time.Duration(0))
+	assert.Nil(t, eight.SetUpstream(seven))
+	b = Batch{}
+	b.AddNode(seven)
+	b.SetUpstream(seven, six)
+	err = dag.Apply(&b)
+	assert.True(t, errors.Is(err, workflow.ErrDanglingEdge), err)
+	_, err = dag.GetNode(seven.Datum.AtomID())
+	assert.Equal(t, workflow.ErrNotRegisteredNode, err)
+	assert.Len(t, six.Downstream(), 0)
+}
+
+func nodeList(nodes map[atom.AtomID]*Node) []*Node {
+	var list []*Node
+	for _, node := range nodes {
+		list = append(list, node)
+	}
+	return list
+}
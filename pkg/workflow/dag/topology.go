@@ -0,0 +1,245 @@
+package dag
+
+import (
+	"sort"
+	"time"
+
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+)
+
+// adjacency is a point in time copy of the edges of a DAG. Every slice is
+// sorted by AtomID so that everything derived from it is deterministic.
+type adjacency struct {
+	ids  []atom.AtomID
+	next map[atom.AtomID][]atom.AtomID
+	prev map[atom.AtomID][]atom.AtomID
+}
+
+func (g *DAG) adjacency() adjacency {
+	g.VerticesMux.RLock()
+	defer g.VerticesMux.RUnlock()
+	return g.adjacencyLocked()
+}
+
+func (g *DAG) adjacencyLocked() adjacency {
+	// CALLER MUST LOCK g.VerticesMux!
+	adj := adjacency{
+		ids:  sortedIDs(g.Vertices),
+		next: make(map[atom.AtomID][]atom.AtomID, len(g.Vertices)),
+		prev: make(map[atom.AtomID][]atom.AtomID, len(g.Vertices)),
+	}
+	for _, id := range adj.ids {
+		node := g.Vertices[id]
+		node.EdgeMux.RLock()
+		adj.next[id] = sortedIDs(node.Next)
+		adj.prev[id] = sortedIDs(node.Prev)
+		node.EdgeMux.RUnlock()
+	}
+	return adj
+}
+
+// TopologicalSort returns every AtomID of the graph such that each node comes
+// after all of its upstreams. Among nodes that are ready at the same time the
+// smallest AtomID comes first, so the order is stable between calls. An edge
+// to a node not in the graph is a *workflow.NodeError wrapping
+// workflow.ErrDanglingEdge.
+func (g *DAG) TopologicalSort() ([]atom.AtomID, error) {
+	return g.adjacency().topologicalSort()
+}
+
+func (adj adjacency) topologicalSort() ([]atom.AtomID, error) {
+	if err := adj.danglingEdge(); err != nil {
+		return nil, err
+	}
+	inDegree := make(map[atom.AtomID]int, len(adj.ids))
+	var ready []atom.AtomID
+	for _, id := range adj.ids {
+		inDegree[id] = len(adj.prev[id])
+		if inDegree[id] == 0 {
+			ready = append(ready, id)
+		}
+	}
+
+	order := make([]atom.AtomID, 0, len(adj.ids))
+	for len(ready) > 0 {
+		id := ready[0]
+		ready = ready[1:]
+		order = append(order, id)
+		for _, nextID := range adj.next[id] {
+			inDegree[nextID]--
+			if inDegree[nextID] == 0 {
+				ready = insertSorted(ready, nextID)
+			}
+		}
+	}
+	if len(order) != len(adj.ids) {
+		return nil, workflow.ErrCyclicGraph
+	}
+	return order, nil
+}
+
+// danglingEdge returns the first edge, in AtomID order, from or to a node that
+// is not in the graph, nil if there is none.
+func (adj adjacency) danglingEdge() error {
+	for _, id := range adj.ids {
+		for _, prevID := range adj.prev[id] {
+			if _, ok := adj.prev[prevID]; !ok {
+				return &workflow.NodeError{Err: workflow.ErrDanglingEdge, Path: []atom.AtomID{prevID, id}}
+			}
+		}
+		for _, nextID := range adj.next[id] {
+			if _, ok := adj.next[nextID]; !ok {
+				return &workflow.NodeError{Err: workflow.ErrDanglingEdge, Path: []atom.AtomID{id, nextID}}
+			}
+		}
+	}
+	return nil
+}
+
+// Levels returns the depth of every node: roots are level 0 and any other
+// node is one more than its deepest upstream.
+func (g *DAG) Levels() (map[atom.AtomID]int, error) {
+	adj := g.adjacency()
+	order, err := adj.topologicalSort()
+	if err != nil {
+		return nil, err
+	}
+	levels := make(map[atom.AtomID]int, len(order))
+	for _, id := range order {
+		level := 0
+		for _, prevID := range adj.prev[id] {
+			if levels[prevID]+1 > level {
+				level = levels[prevID] + 1
+			}
+		}
+		levels[id] = level
+	}
+	return levels, nil
+}
+
+// Roots returns the nodes without upstreams, sorted by AtomID.
+func (g *DAG) Roots() []atom.AtomID {
+	adj := g.adjacency()
+	var roots []atom.AtomID
+	for _, id := range adj.ids {
+		if len(adj.prev[id]) == 0 {
+			roots = append(roots, id)
+		}
+	}
+	return roots
+}
+
+// Leaves returns the nodes without downstreams, sorted by AtomID.
+func (g *DAG) Leaves() []atom.AtomID {
+	adj := g.adjacency()
+	var leaves []atom.AtomID
+	for _, id := range adj.ids {
+		if len(adj.next[id]) == 0 {
+			leaves = append(leaves, id)
+		}
+	}
+	return leaves
+}
+
+// Ancestors returns every node from which atomID can be reached, sorted by AtomID.
+func (g *DAG) Ancestors(atomID atom.AtomID) ([]atom.AtomID, error) {
+	adj := g.adjacency()
+	if _, ok := adj.prev[atomID]; !ok {
+		return nil, workflow.ErrNotRegisteredNode
+	}
+	return reachable(atomID, adj.prev), nil
+}
+
+// Descendants returns every node reachable from atomID, sorted by AtomID.
+func (g *DAG) Descendants(atomID atom.AtomID) ([]atom.AtomID, error) {
+	adj := g.adjacency()
+	if _, ok := adj.next[atomID]; !ok {
+		return nil, workflow.ErrNotRegisteredNode
+	}
+	return reachable(atomID, adj.next), nil
+}
+
+// CriticalPath returns the longest path through the graph when every node
+// takes its duration, and the total duration of that path, which is the
+// shortest possible wall time of a chain built from the graph. Durations are
+// taken from recorded (usually from previous runs) and fall back to
+// Node.EstimatedDuration for nodes missing from it.
+func (g *DAG) CriticalPath(recorded map[atom.AtomID]time.Duration) ([]atom.AtomID, time.Duration, error) {
+	g.VerticesMux.RLock()
+	adj := g.adjacencyLocked()
+	durations := make(map[atom.AtomID]time.Duration, len(adj.ids))
+	for _, id := range adj.ids {
+		if d, ok := recorded[id]; ok {
+			durations[id] = d
+		} else {
+			durations[id] = g.Vertices[id].EstimatedDuration
+		}
+	}
+	g.VerticesMux.RUnlock()
+
+	order, err := adj.topologicalSort()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(order) == 0 {
+		return nil, 0, nil
+	}
+
+	// finish is the earliest time a node can finish; via is the upstream on
+	// the longest path to it.
+	finish := make(map[atom.AtomID]time.Duration, len(order))
+	via := make(map[atom.AtomID]atom.AtomID, len(order))
+	var last atom.AtomID
+	for i, id := range order {
+		var start time.Duration
+		for _, prevID := range adj.prev[id] {
+			if _, ok := via[id]; !ok || finish[prevID] > start {
+				start = finish[prevID]
+				via[id] = prevID
+			}
+		}
+		finish[id] = start + durations[id]
+		if i == 0 || finish[id] > finish[last] {
+			last = id
+		}
+	}
+
+	path := []atom.AtomID{last}
+	for {
+		prevID, ok := via[path[0]]
+		if !ok {
+			break
+		}
+		path = append([]atom.AtomID{prevID}, path...)
+	}
+	return path, finish[last], nil
+}
+
+func reachable(from atom.AtomID, edges map[atom.AtomID][]atom.AtomID) []atom.AtomID {
+	seen := map[atom.AtomID]bool{}
+	toVisit := append([]atom.AtomID(nil), edges[from]...)
+	for len(toVisit) > 0 {
+		id := toVisit[0]
+		toVisit = toVisit[1:]
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		toVisit = append(toVisit, edges[id]...)
+	}
+	ids := make([]atom.AtomID, 0, len(seen))
+	for id := range seen {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Less(ids[j]) })
+	return ids
+}
+
+func insertSorted(ids []atom.AtomID, id atom.AtomID) []atom.AtomID {
+	i := sort.Search(len(ids), func(i int) bool { return id.Less(ids[i]) })
+	ids = append(ids, atom.AtomID{})
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	return ids
+}
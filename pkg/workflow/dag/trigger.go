@@ -0,0 +1,39 @@
+package dag
+
+// TriggerRule decides when a node runs given the states of its upstream
+// nodes. A node without upstream nodes always runs first.
+type TriggerRule string
+
+// TriggerRule const ...
+const (
+	// TriggerAllSuccess runs the node when every upstream node completed:
+	// succeeded, was marked skipped or was ignored. It is the default.
+	TriggerAllSuccess TriggerRule = "all_success"
+	// TriggerAllDone runs the node when every upstream node is done,
+	// whatever its state.
+	TriggerAllDone TriggerRule = "all_done"
+	// TriggerOneSuccess runs the node as soon as one upstream node succeeded
+	// or was marked skipped.
+	TriggerOneSuccess TriggerRule = "one_success"
+	// TriggerOneFailed runs the node as soon as one upstream node failed.
+	TriggerOneFailed TriggerRule = "one_failed"
+	// TriggerNoneFailed runs the node when every upstream node is done and
+	// none failed; unlike TriggerAllSuccess, stopped or canceled upstream
+	// nodes don't prevent it from running.
+	TriggerNoneFailed TriggerRule = "none_failed"
+	// TriggerAlways runs the node when every upstream node is done, like
+	// TriggerAllDone, and also if its upstream nodes can never run.
+	TriggerAlways TriggerRule = "always"
+)
+
+// TriggerRules are the valid trigger rules, the empty one meaning
+// TriggerAllSuccess.
+var TriggerRules = map[TriggerRule]bool{
+	"":                true,
+	TriggerAllSuccess: true,
+	TriggerAllDone:    true,
+	TriggerOneSuccess: true,
+	TriggerOneFailed:  true,
+	TriggerNoneFailed: true,
+	TriggerAlways:     true,
+}
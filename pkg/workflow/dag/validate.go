@@ -0,0 +1,138 @@
+package dag
+
+import (
+	"sort"
+
+	"github.com/longsolong/flow/pkg/workflow"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+)
+
+// Validate checks the structure of the graph. It reports cycles (with the
+// offending path of AtomIDs), orphaned nodes, edges and sequence ids that
+// reference not registered nodes, SequenceRetry set on nodes that do not
+// start their sequence, and unknown trigger rules. It returns nil or a *workflow.InvalidGraphError
+// listing every problem found.
+func (g *DAG) Validate() error {
+	g.VerticesMux.RLock()
+	defer g.VerticesMux.RUnlock()
+
+	adj := g.adjacencyLocked()
+	var errs []*workflow.NodeError
+
+	for _, id := range adj.ids {
+		node := g.Vertices[id]
+		upstream, downstream := adj.prev[id], adj.next[id]
+
+		for _, prevID := range upstream {
+			if _, ok := g.Vertices[prevID]; !ok {
+				errs = append(errs, &workflow.NodeError{
+					Err:  workflow.ErrDanglingEdge,
+					Path: []atom.AtomID{prevID, id},
+				})
+			}
+		}
+		for _, nextID := range downstream {
+			if _, ok := g.Vertices[nextID]; !ok {
+				errs = append(errs, &workflow.NodeError{
+					Err:  workflow.ErrDanglingEdge,
+					Path: []atom.AtomID{id, nextID},
+				})
+			}
+		}
+		if len(adj.ids) > 1 && len(upstream) == 0 && len(downstream) == 0 {
+			errs = append(errs, &workflow.NodeError{
+				Err:  workflow.ErrOrphanNode,
+				Path: []atom.AtomID{id},
+			})
+		}
+		if !node.SequenceID.IsEmpty() {
+			if _, ok := g.Vertices[node.SequenceID]; !ok {
+				errs = append(errs, &workflow.NodeError{
+					Err:  workflow.ErrDanglingSequence,
+					Path: []atom.AtomID{id, node.SequenceID},
+				})
+			}
+		}
+		if node.SequenceRetry > 0 && node.SequenceID != id {
+			errs = append(errs, &workflow.NodeError{
+				Err:  workflow.ErrSequenceRetryNotOnStart,
+				Path: []atom.AtomID{id},
+			})
+		}
+		if !TriggerRules[node.TriggerRule] {
+			errs = append(errs, &workflow.NodeError{
+				Err:  workflow.ErrUnknownTriggerRule,
+				Path: []atom.AtomID{id},
+			})
+		}
+	}
+
+	for _, cycle := range findCycles(adj.ids, adj.next) {
+		errs = append(errs, &workflow.NodeError{
+			Err:  workflow.ErrCyclicGraph,
+			Path: cycle,
+		})
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return &workflow.InvalidGraphError{
+		Name:    g.Name,
+		Version: g.Version,
+		Errors:  errs,
+	}
+}
+
+// findCycles does a DFS from every unvisited node, in AtomID order so the
+// reported paths are deterministic, and returns one path per back edge.
+func findCycles(ids []atom.AtomID, next map[atom.AtomID][]atom.AtomID) (cycles [][]atom.AtomID) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	color := make(map[atom.AtomID]int, len(ids))
+	var stack []atom.AtomID
+
+	var visit func(id atom.AtomID)
+	visit = func(id atom.AtomID) {
+		color[id] = visiting
+		stack = append(stack, id)
+		for _, nextID := range next[id] {
+			switch color[nextID] {
+			case unvisited:
+				if _, ok := next[nextID]; ok {
+					visit(nextID)
+				}
+			case visiting:
+				// Back edge: the cycle is the part of the stack starting at nextID.
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == nextID {
+						cycle := append([]atom.AtomID(nil), stack[i:]...)
+						cycles = append(cycles, append(cycle, nextID))
+						break
+					}
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[id] = visited
+	}
+
+	for _, id := range ids {
+		if color[id] == unvisited {
+			visit(id)
+		}
+	}
+	return cycles
+}
+
+func sortedIDs(nodes map[atom.AtomID]*Node) []atom.AtomID {
+	ids := make([]atom.AtomID, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Less(ids[j]) })
+	return ids
+}
@@ -2,6 +2,10 @@ package workflow
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/longsolong/flow/pkg/workflow/atom"
 )
 
 var (
@@ -16,4 +20,89 @@ var (
 
 	// ErrAlreadyRegisteredDownstream ...
 	ErrAlreadyRegisteredDownstream = errors.New("already registered downstream")
+
+	// ErrInvalidGraph ...
+	ErrInvalidGraph = errors.New("invalid graph")
+
+	// ErrCyclicGraph ...
+	ErrCyclicGraph = errors.New("cycle detected")
+
+	// ErrOrphanNode ...
+	ErrOrphanNode = errors.New("orphan node")
+
+	// ErrDanglingEdge ...
+	ErrDanglingEdge = errors.New("edge references a not registered node")
+
+	// ErrDanglingSequence ...
+	ErrDanglingSequence = errors.New("sequence id references a not registered node")
+
+	// ErrUnknownTriggerRule ...
+	ErrUnknownTriggerRule = errors.New("unknown trigger rule")
+
+	// ErrNotDownstream ...
+	ErrNotDownstream = errors.New("branch chose a node that is not downstream")
+
+	// ErrSequenceRetryNotOnStart ...
+	ErrSequenceRetryNotOnStart = errors.New("sequence retry set on a node that does not start its sequence")
+
+	// ErrNotWaitingInput ...
+	ErrNotWaitingInput = errors.New("job is not waiting for input")
+
+	// ErrInvalidInput ...
+	ErrInvalidInput = errors.New("invalid input")
+
+	// ErrInvalidTransition ...
+	ErrInvalidTransition = errors.New("invalid job state transition")
+
+	// ErrNoOperator ...
+	ErrNoOperator = errors.New("operator action without operator")
 )
+
+// NodeError describes a structural problem with one or more nodes of a graph.
+type NodeError struct {
+	Err  error         // one of the Err* values above
+	Path []atom.AtomID // offending nodes; for ErrCyclicGraph the cycle, first node repeated last
+}
+
+func (e *NodeError) Error() string {
+	ids := make([]string, 0, len(e.Path))
+	for _, id := range e.Path {
+		ids = append(ids, id.String())
+	}
+	return fmt.Sprintf("%s: %s", e.Err, strings.Join(ids, " -> "))
+}
+
+// Unwrap ...
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// InvalidGraphError is returned when a graph fails validation. It collects
+// every problem found, not only the first one.
+type InvalidGraphError struct {
+	Name    string
+	Version int
+	Errors  []*NodeError
+}
+
+func (e *InvalidGraphError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%s %s version %d: %s", ErrInvalidGraph, e.Name, e.Version, strings.Join(msgs, "; "))
+}
+
+// Is reports whether target is ErrInvalidGraph or the cause of one of the
+// collected node errors, so callers can use errors.Is(err, ErrCyclicGraph).
+func (e *InvalidGraphError) Is(target error) bool {
+	if target == ErrInvalidGraph {
+		return true
+	}
+	for _, err := range e.Errors {
+		if err.Err == target {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+// Package retry decides when, and whether, the runner retries a failed job.
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Backoff returns how long to wait before retrying a job after its nth failed
+// try of a run, n starting at 1.
+type Backoff interface {
+	Wait(n uint) time.Duration
+}
+
+// Constant waits the same time before every retry.
+type Constant time.Duration
+
+// Wait ...
+func (b Constant) Wait(n uint) time.Duration {
+	return time.Duration(b)
+}
+
+// Linear waits Initial before the first retry, and Step more before each
+// next one.
+type Linear struct {
+	Initial time.Duration
+	Step    time.Duration
+}
+
+// Wait ...
+func (b Linear) Wait(n uint) time.Duration {
+	if n == 0 {
+		n = 1
+	}
+	return clamp(float64(b.Initial) + float64(b.Step)*float64(n-1))
+}
+
+// Exponential waits Initial before the first retry, and Factor times longer
+// before each next one. A Factor under 1 means 2.
+type Exponential struct {
+	Initial time.Duration
+	Factor  float64
+}
+
+// Wait ...
+func (b Exponential) Wait(n uint) time.Duration {
+	if n == 0 {
+		n = 1
+	}
+	factor := b.Factor
+	if factor < 1 {
+		factor = 2
+	}
+	return clamp(float64(b.Initial) * math.Pow(factor, float64(n-1)))
+}
+
+// Jitter waits a random time between zero and the wait of Backoff, so jobs
+// failing together don't all retry together.
+type Jitter struct {
+	Backoff Backoff
+}
+
+// Wait ...
+func (b Jitter) Wait(n uint) time.Duration {
+	d := b.Backoff.Wait(n)
+	if d <= 0 {
+		return 0
+	}
+	if d == math.MaxInt64 {
+		// d + 1 would overflow, and the few waits Int63 misses don't matter.
+		return time.Duration(rand.Int63())
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Capped waits like Backoff, but never longer than Max.
+type Capped struct {
+	Backoff Backoff
+	Max     time.Duration
+}
+
+// Wait ...
+func (b Capped) Wait(n uint) time.Duration {
+	if d := b.Backoff.Wait(n); d < b.Max {
+		return d
+	}
+	return b.Max
+}
+
+// clamp converts a wait computed as a float to a Duration, without
+// overflowing.
+func clamp(d float64) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	if d >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
@@ -0,0 +1,43 @@
+package retry
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		backoff Backoff
+		waits   []time.Duration // for n = 1, 2, 3, 4
+	}{
+		{Constant(time.Second), []time.Duration{time.Second, time.Second, time.Second, time.Second}},
+		{Linear{Initial: time.Second, Step: 2 * time.Second}, []time.Duration{time.Second, 3 * time.Second, 5 * time.Second, 7 * time.Second}},
+		{Exponential{Initial: time.Second}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{Exponential{Initial: time.Second, Factor: 3}, []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 27 * time.Second}},
+		{Capped{Backoff: Exponential{Initial: time.Second}, Max: 5 * time.Second}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}},
+	}
+	for _, tt := range tests {
+		for i, want := range tt.waits {
+			assert.Equal(t, want, tt.backoff.Wait(uint(i+1)), "%#v n=%d", tt.backoff, i+1)
+		}
+	}
+
+	// No overflow.
+	assert.Equal(t, time.Duration(math.MaxInt64), Exponential{Initial: time.Hour}.Wait(1000))
+
+	// Jitter waits up to the wait of the backoff it wraps.
+	jitter := Jitter{Backoff: Exponential{Initial: time.Second}}
+	for n := uint(1); n <= 4; n++ {
+		d := jitter.Wait(n)
+		assert.True(t, d >= 0 && d <= Exponential{Initial: time.Second}.Wait(n), "n=%d: %s", n, d)
+	}
+	assert.Equal(t, time.Duration(0), Jitter{Backoff: Constant(0)}.Wait(1))
+
+	// Nor does it overflow once the backoff it wraps is clamped.
+	jitter = Jitter{Backoff: Exponential{Initial: time.Hour}}
+	assert.Equal(t, time.Duration(math.MaxInt64), jitter.Backoff.Wait(1000))
+	assert.True(t, jitter.Wait(1000) >= 0)
+}
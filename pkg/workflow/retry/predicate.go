@@ -0,0 +1,54 @@
+package retry
+
+import (
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+)
+
+// Predicate reports whether a failed try of a job can be retried, given what
+// the try returned.
+type Predicate func(ret atom.Return) bool
+
+// Classifier is implemented by atoms that tell which of their failures can
+// be retried, e.g. not an invalid input that fails every time.
+type Classifier interface {
+	Retryable(ret atom.Return) bool
+}
+
+// All returns a predicate that retries only if every one of predicates does.
+func All(predicates ...Predicate) Predicate {
+	return func(ret atom.Return) bool {
+		for _, p := range predicates {
+			if p != nil && !p(ret) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// NotOnStates returns a predicate that doesn't retry tries ending in one of
+// states, e.g. state.StateException.
+func NotOnStates(states ...state.State) Predicate {
+	return func(ret atom.Return) bool {
+		for _, s := range states {
+			if ret.State == s {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// NotOnExits returns a predicate that doesn't retry tries exiting with one of
+// codes.
+func NotOnExits(codes ...int64) Predicate {
+	return func(ret atom.Return) bool {
+		for _, code := range codes {
+			if ret.Exit == code {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,29 @@
+package retry
+
+import (
+	"testing"
+
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPredicate(t *testing.T) {
+	fail := atom.Return{State: state.StateFail, Exit: 1}
+	usage := atom.Return{State: state.StateFail, Exit: 2}
+	exception := atom.Return{State: state.StateException, Exit: 1}
+
+	p := NotOnStates(state.StateException)
+	assert.True(t, p(fail))
+	assert.False(t, p(exception))
+
+	p = NotOnExits(2, 64)
+	assert.True(t, p(fail))
+	assert.False(t, p(usage))
+
+	p = All(NotOnStates(state.StateException), NotOnExits(2), nil)
+	assert.True(t, p(fail))
+	assert.False(t, p(usage))
+	assert.False(t, p(exception))
+	assert.True(t, All()(fail))
+}
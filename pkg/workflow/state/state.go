@@ -1,5 +1,11 @@
 package state
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
 // State ...
 type State byte
 
@@ -16,6 +22,8 @@ const (
 	StateIgnored                  // ignored due to conditional
 	StateUpForRetry               // up for retry
 	StateMarkRetry                // mark as retry by user
+	StateSuspended                // suspended, can be resumed; chains only
+	StateTimeout                  // timed out
 
 	StateUnknown State = 0xff
 )
@@ -34,8 +42,18 @@ var (
 		StateIgnored:     true,
 		StateUpForRetry:  true,
 		StateMarkRetry:   true,
+		StateTimeout:     true,
 		StateUnknown:     true,
 	}
+	// ChainState ...
+	ChainState = map[State]bool{
+		StateUnknown:   true,
+		StateRunning:   true,
+		StateSuccess:   true,
+		StateFail:      true,
+		StateStopped:   true,
+		StateSuspended: true,
+	}
 	// JobUndoneState ...
 	JobUndoneState = map[State]bool{
 		StateRunning:    true,
@@ -53,6 +71,7 @@ var (
 		StateCanceled:    true,
 		StateMarkSkipped: true,
 		StateIgnored:     true,
+		StateTimeout:     true,
 	}
 	// JobCompleteState ...
 	JobCompleteState = map[State]bool{
@@ -60,8 +79,147 @@ var (
 		StateMarkSkipped: true,
 		StateIgnored:     true,
 	}
+	// JobTransitions are the states a job can go to, by the state it is in.
+	// A job can also be set to the state it is in, see CanTransition.
+	JobTransitions = map[State]map[State]bool{
+		// Not run yet: runs, or is never to run. Stopped if the chain is
+		// stopped before it runs, or up for retry if it is suspended.
+		StateUnknown: {
+			StateRunning:    true,
+			StateIgnored:    true,
+			StateUpForRetry: true,
+			StateStopped:    true,
+		},
+		StateUpForRetry: {
+			StateRunning: true,
+			StateIgnored: true,
+			StateUnknown: true,
+			StateStopped: true,
+		},
+		StateMarkRetry: {
+			StateRunning:    true,
+			StateIgnored:    true,
+			StateUnknown:    true,
+			StateUpForRetry: true,
+			StateStopped:    true,
+		},
+		// Ran: done, or waits for its input to run.
+		StateRunning: {
+			StateSuccess:   true,
+			StateFail:      true,
+			StateException: true,
+			StateStopped:   true,
+			StateCanceled:  true,
+			StateTimeout:   true,
+			StateWaitInput: true,
+		},
+		StateWaitInput: {
+			StateUnknown: true,
+		},
+		// Done: its sequence is retried, or an operator marks it.
+		StateSuccess: {
+			StateUpForRetry: true,
+			StateMarkRetry:  true,
+		},
+		StateFail: {
+			StateUpForRetry:  true,
+			StateMarkRetry:   true,
+			StateMarkSkipped: true,
+		},
+		StateException: {
+			StateUpForRetry:  true,
+			StateMarkRetry:   true,
+			StateMarkSkipped: true,
+		},
+		StateTimeout: {
+			StateUpForRetry:  true,
+			StateMarkRetry:   true,
+			StateMarkSkipped: true,
+		},
+		StateStopped: {
+			StateUpForRetry: true,
+			StateMarkRetry:  true,
+		},
+		StateCanceled: {
+			StateUpForRetry: true,
+			StateMarkRetry:  true,
+		},
+		StateMarkSkipped: {
+			StateUpForRetry: true,
+			StateMarkRetry:  true,
+		},
+		StateIgnored: {
+			StateUpForRetry: true,
+			StateMarkRetry:  true,
+			StateUnknown:    true,
+		},
+	}
 )
 
+// CanTransition reports whether a job in state from can go to state to, see
+// JobTransitions.
+func CanTransition(from, to State) bool {
+	if from == to {
+		return JobState[from]
+	}
+	return JobTransitions[from][to]
+}
+
+// Transition is a change of the state of a job.
+type Transition struct {
+	From State
+	To   State
+	At   time.Time
+}
+
+// String returns the StateText of s.
+func (s State) String() string {
+	if text, ok := StateText[s]; ok {
+		return text
+	}
+	return fmt.Sprintf("State(%d)", byte(s))
+}
+
+// MarshalText marshals s as its StateText, e.g. in json.
+func (s State) MarshalText() ([]byte, error) {
+	text, ok := StateText[s]
+	if !ok {
+		return nil, fmt.Errorf("unknown state %d", byte(s))
+	}
+	return []byte(text), nil
+}
+
+// UnmarshalText unmarshals a StateText.
+func (s *State) UnmarshalText(text []byte) error {
+	v, ok := StateValue[string(text)]
+	if !ok {
+		return fmt.Errorf("unknown state %q", text)
+	}
+	*s = v
+	return nil
+}
+
+// UnmarshalJSON unmarshals a StateText, or the number states were marshalled
+// as before, e.g. by a store.
+func (s *State) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) > 0 && data[0] != '"' {
+		var n byte
+		if err := json.Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*s = State(n)
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	return s.UnmarshalText([]byte(text))
+}
+
 // StateText ...
 var StateText = map[State]string{
 	StateUnknown:     "UNKNOWN",
@@ -76,6 +234,8 @@ var StateText = map[State]string{
 	StateIgnored:     "IGNORED",
 	StateUpForRetry:  "UP_FOR_RETRY",
 	StateMarkRetry:   "MARK_RETRY",
+	StateSuspended:   "SUSPENDED",
+	StateTimeout:     "TIMEOUT",
 }
 
 // StateValue ...
@@ -92,4 +252,6 @@ var StateValue = map[string]State{
 	"IGNORED":      StateIgnored,
 	"UP_FOR_RETRY": StateUpForRetry,
 	"MARK_RETRY":   StateMarkRetry,
+	"SUSPENDED":    StateSuspended,
+	"TIMEOUT":      StateTimeout,
 }
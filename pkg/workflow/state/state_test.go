@@ -0,0 +1,45 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanTransition(t *testing.T) {
+	assert.True(t, CanTransition(StateUnknown, StateRunning))
+	assert.True(t, CanTransition(StateRunning, StateWaitInput))
+	assert.True(t, CanTransition(StateFail, StateUpForRetry))
+	assert.True(t, CanTransition(StateSuccess, StateSuccess))
+	assert.False(t, CanTransition(StateSuccess, StateRunning))
+	assert.False(t, CanTransition(StateUnknown, StateSuccess))
+	assert.False(t, CanTransition(StateSuspended, StateSuspended))
+
+	for from, tos := range JobTransitions {
+		assert.True(t, JobState[from], StateText[from])
+		for to := range tos {
+			assert.True(t, JobState[to], StateText[to])
+		}
+	}
+	for s := range JobState {
+		_, ok := JobTransitions[s]
+		assert.True(t, ok, "%s can't change", s)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	data, err := json.Marshal(map[string]State{"a": StateWaitInput, "b": StateUnknown})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"a":"WAIT_INPUT","b":"UNKNOWN"}`, string(data))
+	_, err = json.Marshal(State(0x42))
+	assert.NotNil(t, err)
+
+	var states []State
+	assert.Nil(t, json.Unmarshal([]byte(`["FAIL", 255, 9]`), &states))
+	assert.Equal(t, []State{StateFail, StateUnknown, StateUpForRetry}, states)
+	assert.NotNil(t, json.Unmarshal([]byte(`"DONE"`), new(State)))
+	assert.NotNil(t, json.Unmarshal([]byte(`true`), new(State)))
+	assert.Equal(t, "MARK_RETRY", StateMarkRetry.String())
+	assert.Equal(t, "State(66)", State(0x42).String())
+}
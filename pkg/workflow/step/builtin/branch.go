@@ -0,0 +1,51 @@
+package builtin
+
+import (
+	"context"
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/longsolong/flow/pkg/workflow/step"
+)
+
+//go:generate genatom -type=Branch
+
+// ChooseFunc returns the downstream atoms a Branch runs.
+type ChooseFunc func(ctx context.Context) ([]atom.AtomID, error)
+
+// Branch runs only the downstream atoms chosen by its ChooseFunc; the jobs
+// reachable only through the others are ignored.
+type Branch struct {
+	step.Step
+	choose ChooseFunc
+}
+
+// NewBranch ...
+func NewBranch(id, expansionDigest string, choose ChooseFunc) *Branch {
+	b := &Branch{choose: choose}
+	b.ID = id
+	b.ExpansionDigest = expansionDigest
+	return b
+}
+
+// Create ...
+func (s *Branch) Create(ctx context.Context, req *request.Request) error {
+	return nil
+}
+
+// Run ...
+func (s *Branch) Run(ctx context.Context) (atom.Return, error) {
+	branch, err := s.choose(ctx)
+	if err != nil {
+		return atom.Return{State: state.StateFail, Error: err}, err
+	}
+	if branch == nil {
+		branch = []atom.AtomID{}
+	}
+	return atom.Return{State: state.StateSuccess, Branch: branch}, nil
+}
+
+// Stop run
+func (s *Branch) Stop(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,18 @@
+// Code generated by "genatom -type=Branch"; DO NOT EDIT.
+
+package builtin
+
+import (
+	"reflect"
+
+	"github.com/longsolong/flow/pkg/workflow/atom"
+)
+
+// AtomID ...
+func (s *Branch) AtomID() atom.AtomID {
+	return atom.AtomID{
+		Type:            reflect.TypeOf(s).Elem().String(),
+		ID:              s.ID,
+		ExpansionDigest: s.ExpansionDigest,
+	}
+}
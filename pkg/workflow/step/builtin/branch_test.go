@@ -0,0 +1,37 @@
+package builtin
+
+import (
+	"context"
+	"errors"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBranchRun(t *testing.T) {
+	chosen := NewNoop("chosen", "").AtomID()
+	branch := NewBranch("", "", func(ctx context.Context) ([]atom.AtomID, error) {
+		return []atom.AtomID{chosen}, nil
+	})
+	assert.Equal(t, "builtin.Branch", branch.AtomID().Type)
+	ret, err := branch.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, atom.Return{State: state.StateSuccess, Branch: []atom.AtomID{chosen}}, ret)
+
+	// Choosing nothing ignores every downstream atom.
+	branch = NewBranch("", "", func(ctx context.Context) ([]atom.AtomID, error) {
+		return nil, nil
+	})
+	ret, err = branch.Run(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []atom.AtomID{}, ret.Branch)
+
+	failed := errors.New("failed")
+	branch = NewBranch("", "", func(ctx context.Context) ([]atom.AtomID, error) {
+		return nil, failed
+	})
+	ret, err = branch.Run(context.Background())
+	assert.Equal(t, failed, err)
+	assert.Equal(t, state.StateFail, ret.State)
+}
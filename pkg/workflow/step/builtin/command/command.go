@@ -1,39 +1,319 @@
 package command
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"sync"
+	"text/template"
+	"time"
 
+	"github.com/longsolong/flow/pkg/infra"
+	"github.com/longsolong/flow/pkg/orchestration/request"
 	"github.com/longsolong/flow/pkg/workflow/atom"
+	flowcontext "github.com/longsolong/flow/pkg/workflow/context"
 	"github.com/longsolong/flow/pkg/workflow/state"
 	"github.com/longsolong/flow/pkg/workflow/step"
+	"go.uber.org/zap"
 )
 
-// ShellCommand is a Step that runs a single shell command with arguments.
+//go:generate genatom -type=ShellCommand
+
+const (
+	// DefaultMaxOutput is the number of bytes of stdout, and of stderr, a
+	// ShellCommand keeps by default.
+	DefaultMaxOutput = 64 << 10
+
+	// DefaultKillWait is how long a ShellCommand waits by default for its
+	// process to exit after SIGTERM before sending SIGKILL.
+	DefaultKillWait = 5 * time.Second
+)
+
+var (
+	// ErrNoCommand is returned by Create when the argv of a ShellCommand is
+	// empty.
+	ErrNoCommand = errors.New("shell command has no argv")
+)
+
+// ShellCommand is a Step that runs a single command with arguments. Its argv,
+// env and working dir are text/template templates expanded with the request
+// args when it is created, e.g. "--date={{.date}}". They are set in Go code,
+// or from the args of its node, see SetArgs.
+//
+// The last MaxOutput bytes of stdout and stderr are its "stdout" and "stderr"
+// outputs; every line is also logged with the logger of the run context, if
+// it has one. Stop, or the end of the run context, sends SIGTERM to the
+// process group of the command, then SIGKILL after KillWait.
 type ShellCommand struct {
 	step.Step
 
-	Cmd *exec.Cmd
+	Argv      []string      // command and args templates
+	Env       []string      // KEY=value templates added to the environment of the process
+	Dir       string        // working dir template, the current dir if empty
+	MaxOutput int           // bytes of stdout and of stderr kept, DefaultMaxOutput if 0
+	KillWait  time.Duration // between SIGTERM and SIGKILL, DefaultKillWait if 0
+
+	argv []string // expanded by Create
+	env  []string
+	dir  string
+
+	mux         *sync.Mutex
+	stopChan    chan struct{} // closed by Stop while a process runs, nil otherwise
+	running     bool          // a Run is in progress
+	stopPending bool          // Stop was called while Run had not started its process yet
+}
+
+func init() {
+	atom.MustRegister(func(id, expansionDigest string) atom.Atom {
+		return NewShellCommand(id, expansionDigest)
+	})
+}
+
+// NewShellCommand ...
+func NewShellCommand(id, expansionDigest string, argv ...string) *ShellCommand {
+	s := &ShellCommand{Argv: argv, mux: &sync.Mutex{}}
+	s.ID = id
+	s.ExpansionDigest = expansionDigest
+	return s
+}
+
+// SetArgs sets Argv, Env and Dir from the "argv", "env" and "dir" args, e.g.
+// of a node of a declarative workflow spec:
+//
+//	args:
+//	  argv: [wc, -l, "{{.file}}"]
+//	  env: [LC_ALL=C]
+//	  dir: /tmp
+func (s *ShellCommand) SetArgs(args map[string]interface{}) error {
+	for name, v := range args {
+		var err error
+		switch name {
+		case "argv":
+			s.Argv, err = stringsArg(v)
+		case "env":
+			s.Env, err = stringsArg(v)
+		case "dir":
+			var ok bool
+			if s.Dir, ok = v.(string); !ok {
+				err = atom.ErrInvalidArg
+			}
+		default:
+			err = atom.ErrUnknownArg
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
 }
 
-// Run a shell
+// Create expands the argv, env and dir templates with the request args.
+func (s *ShellCommand) Create(ctx context.Context, req *request.Request) error {
+	var err error
+	if s.argv, err = expandAll("argv", s.Argv, req.RequestArgs); err != nil {
+		return err
+	}
+	if len(s.argv) == 0 || s.argv[0] == "" {
+		return ErrNoCommand
+	}
+	if s.env, err = expandAll("env", s.Env, req.RequestArgs); err != nil {
+		return err
+	}
+	if s.dir, err = expand("dir", s.Dir, req.RequestArgs); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Run runs the command and waits for it to exit. The exit code of the command
+// is the Exit of the returned atom.Return.
 func (s *ShellCommand) Run(ctx context.Context) (atom.Return, error) {
-	// Run the cmd and wait for it to return
-	err := s.Cmd.Run()
-	ret := atom.Return{
-		Error: err,
+	if len(s.argv) == 0 {
+		return atom.Return{State: state.StateFail, Exit: 1, Error: ErrNoCommand}, nil
 	}
-	if err != nil {
-		ret.Exit = 1
+	fields := []zap.Field{zap.String("job_id", s.AtomID().String())}
+	logger, _ := ctx.Value(flowcontext.LoggerCtxKey).(*infra.Logger)
+	maxOutput := s.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = DefaultMaxOutput
+	}
+	stdout := newTailBuffer(maxOutput)
+	stderr := newTailBuffer(maxOutput)
+	stdoutLog := newLineLogger(logger, "stdout", fields)
+	stderrLog := newLineLogger(logger, "stderr", fields)
+
+	s.mux.Lock()
+	s.running = true
+	s.stopPending = false
+	s.mux.Unlock()
+	defer func() {
+		s.mux.Lock()
+		s.running = false
+		s.stopPending = false
+		s.mux.Unlock()
+	}()
+
+	cmd := exec.Command(s.argv[0], s.argv[1:]...)
+	cmd.Dir = s.dir
+	cmd.Env = append(os.Environ(), s.env...)
+	cmd.Stdout = io.MultiWriter(stdout, stdoutLog)
+	cmd.Stderr = io.MultiWriter(stderr, stderrLog)
+	setProcessGroup(cmd)
+
+	s.mux.Lock()
+	if s.stopPending {
+		s.mux.Unlock()
+		return atom.Return{State: state.StateStopped}, nil
+	}
+	if err := cmd.Start(); err != nil {
+		s.mux.Unlock()
+		return atom.Return{State: state.StateFail, Exit: 1, Error: err}, nil
+	}
+	stopChan := make(chan struct{})
+	s.stopChan = stopChan
+	s.mux.Unlock()
+
+	waitChan := make(chan error, 1)
+	go func() { waitChan <- cmd.Wait() }()
+
+	var err error
+	var stopped, canceled bool
+	select {
+	case err = <-waitChan:
+	case <-stopChan:
+		stopped = true
+		err = s.terminate(cmd, waitChan, logger, fields)
+	case <-ctx.Done():
+		canceled = true
+		err = s.terminate(cmd, waitChan, logger, fields)
+	}
+
+	s.mux.Lock()
+	s.stopChan = nil
+	s.mux.Unlock()
+	stdoutLog.flush()
+	stderrLog.flush()
+
+	ret := atom.Return{Outputs: atom.Outputs{}}
+	if setErr := ret.Outputs.Set("stdout", stdout.String()); setErr != nil {
+		return ret, setErr
+	}
+	if setErr := ret.Outputs.Set("stderr", stderr.String()); setErr != nil {
+		return ret, setErr
+	}
+	if cmd.ProcessState != nil {
+		ret.Exit = exitCode(cmd.ProcessState)
+	}
+	switch {
+	case stopped:
+		ret.State = state.StateStopped
+	case canceled && ctx.Err() == context.DeadlineExceeded:
+		ret.State = state.StateTimeout
+		ret.Error = ctx.Err()
+	case canceled:
+		ret.State = state.StateStopped
+		ret.Error = ctx.Err()
+	case err != nil:
 		ret.State = state.StateFail
-	} else {
+		ret.Error = err
+		if ret.Exit == 0 {
+			ret.Exit = 1
+		}
+	default:
 		ret.State = state.StateSuccess
 	}
-
 	return ret, nil
 }
 
-// Stop run
+// Stop stops the running command: SIGTERM, then SIGKILL after KillWait. If
+// Run has not started the process yet, it returns without starting it. Stop
+// only stops the run in progress: called while none is, it does nothing, so
+// the job can run again once retried or resumed.
 func (s *ShellCommand) Stop(ctx context.Context) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.stopChan == nil {
+		if s.running {
+			s.stopPending = true
+		}
+		return nil
+	}
+	select {
+	case <-s.stopChan:
+	default:
+		close(s.stopChan)
+	}
 	return nil
 }
+
+// terminate sends SIGTERM to the process group of cmd, then SIGKILL if it
+// hasn't exited after KillWait, and returns what cmd.Wait returned.
+func (s *ShellCommand) terminate(cmd *exec.Cmd, waitChan chan error, logger *infra.Logger, fields []zap.Field) error {
+	killWait := s.KillWait
+	if killWait <= 0 {
+		killWait = DefaultKillWait
+	}
+	if logger != nil {
+		logger.Log.Info("terminating command", fields...)
+	}
+	if err := terminateGroup(cmd); err != nil && logger != nil {
+		logger.Log.Warn("terminating command failed", append(fields, zap.Error(err))...)
+	}
+	select {
+	case err := <-waitChan:
+		return err
+	case <-time.After(killWait):
+	}
+	if logger != nil {
+		logger.Log.Warn("killing command", fields...)
+	}
+	if err := killGroup(cmd); err != nil && logger != nil {
+		logger.Log.Warn("killing command failed", append(fields, zap.Error(err))...)
+	}
+	return <-waitChan
+}
+
+// stringsArg returns an arg that is a list of strings.
+func stringsArg(v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, atom.ErrInvalidArg
+	}
+	strs := make([]string, 0, len(list))
+	for _, item := range list {
+		str, ok := item.(string)
+		if !ok {
+			return nil, atom.ErrInvalidArg
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
+
+func expandAll(name string, texts []string, args map[string]interface{}) ([]string, error) {
+	expanded := make([]string, 0, len(texts))
+	for i, text := range texts {
+		e, err := expand(fmt.Sprintf("%s[%d]", name, i), text, args)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, e)
+	}
+	return expanded, nil
+}
+
+func expand(name, text string, args map[string]interface{}) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, args); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
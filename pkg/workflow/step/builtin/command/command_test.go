@@ -0,0 +1,191 @@
+//go:build !windows
+// +build !windows
+
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/longsolong/flow/pkg/orchestration/request"
+	"github.com/longsolong/flow/pkg/workflow/atom"
+	"github.com/longsolong/flow/pkg/workflow/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func newRequest(args map[string]interface{}) *request.Request {
+	req := request.NewRequest()
+	req.RequestArgs = args
+	return req
+}
+
+func output(t *testing.T, ret atom.Return, name string) string {
+	var s string
+	assert.Nil(t, ret.Outputs.Get(name, &s))
+	return s
+}
+
+func TestShellCommand(t *testing.T) {
+	ctx := context.Background()
+	s := NewShellCommand("greet", "", "sh", "testdata/greet.sh", "{{.name}}", "{{.exit}}")
+	s.Env = []string{"GREETING={{.greeting}}"}
+	assert.Nil(t, s.Create(ctx, newRequest(map[string]interface{}{"name": "bob", "greeting": "hi", "exit": 3})))
+	assert.Equal(t, "command.ShellCommand", s.AtomID().Type)
+	ret, err := s.Run(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, state.StateFail, ret.State)
+	assert.Equal(t, int64(3), ret.Exit)
+	assert.NotNil(t, ret.Error)
+	assert.Equal(t, "hi bob\n", output(t, ret, "stdout"))
+	assert.Equal(t, "hi to stderr\n", output(t, ret, "stderr"))
+
+	// The working dir.
+	dir, err := ioutil.TempDir("", "command")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	s = NewShellCommand("pwd", "", "pwd", "-P")
+	s.Dir = "{{.dir}}"
+	assert.Nil(t, s.Create(ctx, newRequest(map[string]interface{}{"dir": dir})))
+	ret, _ = s.Run(ctx)
+	assert.Equal(t, state.StateSuccess, ret.State)
+	assert.Equal(t, int64(0), ret.Exit)
+	real, _ := filepath.EvalSymlinks(dir)
+	assert.Equal(t, real+"\n", output(t, ret, "stdout"))
+
+	// Only the end of a long output is kept.
+	s = NewShellCommand("long", "", "printf", "123456789")
+	s.MaxOutput = 4
+	assert.Nil(t, s.Create(ctx, newRequest(nil)))
+	ret, _ = s.Run(ctx)
+	assert.Equal(t, "...\n6789", output(t, ret, "stdout"))
+
+	// Create errors.
+	s = NewShellCommand("missing", "", "echo", "{{.missing}}")
+	assert.NotNil(t, s.Create(ctx, newRequest(map[string]interface{}{})))
+	s = NewShellCommand("empty", "", "{{.cmd}}")
+	assert.True(t, errors.Is(s.Create(ctx, newRequest(map[string]interface{}{"cmd": ""})), ErrNoCommand))
+
+	// A command that can't start fails.
+	s = NewShellCommand("nope", "", "testdata/does-not-exist")
+	assert.Nil(t, s.Create(ctx, newRequest(nil)))
+	ret, _ = s.Run(ctx)
+	assert.Equal(t, state.StateFail, ret.State)
+	assert.NotNil(t, ret.Error)
+}
+
+// alive reports whether a process runs, waiting a bit for it to exit. A
+// zombie no one reaped doesn't run.
+func alive(pid int) bool {
+	for i := 0; i < 50; i++ {
+		if syscall.Kill(pid, 0) == syscall.ESRCH {
+			return false
+		}
+		if stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid)); err == nil {
+			if i := bytes.LastIndexByte(stat, ')'); i > 0 && i+2 < len(stat) && stat[i+2] == 'Z' {
+				return false
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return true
+}
+
+func TestShellCommandStop(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "command")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "pid")
+
+	// Stop terminates the process group, the children of the command too.
+	s := NewShellCommand("spawn", "", "sh", "testdata/spawn.sh", pidFile)
+	assert.Nil(t, s.Create(ctx, newRequest(nil)))
+	retChan := make(chan atom.Return)
+	go func() {
+		ret, _ := s.Run(ctx)
+		retChan <- ret
+	}()
+	var pid int
+	for i := 0; i < 100 && pid == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		b, _ := ioutil.ReadFile(pidFile)
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	assert.NotZero(t, pid)
+	assert.Nil(t, s.Stop(ctx))
+	var ret atom.Return
+	select {
+	case ret = <-retChan:
+	case <-time.After(5 * time.Second):
+		// The child holds stdout open until it exits.
+		t.Fatal("child of the command not stopped")
+	}
+	assert.Equal(t, state.StateStopped, ret.State)
+	assert.Equal(t, int64(128+syscall.SIGTERM), ret.Exit)
+	assert.False(t, alive(pid))
+
+	// A command ignoring SIGTERM is killed after KillWait.
+	s = NewShellCommand("stubborn", "", "sh", "testdata/ignore_term.sh")
+	s.KillWait = 100 * time.Millisecond
+	assert.Nil(t, s.Create(ctx, newRequest(nil)))
+	go func() {
+		ret, _ := s.Run(ctx)
+		retChan <- ret
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, s.Stop(ctx))
+	ret = <-retChan
+	assert.Equal(t, state.StateStopped, ret.State)
+	assert.Equal(t, int64(128+syscall.SIGKILL), ret.Exit)
+	assert.Equal(t, "started\n", output(t, ret, "stdout"))
+
+	// So is a command running past the deadline of its context.
+	s = NewShellCommand("slow", "", "sleep", "60")
+	assert.Nil(t, s.Create(ctx, newRequest(nil)))
+	deadlineCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	ret, _ = s.Run(deadlineCtx)
+	assert.Equal(t, state.StateTimeout, ret.State)
+
+	// Stopped while it doesn't run, e.g. while its job waits to run, it still
+	// runs later.
+	s = NewShellCommand("quick", "", "echo", "ran")
+	assert.Nil(t, s.Create(ctx, newRequest(nil)))
+	assert.Nil(t, s.Stop(ctx))
+	ret, _ = s.Run(ctx)
+	assert.Equal(t, state.StateSuccess, ret.State)
+	assert.Equal(t, "ran\n", output(t, ret, "stdout"))
+}
+
+func TestShellCommandArgs(t *testing.T) {
+	ctx := context.Background()
+	a, err := atom.New("command.ShellCommand", "greet", "")
+	assert.Nil(t, err)
+	s := a.(*ShellCommand)
+	assert.Nil(t, s.SetArgs(map[string]interface{}{
+		"argv": []interface{}{"sh", "greet.sh", "{{.name}}", "0"},
+		"env":  []interface{}{"GREETING=hi"},
+		"dir":  "testdata",
+	}))
+	assert.Nil(t, s.Create(ctx, newRequest(map[string]interface{}{"name": "bob"})))
+	ret, _ := s.Run(ctx)
+	assert.Equal(t, state.StateSuccess, ret.State)
+	assert.Equal(t, "hi bob\n", output(t, ret, "stdout"))
+
+	err = s.SetArgs(map[string]interface{}{"argv": "sh greet.sh"})
+	assert.True(t, errors.Is(err, atom.ErrInvalidArg))
+	err = s.SetArgs(map[string]interface{}{"env": []interface{}{1}})
+	assert.True(t, errors.Is(err, atom.ErrInvalidArg))
+	err = s.SetArgs(map[string]interface{}{"cwd": "/"})
+	assert.True(t, errors.Is(err, atom.ErrUnknownArg))
+}
@@ -0,0 +1,94 @@
+package command
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/longsolong/flow/pkg/infra"
+	"go.uber.org/zap"
+)
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func newTailBuffer(max int) *tailBuffer {
+	return &tailBuffer{max: max}
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) >= b.max {
+		b.truncated = b.truncated || len(b.buf) > 0 || len(p) > b.max
+		b.buf = append(b.buf[:0], p[len(p)-b.max:]...)
+		return n, nil
+	}
+	if over := len(b.buf) + len(p) - b.max; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+		b.truncated = true
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
+
+// String returns the bytes kept, after "...\n" if earlier ones were dropped.
+func (b *tailBuffer) String() string {
+	if b.truncated {
+		return "...\n" + string(b.buf)
+	}
+	return string(b.buf)
+}
+
+// lineLogger logs each line written to it. A nil logger logs nothing.
+type lineLogger struct {
+	logger *infra.Logger
+	stream string
+	fields []zap.Field
+
+	mux     sync.Mutex
+	partial []byte // last line, not ended yet
+}
+
+func newLineLogger(logger *infra.Logger, stream string, fields []zap.Field) *lineLogger {
+	return &lineLogger{logger: logger, stream: stream, fields: fields}
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	if l.logger == nil {
+		return len(p), nil
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.partial = append(l.partial, p...)
+	for {
+		i := bytes.IndexByte(l.partial, '\n')
+		if i < 0 {
+			break
+		}
+		l.log(l.partial[:i])
+		l.partial = l.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush logs the last line if it wasn't ended.
+func (l *lineLogger) flush() {
+	if l.logger == nil {
+		return
+	}
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if len(l.partial) > 0 {
+		l.log(l.partial)
+		l.partial = nil
+	}
+}
+
+func (l *lineLogger) log(line []byte) {
+	fields := append([]zap.Field(nil), l.fields...)
+	fields = append(fields, zap.String("stream", l.stream), zap.ByteString("line", line))
+	l.logger.Log.Info("command output", fields...)
+}
@@ -0,0 +1,44 @@
+//go:build !windows
+// +build !windows
+
+package command
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes cmd start in a process group of its own, so stopping
+// it stops the processes it starts too.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateGroup sends SIGTERM to the process group of a started cmd.
+func terminateGroup(cmd *exec.Cmd) error {
+	return signalGroup(cmd, syscall.SIGTERM)
+}
+
+// killGroup sends SIGKILL to the process group of a started cmd.
+func killGroup(cmd *exec.Cmd) error {
+	return signalGroup(cmd, syscall.SIGKILL)
+}
+
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	// The group id is the pid of its leader; a negative pid signals the group.
+	err := syscall.Kill(-cmd.Process.Pid, sig)
+	if err == syscall.ESRCH {
+		return nil // already exited
+	}
+	return err
+}
+
+// exitCode returns the exit code of an exited process, 128 + the signal
+// number if a signal killed it, like sh does.
+func exitCode(ps *os.ProcessState) int64 {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int64(ws.Signal())
+	}
+	return int64(ps.ExitCode())
+}
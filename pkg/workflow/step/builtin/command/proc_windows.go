@@ -0,0 +1,24 @@
+package command
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup does nothing: Windows has no process groups to signal.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateGroup kills a started cmd: Windows has no SIGTERM.
+func terminateGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// killGroup kills a started cmd.
+func killGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// exitCode returns the exit code of an exited process.
+func exitCode(ps *os.ProcessState) int64 {
+	return int64(ps.ExitCode())
+}
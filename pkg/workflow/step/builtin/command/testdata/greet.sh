@@ -0,0 +1,5 @@
+#!/bin/sh
+# Greets $1 with $GREETING, complains on stderr and exits with $2.
+echo "$GREETING $1"
+echo "$GREETING to stderr" >&2
+exit "$2"
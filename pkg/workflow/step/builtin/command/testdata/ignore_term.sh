@@ -0,0 +1,7 @@
+#!/bin/sh
+# Ignores SIGTERM, so only SIGKILL stops it.
+trap '' TERM
+echo started
+while :; do
+	sleep 1
+done
@@ -0,0 +1,6 @@
+#!/bin/sh
+# Starts a child that outlives a plain kill of this shell, writes its pid to
+# $1 and waits.
+sleep 60 &
+echo $! > "$1"
+wait
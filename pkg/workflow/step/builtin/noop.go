@@ -14,6 +14,12 @@ type Noop struct {
 	step.Step
 }
 
+func init() {
+	atom.MustRegister(func(id, expansionDigest string) atom.Atom {
+		return NewNoop(id, expansionDigest)
+	})
+}
+
 // NewNoop ...
 func NewNoop(id, expansionDigest string) *Noop {
 	n := &Noop{}